@@ -0,0 +1,297 @@
+// Package clock is the time that packet and the forwarder go by. Normally that is Real, the
+// wall clock, but with a Virtual clock time only moves when it's told to - so tests of the
+// timeout paths don't have to wait for them, and the simulation (package sim) can skip
+// ahead whenever everything is just waiting.
+//
+// A Virtual clock only makes sense with connections that also go by it, like sim's pipes,
+// read deadlines on a real net.Conn are always wall clock time
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// NewTimer sends the time on its channel once d has passed
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f in its own goroutine once d has passed, the Timer has no channel
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	// Stop is false if the timer already went off, or was stopped
+	Stop() bool
+	// Reset has the timer go off once d has passed from now instead, whether it went off
+	// already or not - it's false if it did, or was stopped. Like time.Timer's, it doesn't
+	// take a time that was sent already off the channel
+	Reset(d time.Duration) bool
+}
+
+// Since is time.Since for c
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Real is the wall clock, the time package
+type Real struct{}
+
+func (Real) Now() time.Time        { return time.Now() }
+func (Real) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{t: time.NewTimer(d)}
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{t: time.AfterFunc(d, f)}
+}
+
+type realTimer struct{ t *time.Timer }
+
+func (r realTimer) C() <-chan time.Time        { return r.t.C }
+func (r realTimer) Stop() bool                 { return r.t.Stop() }
+func (r realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+
+// Virtual is a clock that only moves with Advance, AdvanceToNext or AutoAdvance
+type Virtual struct {
+	m   sync.Mutex
+	now time.Time
+	// sorted by when they go off, then by when they were made
+	waiters []*waiter
+	// closed (and replaced) when waiters are added, for BlockUntil
+	changed chan struct{}
+	// bumped on every call, AutoAdvance only skips ahead when it hasn't moved for a while
+	activity uint64
+}
+
+type waiter struct {
+	v  *Virtual
+	at time.Time
+	c  chan time.Time
+	f  func()
+	// no longer in v.waiters, it went off or was stopped
+	done bool
+}
+
+// NewVirtual starts a Virtual clock at start
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start, changed: make(chan struct{})}
+}
+
+func (v *Virtual) Now() time.Time {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.activity++
+	return v.now
+}
+
+func (v *Virtual) Sleep(d time.Duration) {
+	if d <= 0 {
+		v.m.Lock()
+		v.activity++
+		v.m.Unlock()
+		return
+	}
+	<-v.NewTimer(d).C()
+}
+
+func (v *Virtual) NewTimer(d time.Duration) Timer {
+	return v.add(d, make(chan time.Time, 1), nil)
+}
+
+func (v *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	return v.add(d, nil, f)
+}
+
+func (v *Virtual) add(d time.Duration, c chan time.Time, f func()) *waiter {
+	v.m.Lock()
+	v.activity++
+	w := &waiter{v: v, at: v.now.Add(d), c: c, f: f}
+	if d <= 0 {
+		w.done = true
+		now := v.now
+		v.m.Unlock()
+		w.fire(now)
+		return w
+	}
+	v.insert(w)
+	v.m.Unlock()
+	return w
+}
+
+// insert puts w among the waiters, after the ones that go off at the same time. v.m must
+// be held
+func (v *Virtual) insert(w *waiter) {
+	i := sort.Search(len(v.waiters), func(i int) bool { return v.waiters[i].at.After(w.at) })
+	v.waiters = append(v.waiters, nil)
+	copy(v.waiters[i+1:], v.waiters[i:])
+	v.waiters[i] = w
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+// remove takes w out of the waiters, v.m must be held
+func (v *Virtual) remove(w *waiter) {
+	for i, o := range v.waiters {
+		if o == w {
+			v.waiters = append(v.waiters[:i], v.waiters[i+1:]...)
+			break
+		}
+	}
+}
+
+func (w *waiter) fire(now time.Time) {
+	if w.f != nil {
+		go w.f()
+		return
+	}
+	select {
+	case w.c <- now:
+	default:
+	}
+}
+
+func (w *waiter) C() <-chan time.Time { return w.c }
+
+func (w *waiter) Stop() bool {
+	v := w.v
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.activity++
+	if w.done {
+		return false
+	}
+	w.done = true
+	v.remove(w)
+	return true
+}
+
+func (w *waiter) Reset(d time.Duration) bool {
+	v := w.v
+	v.m.Lock()
+	v.activity++
+	active := !w.done
+	if active {
+		v.remove(w)
+	}
+	w.at = v.now.Add(d)
+	if d <= 0 {
+		w.done = true
+		now := v.now
+		v.m.Unlock()
+		w.fire(now)
+		return active
+	}
+	w.done = false
+	v.insert(w)
+	v.m.Unlock()
+	return active
+}
+
+// Advance moves the clock d ahead, every timer on the way goes off at its own time
+func (v *Virtual) Advance(d time.Duration) {
+	v.m.Lock()
+	end := v.now.Add(d)
+	v.m.Unlock()
+	for v.fireNext(end) {
+	}
+	v.m.Lock()
+	if end.After(v.now) {
+		v.now = end
+	}
+	v.m.Unlock()
+}
+
+// AdvanceToNext moves the clock to when the next timer goes off (and sets off every timer
+// due then), false if there are none
+func (v *Virtual) AdvanceToNext() bool {
+	v.m.Lock()
+	if len(v.waiters) == 0 {
+		v.m.Unlock()
+		return false
+	}
+	at := v.waiters[0].at
+	v.m.Unlock()
+	for v.fireNext(at) {
+	}
+	return true
+}
+
+// fireNext sets off the first timer if it's due by end
+func (v *Virtual) fireNext(end time.Time) bool {
+	v.m.Lock()
+	if len(v.waiters) == 0 || v.waiters[0].at.After(end) {
+		v.m.Unlock()
+		return false
+	}
+	w := v.waiters[0]
+	v.waiters = v.waiters[1:]
+	w.done = true
+	if w.at.After(v.now) {
+		v.now = w.at
+	}
+	now := v.now
+	v.activity++
+	v.m.Unlock()
+	w.fire(now)
+	return true
+}
+
+// Waiters is how many timers (sleeps included) haven't gone off yet
+func (v *Virtual) Waiters() int {
+	v.m.Lock()
+	defer v.m.Unlock()
+	return len(v.waiters)
+}
+
+// BlockUntil waits (in real time) till there are at least n timers, e.g. till a Recv in
+// another goroutine is waiting for its deadline, so Advance can't come too early
+func (v *Virtual) BlockUntil(n int) {
+	for {
+		v.m.Lock()
+		if len(v.waiters) >= n {
+			v.m.Unlock()
+			return
+		}
+		changed := v.changed
+		v.m.Unlock()
+		<-changed
+	}
+}
+
+// AutoAdvance skips ahead to the next timer every time nothing has used the clock for idle
+// (real time) - that is, when everything is waiting for a timer or for a packet that is only
+// coming after one. It is a guess, something busy for longer than idle without looking at
+// the clock can see time jump. Call stop to turn it off again
+func (v *Virtual) AutoAdvance(idle time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		var last uint64
+		t := time.NewTicker(idle)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			v.m.Lock()
+			quiet := v.activity == last
+			last = v.activity
+			v.m.Unlock()
+			if quiet {
+				v.AdvanceToNext()
+				v.m.Lock()
+				last = v.activity
+				v.m.Unlock()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
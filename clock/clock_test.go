@@ -0,0 +1,197 @@
+package clock_test
+
+import (
+	"errors"
+	"handin2/clock"
+	"handin2/sim"
+	"os"
+	"testing"
+	"time"
+)
+
+var epoch = time.Unix(0, 0)
+
+// fired is the time t went off with, false if it hasn't
+func fired(t clock.Timer) (time.Time, bool) {
+	select {
+	case at := <-t.C():
+		return at, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// timers go off in the order they're due, each with its own time even when Advance goes past
+// several of them at once
+func TestVirtualOrder(t *testing.T) {
+	v := clock.NewVirtual(epoch)
+	timers := make([]clock.Timer, 4)
+	for i, d := range []time.Duration{3, 1, 2, 2} {
+		timers[i] = v.NewTimer(d * time.Second)
+	}
+	v.Advance(2500 * time.Millisecond)
+	for i, due := range []time.Duration{0, 1, 2, 2} {
+		at, ok := fired(timers[i])
+		if due == 0 && ok {
+			t.Fatalf("timer %d: went off at %v, it's due at 3s", i, at.Sub(epoch))
+		}
+		if due > 0 && (!ok || !at.Equal(epoch.Add(due*time.Second))) {
+			t.Fatalf("timer %d: went off %v at %v, expected at %v", i, ok, at.Sub(epoch), due*time.Second)
+		}
+	}
+	if now := v.Now(); !now.Equal(epoch.Add(2500 * time.Millisecond)) {
+		t.Fatalf("clock is at %v, expected 2.5s", now.Sub(epoch))
+	}
+	if !v.AdvanceToNext() {
+		t.Fatal("AdvanceToNext: no timers left")
+	}
+	if at, ok := fired(timers[0]); !ok || !at.Equal(epoch.Add(3*time.Second)) {
+		t.Fatalf("timer 0: went off %v at %v, expected at 3s", ok, at.Sub(epoch))
+	}
+	if v.AdvanceToNext() || v.Waiters() != 0 {
+		t.Fatalf("%d waiters left after everything went off", v.Waiters())
+	}
+
+	// AfterFunc runs f in a goroutine of its own, so only the ones that went off at different
+	// times can be told apart
+	done := make(chan int, 3)
+	for i, d := range []time.Duration{2, 1, 2} {
+		v.AfterFunc(d*time.Second, func() { done <- i })
+	}
+	v.Advance(time.Second)
+	if i := <-done; i != 1 {
+		t.Fatalf("AfterFunc %d went off first, expected 1", i)
+	}
+	v.Advance(time.Second)
+	if i, j := <-done, <-done; i+j != 2 {
+		t.Fatalf("AfterFunc %d and %d went off second, expected 0 and 2", i, j)
+	}
+}
+
+func TestVirtualStop(t *testing.T) {
+	v := clock.NewVirtual(epoch)
+	timer := v.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Fatal("Stop of a timer that's waiting is false")
+	}
+	if timer.Stop() {
+		t.Fatal("Stop of a stopped timer is true")
+	}
+	v.Advance(2 * time.Second)
+	if _, ok := fired(timer); ok {
+		t.Fatal("a stopped timer went off")
+	}
+
+	timer = v.NewTimer(time.Second)
+	v.Advance(time.Second)
+	if timer.Stop() {
+		t.Fatal("Stop of a timer that went off is true")
+	}
+	if _, ok := fired(timer); !ok {
+		t.Fatal("Stop took the time it went off with off the channel")
+	}
+}
+
+func TestVirtualReset(t *testing.T) {
+	v := clock.NewVirtual(epoch)
+	timer := v.NewTimer(time.Second)
+	// it's waiting, so it goes off 2s from now instead of 1s
+	if !timer.Reset(2 * time.Second) {
+		t.Fatal("Reset of a timer that's waiting is false")
+	}
+	if v.Waiters() != 1 {
+		t.Fatalf("%d waiters after Reset, expected 1", v.Waiters())
+	}
+	v.Advance(time.Second)
+	if _, ok := fired(timer); ok {
+		t.Fatal("went off at the time it was reset from")
+	}
+	v.Advance(time.Second)
+	if at, ok := fired(timer); !ok || !at.Equal(epoch.Add(2*time.Second)) {
+		t.Fatalf("went off %v at %v, expected at 2s", ok, at.Sub(epoch))
+	}
+
+	// and once it went off (or was stopped) Reset starts it again
+	if timer.Reset(time.Second) {
+		t.Fatal("Reset of a timer that went off is true")
+	}
+	v.Advance(time.Second)
+	if at, ok := fired(timer); !ok || !at.Equal(epoch.Add(3*time.Second)) {
+		t.Fatalf("went off %v at %v after Reset, expected at 3s", ok, at.Sub(epoch))
+	}
+	timer.Stop()
+	timer.Reset(0)
+	if _, ok := fired(timer); !ok {
+		t.Fatal("Reset(0) didn't go off straight away")
+	}
+}
+
+// with nothing else using the clock, a sleep of an hour is over in a few milliseconds
+func TestAutoAdvance(t *testing.T) {
+	v := clock.NewVirtual(epoch)
+	stop := v.AutoAdvance(time.Millisecond)
+	defer stop()
+	slept := make(chan struct{})
+	go func() {
+		v.Sleep(time.Hour)
+		close(slept)
+	}()
+	select {
+	case <-slept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AutoAdvance didn't skip ahead to the end of the sleep")
+	}
+	if now := v.Now(); now.Before(epoch.Add(time.Hour)) {
+		t.Fatalf("clock is at %v after sleeping an hour", now.Sub(epoch))
+	}
+
+	// and after stop it stays where it is
+	stop()
+	v.NewTimer(time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if v.Waiters() != 1 {
+		t.Fatal("AutoAdvance skipped ahead after it was stopped")
+	}
+}
+
+// read deadlines on sim's pipes go by the clock they're given
+func TestPipeDeadline(t *testing.T) {
+	v := clock.NewVirtual(epoch)
+	a, b := sim.Pipe(v, "a", "b")
+	defer a.Close()
+	read := func() <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := a.Read(make([]byte, 16))
+			done <- err
+		}()
+		return done
+	}
+
+	a.SetReadDeadline(v.Now().Add(time.Second))
+	done := read()
+	v.BlockUntil(1)
+	v.Advance(999 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Read returned %v before the deadline", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	v.Advance(time.Millisecond)
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	// a deadline that has passed already doesn't wait at all
+	if err := <-read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+
+	// something that comes before it is read, however far off the deadline is in real time
+	a.SetReadDeadline(v.Now().Add(time.Hour))
+	done = read()
+	v.BlockUntil(1)
+	b.Write([]byte("hi"))
+	if err := <-done; err != nil {
+		t.Fatalf("expected to read what was written, got %v", err)
+	}
+}
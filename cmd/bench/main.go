@@ -0,0 +1,217 @@
+// bench runs batches of transfers through an in-process forwarder (see package sim) for every
+// combination of payload size, window, drop, corruption and jitter it's given, and writes a
+// table of how the protocol did - goodput, completion time percentiles of the transfers that
+// went through, restarts and retransmitted bytes. Time is virtual by default like in cmd/sim,
+// so goodput and completion times are in simulated time
+//
+//	$ go run ./cmd/bench -size 1024,65536 -window 512,8192 -drop 0,10 -jitter false,true
+//	$ go run ./cmd/bench -format csv -o results.csv
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"handin2/clock"
+	"handin2/forwarder"
+	"handin2/packet"
+	"handin2/sim"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var columns = []string{"size", "window", "drop %", "zero %", "jitter", "ok", "goodput KiB/s", "p50 ms", "p90 ms", "p99 ms", "max ms", "restarts", "retransmitted"}
+
+func main() {
+	sizes := flag.String("size", "1024,16384", "comma separated bytes per transfer")
+	windows := flag.String("window", "512,4096", "comma separated bytes per segment, 0 finds the largest that gets through")
+	drops := flag.String("drop", "0,5,15", "comma separated drop percentages")
+	zeros := flag.String("zero", "0,5", "comma separated percentages of packets to have a byte zeroed")
+	jitters := flag.String("jitter", "false,true", "comma separated, whether packets queued for a destination get shuffled")
+	transfers := flag.Int("transfers", 50, "transfers per batch")
+	pairs := flag.Int("pairs", 10, "pairs of endpoints transferring side by side")
+	duplicate := flag.Int("duplicate", 0, "percentage of packets to send twice")
+	mtu := flag.Int("mtu", 0, "largest packet in bytes a link takes, 0 is unlimited")
+	fragment := flag.Bool("fragment", false, "fragment packets bigger than -mtu instead of dropping them")
+	tolerance := flag.Uint("tolerance", 10, "restarts allowed per transfer")
+	wait := flag.Uint("wait", 10, "seconds the receiver waits for a START")
+	latency := flag.Duration("latency", time.Millisecond, "time between packets written to an endpoint")
+	cc := flag.String("cc", "reno", "congestion control, reno or cubic")
+	timestamps := flag.Bool("timestamps", true, "offer and answer the timestamps option")
+	format := flag.String("format", "markdown", "markdown or csv")
+	out := flag.String("o", "", "file to write the table to, instead of stdout")
+	virtual := flag.Bool("virtual", true, "use a virtual clock, false runs in real time")
+	idle := flag.Duration("idle", 2*time.Millisecond, "with -virtual, how long (real time) nothing has to happen before the clock skips to the next timer")
+	flag.Parse()
+
+	// errors and progress go to stderr, so the table can be redirected on its own
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	packet.SetLogger(nil)
+	packet.SetTimestamps(*timestamps)
+	switch *cc {
+	case "reno":
+		packet.SetCongestionControl(packet.NewReno)
+	case "cubic":
+		packet.SetCongestionControl(packet.NewCubic)
+	default:
+		fail(fmt.Errorf("unknown congestion control %q", *cc))
+	}
+	if *format != "markdown" && *format != "csv" {
+		fail(fmt.Errorf("unknown format %q", *format))
+	}
+	if *tolerance > 0xffff || *wait > 0xff {
+		fail(errors.New("tolerance or wait is too large"))
+	}
+	sizeList, err := ints(*sizes, 0, 0xffff*0xffff)
+	if err != nil {
+		fail(fmt.Errorf("-size: %w", err))
+	}
+	windowList, err := ints(*windows, 0, 0xffff)
+	if err != nil {
+		fail(fmt.Errorf("-window: %w", err))
+	}
+	dropList, err := ints(*drops, 0, 100)
+	if err != nil {
+		fail(fmt.Errorf("-drop: %w", err))
+	}
+	zeroList, err := ints(*zeros, 0, 100)
+	if err != nil {
+		fail(fmt.Errorf("-zero: %w", err))
+	}
+	// the rest of the impairments are the same for every batch
+	if err := (forwarder.Impairments{Duplicate: *duplicate, MTU: *mtu}).Validate(); err != nil {
+		fail(err)
+	}
+	var jitterList []bool
+	for _, j := range strings.Split(*jitters, ",") {
+		b, err := strconv.ParseBool(strings.TrimSpace(j))
+		if err != nil {
+			fail(fmt.Errorf("-jitter: %w", err))
+		}
+		jitterList = append(jitterList, b)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var clk clock.Clock = clock.Real{}
+	if *virtual {
+		v := clock.NewVirtual(time.Now())
+		stop := v.AutoAdvance(*idle)
+		defer stop()
+		clk = v
+	}
+	packet.SetClock(clk)
+
+	var rows [][]string
+	batches := len(sizeList) * len(windowList) * len(dropList) * len(zeroList) * len(jitterList)
+	for _, size := range sizeList {
+		for _, window := range windowList {
+			for _, drop := range dropList {
+				for _, zero := range zeroList {
+					for _, jitter := range jitterList {
+						fmt.Fprintf(os.Stderr, "%d/%d: size %d, window %d, drop %d%%, zero %d%%, jitter %v\n",
+							len(rows)+1, batches, size, window, drop, zero, jitter)
+						cfg := forwarder.Config{
+							Impairments: forwarder.Impairments{Jitter: jitter, Drop: drop, Zero: zero, Duplicate: *duplicate, MTU: *mtu, Fragment: *fragment},
+							Latency:     *latency,
+							Clock:       clk,
+						}
+						b := sim.Batch{Transfers: *transfers, Pairs: *pairs, Size: size,
+							Window: uint16(window), Tolerance: uint16(*tolerance), Wait: uint8(*wait)}
+						sum, err := sim.Run(cfg, b)
+						if err != nil {
+							fail(err)
+						}
+						for _, e := range sum.ErrorList() {
+							fmt.Fprintf(os.Stderr, "\t%dx %s\n", sum.Errors[e], e)
+						}
+						rows = append(rows, row(size, window, drop, zero, jitter, sum))
+					}
+				}
+			}
+		}
+	}
+
+	if *format == "csv" {
+		err = writeCSV(w, rows)
+	} else {
+		err = writeMarkdown(w, rows)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// ints parses a comma separated list, every number has to be in [lo, hi]
+func ints(s string, lo int, hi int) ([]int, error) {
+	var list []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		if n < lo || n > hi {
+			return nil, fmt.Errorf("%d isn't between %d and %d", n, lo, hi)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+func row(size int, window int, drop int, zero int, jitter bool, sum sim.Summary) []string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	}
+	return []string{
+		strconv.Itoa(size),
+		strconv.Itoa(window),
+		strconv.Itoa(drop),
+		strconv.Itoa(zero),
+		strconv.FormatBool(jitter),
+		fmt.Sprintf("%d/%d", sum.OK, sum.OK+sum.Failed),
+		strconv.FormatFloat(sum.Goodput()/1024, 'f', 1, 64),
+		ms(sum.Percentile(50)),
+		ms(sum.Percentile(90)),
+		ms(sum.Percentile(99)),
+		ms(sum.Percentile(100)),
+		strconv.Itoa(sum.Restarts),
+		strconv.Itoa(sum.Retransmitted),
+	}
+}
+
+func writeCSV(w io.Writer, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	return cw.WriteAll(rows)
+}
+
+// the numbers are right aligned
+func writeMarkdown(w io.Writer, rows [][]string) error {
+	align := make([]string, len(columns))
+	for i := range align {
+		align[i] = "---:"
+	}
+	lines := []string{"| " + strings.Join(columns, " | ") + " |", "|" + strings.Join(align, "|") + "|"}
+	for _, r := range rows {
+		lines = append(lines, "| "+strings.Join(r, " | ")+" |")
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
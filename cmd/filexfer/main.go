@@ -0,0 +1,325 @@
+// filexfer sends files through the forwarder, on top of packet.SendStream/RecvStream
+//
+//	$ go run ./cmd/filexfer recv -dir downloads
+//	$ go run ./cmd/filexfer send some/file.bin other.txt
+//
+// every file starts with its name, size, mode and SHA-256 - the receiver answers with how much
+// of it it already has (from an earlier transfer that got interrupted), the sender continues from
+// there and once the rest is in, the receiver checks the SHA-256 of the whole thing and tells
+// the sender whether it matched. Until then the file is kept as <name>.part, next to a
+// <name>.part.json with the metadata, so a resumed transfer can tell it's the same file
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"handin2/packet"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type meta struct {
+	Name   string      `json:"name"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// the receiver's answer to meta
+type offset struct {
+	Offset int64 `json:"offset"`
+}
+
+// the receiver's answer once the stream is over
+type result struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: filexfer send [flags] file...")
+	fmt.Fprintln(os.Stderr, "       filexfer recv [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	mode := os.Args[1]
+	fs := flag.NewFlagSet("filexfer "+mode, flag.ExitOnError)
+	addr := fs.String("addr", "localhost:4004", "address of the forwarder")
+	level := fs.String("log-level", "warn", "debug, info, warn, error or off")
+	window := fs.Uint("window", 1024, "bytes per segment, 0 finds the largest that gets through")
+	tolerance := fs.Uint("tolerance", 10, "restarts allowed per chunk of 64 segments")
+	wait := fs.Uint("wait", 10, "seconds to wait for the other side before giving up")
+	cc := fs.String("cc", "reno", "congestion control, reno or cubic")
+	var id, to *string
+	var dir *string
+	switch mode {
+	case "send":
+		id = fs.String("id", "c", "our id with the forwarder")
+		to = fs.String("to", "s", "id of the receiver")
+	case "recv":
+		id = fs.String("id", "s", "our id with the forwarder")
+		dir = fs.String("dir", ".", "where received files are put")
+	default:
+		usage()
+	}
+	fs.Parse(os.Args[2:])
+
+	logger, err := packet.NewTextLogger(os.Stderr, *level)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	packet.SetLogger(logger)
+
+	switch *cc {
+	case "reno":
+		packet.SetCongestionControl(packet.NewReno)
+	case "cubic":
+		packet.SetCongestionControl(packet.NewCubic)
+	default:
+		fmt.Printf("unknown congestion control %q\n", *cc)
+		return
+	}
+
+	if len(*id) != 1 || (to != nil && len(*to) != 1) {
+		fmt.Println("ids have to be a single character")
+		return
+	}
+	if *window > 0xffff || *tolerance > 0xffff || *wait > 0xff {
+		fmt.Println("window, tolerance or wait is too large")
+		return
+	}
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		logger.Error("dial", "addr", *addr, "err", err)
+		return
+	}
+	c := packet.NewConn(conn)
+	defer c.Close()
+	// register with the forwarder, see pseudo_client.go
+	c.Write([]byte{(*id)[0]})
+
+	x := &xfer{c: c, id: (*id)[0], window: uint16(*window), tolerance: uint16(*tolerance), wait: uint8(*wait)}
+	if mode == "send" {
+		if fs.NArg() == 0 {
+			usage()
+		}
+		for _, path := range fs.Args() {
+			if err := x.send(path, (*to)[0]); err != nil {
+				logger.Error("send", "file", path, "err", err)
+				os.Exit(1)
+			}
+		}
+		// so the receiver knows there's nothing more coming from us
+		if err := packet.Close(c, x.id, (*to)[0], x.tolerance); err != nil {
+			logger.Error("close", "err", err)
+		}
+		return
+	}
+	for {
+		if err := x.recv(*dir); err != nil {
+			logger.Error("recv", "err", err)
+		}
+	}
+}
+
+type xfer struct {
+	c         net.Conn
+	id        byte
+	window    uint16
+	tolerance uint16
+	wait      uint8
+}
+
+func (x *xfer) sendJSON(dest byte, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return packet.Send(x.c, x.id, dest, b, uint16(len(b)), x.tolerance)
+}
+
+func (x *xfer) recvJSON(from byte, wait uint8, v any) error {
+	data, src, err := packet.Recv(x.c, x.id, wait)
+	if err != nil {
+		return err
+	}
+	if src != from {
+		return fmt.Errorf("expected an answer from %c, got one from %c", from, src)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (x *xfer) send(path string, dest byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	sum, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	m := meta{Name: filepath.Base(path), Size: info.Size(), Mode: info.Mode().Perm(), SHA256: sum}
+	if err := x.sendJSON(dest, m); err != nil {
+		return err
+	}
+	var off offset
+	if err := x.recvJSON(dest, x.wait, &off); err != nil {
+		return err
+	}
+	if off.Offset < 0 || off.Offset > m.Size {
+		return fmt.Errorf("receiver wants to resume from %d, but the file is %d bytes", off.Offset, m.Size)
+	}
+	if off.Offset > 0 {
+		fmt.Printf("%s: resuming from %d of %d bytes\n", m.Name, off.Offset, m.Size)
+	}
+	if _, err := f.Seek(off.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	n, err := packet.SendStream(x.c, x.id, dest, f, x.window, x.tolerance)
+	if err != nil {
+		return fmt.Errorf("interrupted after %d bytes, run again to resume: %w", off.Offset+n, err)
+	}
+	var res result
+	if err := x.recvJSON(dest, x.wait, &res); err != nil {
+		return err
+	}
+	if !res.OK {
+		return fmt.Errorf("receiver rejected the file: %s", res.Error)
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("%s: sent %d bytes in %s (%.1f KiB/s), SHA-256 %s verified\n",
+		m.Name, n, elapsed.Truncate(time.Millisecond), float64(n)/1024/elapsed.Seconds(), m.SHA256)
+	return nil
+}
+
+func (x *xfer) recv(dir string) error {
+	data, from, err := packet.Recv(x.c, x.id, 0)
+	var closed *packet.ClosedError
+	if errors.As(err, &closed) {
+		// the sender is done (or gone), there might be another one later
+		fmt.Println(closed)
+		if !closed.Reset {
+			return packet.Close(x.c, x.id, from, x.tolerance)
+		}
+		return nil
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			// the forwarder is gone, there's nothing left to wait for
+			fmt.Println("connection closed")
+			os.Exit(1)
+		}
+		return err
+	}
+	var m meta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("transfer from %c isn't file metadata: %w", from, err)
+	}
+	name := filepath.Base(m.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return fmt.Errorf("bad file name %q", m.Name)
+	}
+	path := filepath.Join(dir, name)
+	part, partMeta := path+".part", path+".part.json"
+
+	// only resume if what we have is the start of the same file
+	var have int64
+	var old meta
+	if b, err := os.ReadFile(partMeta); err == nil && json.Unmarshal(b, &old) == nil && old == m {
+		if info, err := os.Stat(part); err == nil && info.Size() <= m.Size {
+			have = info.Size()
+		}
+	}
+	if have == 0 {
+		b, _ := json.Marshal(m)
+		if err := os.WriteFile(partMeta, b, 0644); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(have); err != nil {
+		return err
+	}
+	if _, err := f.Seek(have, io.SeekStart); err != nil {
+		return err
+	}
+	if have > 0 {
+		fmt.Printf("%s from <%c>: resuming from %d of %d bytes\n", name, from, have, m.Size)
+	}
+	if err := x.sendJSON(from, offset{have}); err != nil {
+		return err
+	}
+
+	// what RecvStream wrote has been confirmed to the sender, so it's kept even if it fails
+	n, _, err := packet.RecvStream(x.c, x.id, f, x.wait)
+	if err != nil {
+		return fmt.Errorf("%s interrupted after %d bytes, kept as %s: %w", name, have+n, part, err)
+	}
+	f.Close()
+
+	res := result{OK: true}
+	sum, err := hashFile(part)
+	if err != nil {
+		return err
+	}
+	if sum != m.SHA256 {
+		res = result{Error: fmt.Sprintf("SHA-256 mismatch, got %s", sum)}
+		os.Remove(part)
+		os.Remove(partMeta)
+	} else {
+		if err := os.Rename(part, path); err != nil {
+			return err
+		}
+		os.Remove(partMeta)
+		// only the permission bits, a sender doesn't get to make it setuid or a directory
+		if err := os.Chmod(path, m.Mode.Perm()); err != nil {
+			res = result{Error: fmt.Sprintf("received, but the mode couldn't be set: %v", err)}
+		} else {
+			fmt.Printf("%s from <%c>: %d bytes, SHA-256 %s verified\n", name, from, have+n, sum)
+		}
+	}
+	if err := x.sendJSON(from, res); err != nil {
+		return err
+	}
+	if !res.OK {
+		return fmt.Errorf("%s: %s", name, res.Error)
+	}
+	return nil
+}
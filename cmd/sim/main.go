@@ -0,0 +1,121 @@
+// sim runs batches of transfers through an in-process forwarder (see package sim), one batch
+// per drop percentage, and prints how they went. By default time is virtual, so waiting for
+// timeouts costs next to nothing - mean, max and elapsed are in simulated time, wall is how
+// long it really took. A batch with transfers delivered more than once is warned about, and
+// sim exits with 1
+//
+//	$ go run ./cmd/sim -transfers 200 -drop 0,5,10,20
+package main
+
+import (
+	"flag"
+	"fmt"
+	"handin2/clock"
+	"handin2/forwarder"
+	"handin2/packet"
+	"handin2/sim"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	transfers := flag.Int("transfers", 200, "transfers per batch")
+	pairs := flag.Int("pairs", 20, "pairs of endpoints transferring side by side")
+	size := flag.Int("size", 8192, "bytes per transfer")
+	window := flag.Uint("window", 512, "bytes per segment, 0 finds the largest that gets through")
+	tolerance := flag.Uint("tolerance", 10, "restarts allowed per transfer")
+	wait := flag.Uint("wait", 10, "seconds the receiver waits for a START")
+	latency := flag.Duration("latency", time.Millisecond, "time between packets written to an endpoint")
+	drops := flag.String("drop", "0,5,10,20", "comma separated drop percentages, one batch each")
+	zero := flag.Int("zero", 0, "percentage of packets to have a byte zeroed")
+	duplicate := flag.Int("duplicate", 0, "percentage of packets to send twice")
+	jitter := flag.Bool("jitter", false, "shuffle packets queued for a destination")
+	mtu := flag.Int("mtu", 0, "largest packet in bytes a link takes, 0 is unlimited")
+	fragment := flag.Bool("fragment", false, "fragment packets bigger than -mtu instead of dropping them")
+	cc := flag.String("cc", "reno", "congestion control, reno or cubic")
+	level := flag.String("log-level", "off", "debug, info, warn, error or off")
+	virtual := flag.Bool("virtual", true, "use a virtual clock, false runs in real time")
+	idle := flag.Duration("idle", 2*time.Millisecond, "with -virtual, how long (real time) nothing has to happen before the clock skips to the next timer")
+	flag.Parse()
+
+	logger, err := packet.NewTextLogger(os.Stderr, *level)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	packet.SetLogger(logger)
+	switch *cc {
+	case "reno":
+		packet.SetCongestionControl(packet.NewReno)
+	case "cubic":
+		packet.SetCongestionControl(packet.NewCubic)
+	default:
+		fmt.Printf("unknown congestion control %q\n", *cc)
+		return
+	}
+	if *window > 0xffff || *tolerance > 0xffff || *wait > 0xff {
+		fmt.Println("window, tolerance or wait is too large")
+		return
+	}
+
+	// every batch is checked before the first one runs
+	var imps []forwarder.Impairments
+	for _, d := range strings.Split(*drops, ",") {
+		drop, err := strconv.Atoi(strings.TrimSpace(d))
+		if err != nil {
+			fmt.Printf("bad drop percentage %q\n", d)
+			os.Exit(2)
+		}
+		imp := forwarder.Impairments{Jitter: *jitter, Drop: drop, Zero: *zero, Duplicate: *duplicate, MTU: *mtu, Fragment: *fragment}
+		if err := imp.Validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		imps = append(imps, imp)
+	}
+
+	b := sim.Batch{Transfers: *transfers, Pairs: *pairs, Size: *size,
+		Window: uint16(*window), Tolerance: uint16(*tolerance), Wait: uint8(*wait)}
+	fmt.Printf("%d transfers of %d bytes, %d at a time, window %d, zero %d%%, duplicate %d%%, jitter %v\n\n",
+		b.Transfers, b.Size, b.Pairs, b.Window, *zero, *duplicate, *jitter)
+	var clk clock.Clock = clock.Real{}
+	if *virtual {
+		v := clock.NewVirtual(time.Now())
+		stop := v.AutoAdvance(*idle)
+		defer stop()
+		clk = v
+	}
+	packet.SetClock(clk)
+
+	redelivered := false
+	fmt.Printf("%6s %10s %10s %10s %9s %14s %12s %10s %10s\n", "drop", "ok", "mean", "max", "restarts", "retransmitted", "redelivered", "elapsed", "wall")
+	for _, imp := range imps {
+		cfg := forwarder.Config{
+			Impairments: imp,
+			Logger:      logger,
+			Latency:     *latency,
+			Clock:       clk,
+		}
+		sum, err := sim.Run(cfg, b)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%5d%% %10s %10s %10s %9d %14d %12d %10s %10s\n", imp.Drop,
+			fmt.Sprintf("%d/%d", sum.OK, sum.OK+sum.Failed),
+			sum.Mean().Truncate(time.Millisecond), sum.Max.Truncate(time.Millisecond),
+			sum.Restarts, sum.Retransmitted, sum.Redelivered, sum.Elapsed.Truncate(time.Millisecond), sum.Wall.Truncate(time.Millisecond))
+		for _, e := range sum.ErrorList() {
+			fmt.Printf("%6s %dx %s\n", "", sum.Errors[e], e)
+		}
+		if sum.Redelivered > 0 {
+			fmt.Printf("%6s warning: %d transfers were delivered more than once\n", "", sum.Redelivered)
+			redelivered = true
+		}
+	}
+	if redelivered {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,334 @@
+// Package dashboard is a terminal UI for a running forwarder, it shows who is
+// registered, what goes over each link and a scrolling log of decoded packets,
+// and lets the impairments be changed while it's running.
+//
+// it only uses ANSI escape codes and stty, so it works in any unix-ish terminal
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"handin2/clock"
+	"handin2/forwarder"
+	"handin2/packet"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// how many packets to keep around for the log
+const logLines = 500
+
+const help = "[j] jitter  [d/D] drop -/+  [z/Z] zero -/+  [u/U] duplicate -/+  [c] clear log  [q] quit"
+
+type Dashboard struct {
+	f     *forwarder.Forwarder
+	title string
+
+	m sync.Mutex
+	// the last logLines events as they came from the forwarder, a ring starting at next -
+	// they're only decoded when they're drawn, Tap is called with the forwarder locked
+	log  [logLines]forwarder.Event
+	next int
+	n    int
+
+	// In counters from the last frame, to get rates
+	last     map[[2]byte]uint64
+	lastTime time.Time
+}
+
+func New(f *forwarder.Forwarder, title string) *Dashboard {
+	d := &Dashboard{f: f, title: title, last: make(map[[2]byte]uint64)}
+	f.Tap(d.record)
+	return d
+}
+
+func (d *Dashboard) record(ev forwarder.Event) {
+	d.m.Lock()
+	// ev.Packet is only valid during the call, it goes in the slot's own slice
+	slot := &d.log[d.next]
+	slot.Time, slot.What = ev.Time, ev.What
+	slot.Packet = append(slot.Packet[:0], ev.Packet...)
+	d.next = (d.next + 1) % logLines
+	d.n = min(d.n+1, logLines)
+	d.m.Unlock()
+}
+
+// latest is a copy of the last n events logged, oldest first
+func (d *Dashboard) latest(n int) []forwarder.Event {
+	d.m.Lock()
+	defer d.m.Unlock()
+	n = min(n, d.n)
+	evs := make([]forwarder.Event, n)
+	for i := range evs {
+		ev := d.log[(d.next-n+i+logLines)%logLines]
+		ev.Packet = bytes.Clone(ev.Packet)
+		evs[i] = ev
+	}
+	return evs
+}
+
+func describe(p []byte) string {
+	var pk packet.Packet
+	err := pk.UnmarshalBinary(p)
+	var bad packet.DecodeError
+	if errors.As(err, &bad) && bad.Corrupt() {
+		return fmt.Sprintf("corrupt, %d bytes", len(p))
+	}
+	s := fmt.Sprintf("%c->%c %-13s seq=%-5d epoch=%-5d size=%-5d data=%d", pk.Src, pk.Dest, packet.FmtFlags(pk.Flag), pk.Seq, pk.Epoch, pk.Size, len(pk.Data))
+	if err == packet.ErrOptions {
+		s += " (bad options)"
+	} else if err != nil {
+		s += " (bad checksum)"
+	}
+	return s
+}
+
+// Run draws to out every interval and handles keys from in, till q is pressed, in is closed
+// or ctx is done (e.g. on ^C, so whoever put the terminal in raw mode gets to restore it)
+func (d *Dashboard) Run(ctx context.Context, in io.Reader, out io.Writer, interval time.Duration) error {
+	keys := make(chan byte)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(keys)
+		b := make([]byte, 1)
+		for {
+			if _, err := in.Read(b); err != nil {
+				return
+			}
+			select {
+			case keys <- b[0]:
+			case <-done:
+				return
+			}
+		}
+	}()
+	// a Read that's waiting for a key is interrupted if in can have a deadline, if it can't
+	// (stdin on a terminal usually can't) the reader stops at the next key instead of being
+	// stuck handing it over
+	if dl, ok := in.(interface{ SetReadDeadline(time.Time) error }); ok {
+		defer dl.SetReadDeadline(time.Now())
+	}
+
+	// alternate screen & hidden cursor, put back on the way out
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		d.draw(out)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		case k, ok := <-keys:
+			if !ok || k == 'q' {
+				return nil
+			}
+			d.key(k)
+		}
+	}
+}
+
+func (d *Dashboard) key(k byte) {
+	imp := d.f.Impairments()
+	switch k {
+	case 'j':
+		imp.Jitter = !imp.Jitter
+	case 'd':
+		imp.Drop = clamp(imp.Drop - 5)
+	case 'D':
+		imp.Drop = clamp(imp.Drop + 5)
+	case 'z':
+		imp.Zero = clamp(imp.Zero - 5)
+	case 'Z':
+		imp.Zero = clamp(imp.Zero + 5)
+	case 'u':
+		imp.Duplicate = clamp(imp.Duplicate - 5)
+	case 'U':
+		imp.Duplicate = clamp(imp.Duplicate + 5)
+	case 'c':
+		d.m.Lock()
+		d.n = 0
+		d.m.Unlock()
+		return
+	default:
+		return
+	}
+	d.f.SetImpairments(imp)
+}
+
+// 0 means there's no limit
+func unlimited(v int, unit string) string {
+	if v == 0 {
+		return "off"
+	}
+	return strconv.Itoa(v) + unit
+}
+
+// mtu says what happens to bigger packets too
+func mtu(imp forwarder.Impairments) string {
+	if imp.MTU > 0 && imp.Fragment {
+		return unlimited(imp.MTU, "B fragmenting")
+	}
+	return unlimited(imp.MTU, "B")
+}
+
+func clamp(p int) int {
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+func (d *Dashboard) draw(out io.Writer) {
+	rows, cols := size()
+	var b bytes.Buffer
+	lines := 0
+	line := func(format string, args ...any) {
+		b.WriteString(cut(fmt.Sprintf(format, args...), cols))
+		b.WriteString("\x1b[K\r\n")
+		lines++
+	}
+	bold := func(s string) string { return "\x1b[1m" + s + "\x1b[0m" }
+
+	// ages and rates go by the forwarder's clock, it might not be the wall clock
+	clk := d.f.Clock()
+	imp := d.f.Impairments()
+	jitter := "off"
+	if imp.Jitter {
+		jitter = "on"
+	}
+	b.WriteString("\x1b[H")
+	line("%s  jitter %s  drop %d%%  zero %d%%  duplicate %d%%  bandwidth %s  queue limit %s  mtu %s",
+		bold(d.title), jitter, imp.Drop, imp.Zero, imp.Duplicate, unlimited(imp.Bandwidth, "B/s"), unlimited(imp.QueueLimit, ""), mtu(imp))
+	line("%s", help)
+	line("")
+
+	line("%s", bold("ENDPOINTS"))
+	line("  %-4s %-22s %-10s %s", "id", "remote", "connected", "queued")
+	for _, ep := range d.f.Endpoints() {
+		line("  %-4c %-22s %-10s %d", ep.ID, ep.Remote, clock.Since(clk, ep.Since).Truncate(time.Second), ep.Queued)
+	}
+	line("")
+
+	now := clk.Now()
+	elapsed := now.Sub(d.lastTime).Seconds()
+	line("%s", bold("LINKS"))
+	line("  %-6s %-8s %-8s %-8s %-10s %-8s %-8s %-9s %-7s %s", "link", "in", "out", "dropped", "corrupted", "dup", "blocked", "overflow", "in/s", "")
+	for _, l := range d.f.Links() {
+		k := [2]byte{l.Src, l.Dest}
+		rate := 0.0
+		if !d.lastTime.IsZero() && elapsed > 0 {
+			rate = float64(l.In-d.last[k]) / elapsed
+		}
+		d.last[k] = l.In
+		state := ""
+		if l.Paused {
+			state = "paused "
+		}
+		if l.Down {
+			state += "down "
+		}
+		if l.Oversize > 0 || l.Fragmented > 0 {
+			state += fmt.Sprintf("oversize %d fragmented %d ", l.Oversize, l.Fragmented)
+		}
+		if l.Impairments != nil {
+			imp := l.Impairments
+			state += fmt.Sprintf("(jitter %t drop %d%% zero %d%% duplicate %d%% bandwidth %s queue limit %s mtu %s)",
+				imp.Jitter, imp.Drop, imp.Zero, imp.Duplicate, unlimited(imp.Bandwidth, "B/s"), unlimited(imp.QueueLimit, ""), mtu(*imp))
+		}
+		line("  %c->%c   %-8d %-8d %-8d %-10d %-8d %-8d %-9d %-7.1f %s", l.Src, l.Dest, l.In, l.Out, l.Dropped, l.Corrupted, l.Duplicated, l.Blocked, l.Overflowed, rate, state)
+	}
+	d.lastTime = now
+	line("")
+
+	line("%s", bold("PACKETS"))
+	room := rows - lines - 1
+	if room < 0 {
+		room = 0
+	}
+	for _, ev := range d.latest(room) {
+		line("  %s %-7s %s", ev.Time.Format("15:04:05.000"), ev.What, describe(ev.Packet))
+	}
+	// clear whatever is left from a longer frame
+	b.WriteString("\x1b[J")
+	out.Write(b.Bytes())
+}
+
+// cut is s cut down to cols characters on screen - escape codes (like bold's) don't take
+// up any room, and aren't cut in half. A line that was cut ends with a reset, in case the
+// code that would have turned an attribute off again was cut off
+func cut(s string, cols int) string {
+	visible := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '[' {
+			// a CSI sequence ends with a byte from @ to ~
+			j := i + 2
+			for j < len(s) && (s[j] < 0x40 || s[j] > 0x7e) {
+				j++
+			}
+			i = min(j+1, len(s))
+			continue
+		}
+		if visible == cols {
+			return s[:i] + "\x1b[0m"
+		}
+		_, n := utf8.DecodeRuneInString(s[i:])
+		i += n
+		visible++
+	}
+	return s
+}
+
+// size of the terminal, falls back to 24x80
+func size() (rows int, cols int) {
+	rows, cols = 24, 80
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return
+	}
+	if r, err := strconv.Atoi(fields[0]); err == nil && r > 0 {
+		rows = r
+	}
+	if c, err := strconv.Atoi(fields[1]); err == nil && c > 0 {
+		cols = c
+	}
+	return
+}
+
+// Raw puts the terminal on stdin in cbreak mode without echo, so single key presses
+// can be read - the returned function puts it back the way it was
+func Raw() (restore func(), err error) {
+	stty := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		return cmd.Output()
+	}
+	state, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("dashboard needs a terminal: %w", err)
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(string(state))) }, nil
+}
@@ -1,161 +1,122 @@
-// adapted from concurrent tcp server
-// https://www.linode.com/docs/guides/developing-udp-and-tcp-clients-and-servers-in-go/
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"handin2/dashboard"
+	"handin2/forwarder"
+	"handin2/metrics"
 	"handin2/packet"
 	"math/rand"
 	"net"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-var verbose bool = true
-
-// network has bad jitter
-var jitter bool = false
-
-// percentage for packet to be dropped, ignored
-var drop_packet int = 0
-
-// percentage for packet to have a byte zeroed
-var zero_bit int = 0
-
-// make sure we dont update packets in different goroutines
-var m sync.Mutex
-
-// id -> packets that need to be sent to it
-var packets = make(map[byte][][]byte)
-
-// should the handleSend goroutine exit
-var isClosed = make(map[byte]bool)
+func main() {
+	level := flag.String("log-level", "info", "debug, info, warn, error or off")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics on this loopback address, e.g. localhost:9100")
+	admin := flag.String("admin", "", "serve the admin API on this loopback address, e.g. localhost:9200")
+	scenario := flag.String("scenario", "", "play the fault timeline in this JSON file, see forwarder/scenario.go")
+	tui := flag.Bool("tui", false, "show a live dashboard instead of logging, logs are turned off")
+	// network has bad jitter
+	jitter := flag.Bool("jitter", false, "shuffle packets queued for a destination")
+	// percentage for packet to be dropped, ignored
+	drop := flag.Int("drop", 0, "percentage of packets to drop")
+	// percentage for packet to have a byte zeroed
+	zero := flag.Int("zero", 0, "percentage of packets to have a byte zeroed")
+	// percentage for packet to be sent twice
+	duplicate := flag.Int("duplicate", 0, "percentage of packets to send twice")
+	// how fast links are, and how many packets fit in the queue for a destination
+	bandwidth := flag.Int("bandwidth", 0, "bytes per second a link can carry, 0 is unlimited")
+	queueLimit := flag.Int("queue-limit", 0, "packets queued for a destination before more are dropped, 0 is unlimited")
+	// how big packets can be, and whether bigger ones are dropped (the sender is told) or fragmented
+	mtu := flag.Int("mtu", 0, "largest packet in bytes a link takes, 0 is unlimited")
+	fragment := flag.Bool("fragment", false, "fragment packets bigger than -mtu instead of dropping them")
+	flag.Parse()
 
-func handleSend(c net.Conn, id byte) {
-	// sleep is used to simulate latency, ideally
-	// packets received (to be sent) would use a channel
-	// to not waste time waiting for data, etc.
-	var p []byte
-	for {
-		time.Sleep(10 * time.Millisecond)
-		if isClosed[id] {
-			isClosed[id] = false
-			return
-		}
-		m.Lock()
-		if len(packets[id]) > 0 {
-			// shuffling array to simulate really bad jitter
-			// model implementation can (sometimes) survive this attack
-			if jitter {
-				dest := make([][]byte, len(packets[id]))
-				perm := rand.Perm(len(packets[id]))
-				for i, v := range perm {
-					dest[v] = packets[id][i]
-				}
-				p, packets[id] = dest[0], dest[1:]
-			} else {
-				p, packets[id] = packets[id][0], packets[id][1:]
-			}
-			n := rand.Intn(100)
-			if drop_packet > n {
-				fmt.Printf("handleRecv<%c> dropped - <%s>\n", id, packet.FmtBits(p))
-			} else {
-				n = rand.Intn(100)
-				if zero_bit > n {
-					fmt.Printf("handleRecv<%c> flipped some bits\n", id)
-					p[len(p)-3] &= 0x00
-				}
-				c.Write(p)
-			}
-		}
-		m.Unlock()
+	imp := forwarder.Impairments{Jitter: *jitter, Drop: *drop, Zero: *zero, Duplicate: *duplicate,
+		Bandwidth: *bandwidth, QueueLimit: *queueLimit, MTU: *mtu, Fragment: *fragment}
+	if err := imp.Validate(); err != nil {
+		// like flag does for flags it can't parse
+		fmt.Println(err)
+		os.Exit(2)
 	}
-}
 
-func handleReceive(c net.Conn) {
-	// 65543 is max size of our 'packet'
-	data := make([]byte, 65543)
-	//id_info, err := bufio.NewReader(c).ReadBytes('\n')
-	_, err := c.Read(data)
-	id := data[0]
-	fmt.Printf("+ Connection from <%c>\n", id)
+	if *tui {
+		*level = "off"
+	}
+	logger, err := packet.NewTextLogger(os.Stderr, *level)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	// it is assumed that there will be no duplicate registrations with forwarder
-	// as in, no malicious actor that takes advantage of it being a model
-	if verbose {
-		fmt.Printf("Started handleSend for <%c>\n", id)
+
+	if *metricsAddr != "" {
+		go func() {
+			logger.Error("metrics", "err", metrics.ListenAndServe(*metricsAddr, metrics.Default))
+		}()
 	}
-	go handleSend(c, id)
 
-	for {
-		// the reason we make a new variable, rather than reuse data
-		// is because we want to store slices into it on the packets map
-		// if we reuse data, then they will all point to the same value (identical entries)
-		buffer := make([]byte, 65543)
-		n, err := c.Read(buffer)
-		if err != nil {
+	var sc *forwarder.Scenario
+	if *scenario != "" {
+		if sc, err = forwarder.LoadScenario(*scenario); err != nil {
 			fmt.Println(err)
-			goto errored
-		}
-
-		// note, we dont use valid, since its not the forwarders responsibility
-		corrupt, _, dest, _, _, flag, _, _ := packet.Decode(buffer[:n])
-		if verbose {
-			switch flag {
-			case packet.START:
-				fmt.Printf("handleRecv<%c> - START PACKET to <%c>\n", id, dest)
-			case packet.ACCEPT:
-				fmt.Printf("handleRecv<%c> - ACCEPT PACKET to <%c>\n", id, dest)
-			case packet.DONE:
-				fmt.Printf("handleRecv<%c> - DONE PACKET to <%c>\n", id, dest)
-			case packet.DONE | packet.ACCEPT:
-				fmt.Printf("handleRecv<%c> - ACCEPT & DONE PACKET to <%c>\n", id, dest)
-			case packet.FAILURE:
-				fmt.Printf("handleRecv<%c> - FAILURE PACKET to <%c>\n", id, dest)
-			default:
-				fmt.Printf("handleRecv<%c> - <%s> to <%c>\n", id, packet.FmtBits(buffer[:n]), dest)
-			}
-		}
-		if !corrupt {
-			m.Lock()
-			packets[dest] = append(packets[dest], buffer[:n])
-			m.Unlock()
+			return
 		}
 	}
-errored:
-	c.Close()
-	fmt.Printf("- Connection from <%c>\n", id)
-	isClosed[id] = true
-}
 
-func main() {
-	arguments := os.Args
 	PORT := ""
 	rand.Seed(time.Now().UnixNano())
-	if len(arguments) == 1 {
-		fmt.Println("Using default port of 4004\n________________\n")
+	if flag.NArg() == 0 {
+		if !*tui {
+			fmt.Println("Using default port of 4004\n________________")
+		}
 		PORT = ":4004"
 	} else {
-		PORT = ":" + arguments[1]
+		PORT = ":" + flag.Arg(0)
 	}
 
 	l, err := net.Listen("tcp4", PORT)
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("listen", "port", PORT, "err", err)
 		return
 	}
 	defer l.Close()
 
-	for {
-		c, err := l.Accept()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		go handleReceive(c)
+	f := forwarder.New(forwarder.Config{
+		Impairments: imp,
+		Logger:      logger,
+	})
+
+	if *admin != "" {
+		go func() {
+			logger.Error("admin", "err", f.ListenAndServeAdmin(*admin))
+		}()
+	}
+
+	if sc != nil {
+		go f.Play(context.Background(), sc)
+	}
+
+	if !*tui {
+		logger.Error("accept", "err", f.Serve(l))
+		return
+	}
+
+	d := dashboard.New(f, "forwarder "+PORT)
+	go f.Serve(l)
+	restore, err := dashboard.Raw()
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	defer restore()
+	// ^C ends the dashboard like q does, so the terminal is restored
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	d.Run(ctx, os.Stdin, os.Stdout, 500*time.Millisecond)
 }
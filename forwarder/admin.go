@@ -0,0 +1,240 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"handin2/metrics"
+	"net/http"
+	"time"
+)
+
+// the JSON versions of Endpoint and Link, ids are written as the character they are
+type endpointJSON struct {
+	ID     string    `json:"id"`
+	Remote string    `json:"remote"`
+	Since  time.Time `json:"since"`
+	Queued int       `json:"queued"`
+}
+
+type linkJSON struct {
+	Src         string       `json:"src"`
+	Dest        string       `json:"dest"`
+	In          uint64       `json:"in"`
+	Out         uint64       `json:"out"`
+	Dropped     uint64       `json:"dropped"`
+	Corrupted   uint64       `json:"corrupted"`
+	Duplicated  uint64       `json:"duplicated"`
+	Blocked     uint64       `json:"blocked"`
+	Overflowed  uint64       `json:"overflowed"`
+	Oversize    uint64       `json:"oversize"`
+	Fragmented  uint64       `json:"fragmented"`
+	Paused      bool         `json:"paused"`
+	Down        bool         `json:"down"`
+	Impairments *Impairments `json:"impairments,omitempty"`
+}
+
+type partitionJSON struct {
+	Groups []string `json:"groups"`
+}
+
+// AdminHandler lets test scripts poke at a running forwarder:
+//
+//	GET    /endpoints                        registered endpoints
+//	POST   /endpoints/{id}/flush             throw away what's queued for id
+//	POST   /endpoints/{id}/disconnect        close the connection to id
+//	GET    /impairments                      network wide impairments
+//	PUT    /impairments                      {"drop":10,"bandwidth":20000,"queue_limit":8,"mtu":1500}
+//	GET    /links                            counters and state of every link
+//	PUT    /links/{src}/{dest}/impairments   override impairments for one link
+//	DELETE /links/{src}/{dest}/impairments   go back to the network wide ones
+//	POST   /links/{src}/{dest}/pause         hold on to packets on the link
+//	POST   /links/{src}/{dest}/resume        let them through again
+//	POST   /links/{src}/{dest}/down          throw away everything on the link
+//	POST   /links/{src}/{dest}/up            back to normal
+//	PUT    /partition                        {"groups":["ab","cs"]}, ids are single characters of registered endpoints
+//	DELETE /partition                        heal it
+func (f *Forwarder) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /endpoints", func(w http.ResponseWriter, r *http.Request) {
+		eps := []endpointJSON{}
+		for _, ep := range f.Endpoints() {
+			eps = append(eps, endpointJSON{string(rune(ep.ID)), ep.Remote, ep.Since, ep.Queued})
+		}
+		reply(w, eps)
+	})
+	mux.HandleFunc("POST /endpoints/{id}/flush", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r, "id")
+		if !ok {
+			return
+		}
+		reply(w, map[string]int{"flushed": f.Flush(id)})
+	})
+	mux.HandleFunc("POST /endpoints/{id}/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r, "id")
+		if !ok {
+			return
+		}
+		if !f.Disconnect(id) {
+			http.Error(w, fmt.Sprintf("%c isn't registered", id), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /impairments", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, f.Impairments())
+	})
+	mux.HandleFunc("PUT /impairments", func(w http.ResponseWriter, r *http.Request) {
+		var imp Impairments
+		if !readJSON(w, r, &imp) {
+			return
+		}
+		if err := imp.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.SetImpairments(imp)
+		reply(w, imp)
+	})
+	mux.HandleFunc("GET /links", func(w http.ResponseWriter, r *http.Request) {
+		links := []linkJSON{}
+		for _, l := range f.Links() {
+			links = append(links, linkJSON{
+				string(rune(l.Src)), string(rune(l.Dest)),
+				l.In, l.Out, l.Dropped, l.Corrupted, l.Duplicated, l.Blocked, l.Overflowed, l.Oversize, l.Fragmented, l.Paused, l.Down, l.Impairments,
+			})
+		}
+		reply(w, links)
+	})
+	mux.HandleFunc("PUT /links/{src}/{dest}/impairments", func(w http.ResponseWriter, r *http.Request) {
+		src, dest, ok := pathLink(w, r)
+		if !ok {
+			return
+		}
+		var imp Impairments
+		if !readJSON(w, r, &imp) {
+			return
+		}
+		if err := imp.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.SetLinkImpairments(src, dest, &imp)
+		reply(w, imp)
+	})
+	mux.HandleFunc("DELETE /links/{src}/{dest}/impairments", func(w http.ResponseWriter, r *http.Request) {
+		src, dest, ok := pathLink(w, r)
+		if !ok {
+			return
+		}
+		f.SetLinkImpairments(src, dest, nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /links/{src}/{dest}/pause", func(w http.ResponseWriter, r *http.Request) {
+		src, dest, ok := pathLink(w, r)
+		if !ok {
+			return
+		}
+		f.Pause(src, dest)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /links/{src}/{dest}/resume", func(w http.ResponseWriter, r *http.Request) {
+		src, dest, ok := pathLink(w, r)
+		if !ok {
+			return
+		}
+		f.Resume(src, dest)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /links/{src}/{dest}/down", func(w http.ResponseWriter, r *http.Request) {
+		src, dest, ok := pathLink(w, r)
+		if !ok {
+			return
+		}
+		f.SetDown(src, dest, true)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /links/{src}/{dest}/up", func(w http.ResponseWriter, r *http.Request) {
+		src, dest, ok := pathLink(w, r)
+		if !ok {
+			return
+		}
+		f.SetDown(src, dest, false)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /partition", func(w http.ResponseWriter, r *http.Request) {
+		var p partitionJSON
+		if !readJSON(w, r, &p) {
+			return
+		}
+		groups := make([][]byte, len(p.Groups))
+		for i, g := range p.Groups {
+			groups[i] = []byte(g)
+		}
+		if err := validGroups(groups); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// a typo would leave whoever was meant out of the partition, talking to everyone
+		registered := make(map[byte]bool)
+		for _, ep := range f.Endpoints() {
+			registered[ep.ID] = true
+		}
+		for _, g := range groups {
+			for _, id := range g {
+				if !registered[id] {
+					http.Error(w, fmt.Sprintf("%c isn't registered", id), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		f.Partition(groups)
+		reply(w, p)
+	})
+	mux.HandleFunc("DELETE /partition", func(w http.ResponseWriter, r *http.Request) {
+		f.Heal()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// ListenAndServeAdmin serves AdminHandler, only on loopback since anyone who
+// can reach it can mess with the network
+func (f *Forwarder) ListenAndServeAdmin(addr string) error {
+	if err := metrics.CheckLoopback(addr); err != nil {
+		return fmt.Errorf("forwarder: admin API: %w", err)
+	}
+	return http.ListenAndServe(addr, f.AdminHandler())
+}
+
+func reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// ids are a single character, like they are when endpoints register
+func pathID(w http.ResponseWriter, r *http.Request, name string) (byte, bool) {
+	v := r.PathValue(name)
+	if len(v) != 1 {
+		http.Error(w, fmt.Sprintf("%s has to be a single character, got %q", name, v), http.StatusBadRequest)
+		return 0, false
+	}
+	return v[0], true
+}
+
+func pathLink(w http.ResponseWriter, r *http.Request) (src byte, dest byte, ok bool) {
+	if src, ok = pathID(w, r, "src"); !ok {
+		return
+	}
+	dest, ok = pathID(w, r, "dest")
+	return
+}
@@ -0,0 +1,199 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"handin2/metrics"
+	"handin2/packet"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the admin API is tested through httptest, against a forwarder with endpoints that dial it
+// over loopback - like pseudo_client does
+
+func newForwarder(t *testing.T) (*Forwarder, string) {
+	t.Helper()
+	f := New(Config{Registry: metrics.NewRegistry(), Latency: time.Millisecond})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go f.Serve(l)
+	return f, l.Addr().String()
+}
+
+// dial registers id, and waits till the forwarder has it
+func dial(t *testing.T, f *Forwarder, addr string, id byte) *packet.Conn {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := packet.NewConn(nc)
+	t.Cleanup(func() { c.Close() })
+	c.Write([]byte{id})
+	eventually(t, func() bool { return registered(f, id) })
+	return c
+}
+
+func registered(f *Forwarder, id byte) bool {
+	for _, ep := range f.Endpoints() {
+		if ep.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// eventually fails the test if cond isn't true within a few seconds (of real time)
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("gave up waiting")
+		}
+	}
+}
+
+// do sends a request to the admin API, and fails the test if the status isn't want
+func do(t *testing.T, h http.Handler, method string, path string, body string, want int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if w.Code != want {
+		t.Fatalf("%s %s %s: %d %q, expected %d", method, path, body, w.Code, w.Body, want)
+	}
+	return w
+}
+
+func TestAdminImpairments(t *testing.T) {
+	f, _ := newForwarder(t)
+	h := f.AdminHandler()
+
+	do(t, h, "PUT", "/impairments", `{"drop":10,"bandwidth":20000,"queue_limit":8,"mtu":1500}`, http.StatusOK)
+	want := Impairments{Drop: 10, Bandwidth: 20000, QueueLimit: 8, MTU: 1500}
+	if imp := f.Impairments(); imp != want {
+		t.Fatalf("impairments are %+v, expected %+v", imp, want)
+	}
+	// anything that doesn't make sense leaves them as they were
+	for _, body := range []string{
+		`{"drop":101}`, `{"zero":-1}`, `{"duplicate":200}`,
+		`{"bandwidth":-1}`, `{"queue_limit":-8}`, `{"mtu":-1500}`,
+		`{"loss":10}`, `{"drop":"ten"}`, `{`,
+	} {
+		do(t, h, "PUT", "/impairments", body, http.StatusBadRequest)
+	}
+	if imp := f.Impairments(); imp != want {
+		t.Fatalf("impairments are %+v after bad requests, expected %+v", imp, want)
+	}
+	var got Impairments
+	if err := json.NewDecoder(do(t, h, "GET", "/impairments", "", http.StatusOK).Body).Decode(&got); err != nil || got != want {
+		t.Fatalf("GET /impairments: %+v, %v", got, err)
+	}
+
+	do(t, h, "PUT", "/links/a/b/impairments", `{"drop":101}`, http.StatusBadRequest)
+	do(t, h, "PUT", "/links/ab/b/impairments", `{"drop":5}`, http.StatusBadRequest)
+	do(t, h, "PUT", "/links/a/b/impairments", `{"drop":5}`, http.StatusOK)
+	var links []linkJSON
+	json.NewDecoder(do(t, h, "GET", "/links", "", http.StatusOK).Body).Decode(&links)
+	if len(links) != 1 || links[0].Src != "a" || links[0].Dest != "b" || links[0].Impairments == nil || links[0].Impairments.Drop != 5 {
+		t.Fatalf("GET /links: %+v", links)
+	}
+	do(t, h, "DELETE", "/links/a/b/impairments", "", http.StatusNoContent)
+	if l := f.Links(); len(l) != 1 || l[0].Impairments != nil {
+		t.Fatalf("link still has its own impairments: %+v", l)
+	}
+}
+
+func TestAdminPartition(t *testing.T) {
+	f, addr := newForwarder(t)
+	h := f.AdminHandler()
+	for _, id := range []byte("abc") {
+		dial(t, f, addr, id)
+	}
+	partitioned := func(a byte, b byte) bool {
+		f.m.Lock()
+		defer f.m.Unlock()
+		return f.partitioned(a, b)
+	}
+
+	do(t, h, "PUT", "/partition", `{"groups":["ab","c"]}`, http.StatusOK)
+	if partitioned('a', 'b') || !partitioned('a', 'c') || !partitioned('b', 'c') {
+		t.Fatal("expected a and b to be cut off from c")
+	}
+	for _, body := range []string{
+		// an empty group, an id in two groups, an id nobody registered
+		`{"groups":["ab",""]}`, `{"groups":["ab","bc"]}`, `{"groups":["aa"]}`, `{"groups":["a","z"]}`,
+	} {
+		do(t, h, "PUT", "/partition", body, http.StatusBadRequest)
+	}
+	if partitioned('a', 'b') || !partitioned('a', 'c') {
+		t.Fatal("a bad partition replaced the one before it")
+	}
+	do(t, h, "DELETE", "/partition", "", http.StatusNoContent)
+	if partitioned('a', 'c') {
+		t.Fatal("still partitioned after DELETE")
+	}
+}
+
+func TestAdminPauseFlushDisconnect(t *testing.T) {
+	f, addr := newForwarder(t)
+	h := f.AdminHandler()
+	a := dial(t, f, addr, 'a')
+	b := dial(t, f, addr, 'b')
+	queued := func(id byte) int {
+		for _, ep := range f.Endpoints() {
+			if ep.ID == id {
+				return ep.Queued
+			}
+		}
+		return -1
+	}
+	data := packet.Encode('b', 'a', 0, 1, packet.EMPTY, 0, []byte("hello"))
+
+	// paused, the packets stay in the queue for b - and flushing it throws them away
+	do(t, h, "POST", "/links/a/b/pause", "", http.StatusNoContent)
+	for i := 0; i < 3; i++ {
+		a.Write(data)
+	}
+	eventually(t, func() bool { return queued('b') == 3 })
+	if l := f.Links(); len(l) != 1 || !l[0].Paused {
+		t.Fatalf("expected a->b to be paused: %+v", l)
+	}
+	var flushed map[string]int
+	json.NewDecoder(do(t, h, "POST", "/endpoints/b/flush", "", http.StatusOK).Body).Decode(&flushed)
+	if flushed["flushed"] != 3 || queued('b') != 0 {
+		t.Fatalf("flushed %v, %d still queued", flushed, queued('b'))
+	}
+
+	// resumed, the next one gets through
+	do(t, h, "POST", "/links/a/b/resume", "", http.StatusNoContent)
+	a.Write(data)
+	buf := make([]byte, packet.MaxSize)
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != string(data) {
+		t.Fatalf("b read % x, %v - expected % x", buf[:n], err, data)
+	}
+
+	// disconnected, b's connection is closed - a is sent a RESET from b since they talked
+	do(t, h, "POST", "/endpoints/b/disconnect", "", http.StatusNoContent)
+	if _, err := b.Read(buf); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected b's connection to be closed, got %v", err)
+	}
+	eventually(t, func() bool { return !registered(f, 'b') })
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := a.Read(buf)
+	var reset packet.Packet
+	if err != nil || reset.UnmarshalBinary(buf[:n]) != nil || !reset.IsReset() || reset.Src != 'b' {
+		t.Fatalf("expected a RESET from b, got % x, %v", buf[:n], err)
+	}
+	do(t, h, "POST", "/endpoints/b/disconnect", "", http.StatusNotFound)
+	do(t, h, "POST", "/endpoints/bc/flush", "", http.StatusBadRequest)
+}
@@ -0,0 +1,901 @@
+// Package forwarder is 'the internet' that pseudo clients/servers talk through.
+// Every endpoint registers with a one byte id, after that whatever it writes gets
+// queued for the id in the dest field - that is, it also acts as a pseudo ARP.
+// On the way through, packets can be shuffled, dropped, duplicated or corrupted, and
+// links can be made slow, given a queue that overflows and an MTU.
+//
+// adapted from concurrent tcp server
+// https://www.linode.com/docs/guides/developing-udp-and-tcp-clients-and-servers-in-go/
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"handin2/clock"
+	"handin2/metrics"
+	"handin2/packet"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Impairments is what makes the network unreliable, they're set for the
+// whole network and can be overridden for single links
+type Impairments struct {
+	// network has bad jitter, whatever is queued for a destination gets shuffled
+	Jitter bool `json:"jitter"`
+	// percentage for packet to be dropped
+	Drop int `json:"drop"`
+	// percentage for packet to have a byte zeroed
+	Zero int `json:"zero"`
+	// percentage for packet to be sent twice, the copy goes to the back of the queue
+	Duplicate int `json:"duplicate"`
+	// bytes per second the link can carry, 0 is unlimited (there's still Config.Latency between packets)
+	Bandwidth int `json:"bandwidth"`
+	// packets that can be queued for the destination before the ones that come in
+	// over this link are dropped, 0 is unlimited
+	QueueLimit int `json:"queue_limit"`
+	// the largest packet (in bytes) the link takes, 0 is unlimited. Bigger ones are dropped,
+	// and the sender gets a packet.TooBig saying how big they can be
+	MTU int `json:"mtu"`
+	// bigger packets are fragmented instead - every fragment takes its own time on the link
+	// and can be dropped on its own, the packet only makes it if all of them do
+	Fragment bool `json:"fragment"`
+}
+
+// Validate is why imp makes no sense, nil if it does - New takes it as it is, so
+// impairments from flags or a file should be checked with it first
+func (imp Impairments) Validate() error {
+	for _, p := range []struct {
+		name  string
+		value int
+	}{{"drop", imp.Drop}, {"zero", imp.Zero}, {"duplicate", imp.Duplicate}} {
+		if p.value < 0 || p.value > 100 {
+			return fmt.Errorf("%s is a percentage, %d isn't between 0 and 100", p.name, p.value)
+		}
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{{"bandwidth", imp.Bandwidth}, {"queue_limit", imp.QueueLimit}, {"mtu", imp.MTU}} {
+		if n.value < 0 {
+			return fmt.Errorf("%s can't be negative, got %d", n.name, n.value)
+		}
+	}
+	return nil
+}
+
+type Config struct {
+	Impairments Impairments
+	// nil means no logging
+	Logger packet.Logger
+	// where the forwarder's metrics are registered, nil means metrics.Default
+	Registry *metrics.Registry
+	// time between packets written to an endpoint, 0 means 10ms
+	Latency time.Duration
+	// what latency, delays, scenarios and event times go by, nil means the wall clock
+	Clock clock.Clock
+}
+
+// Event is something that happened to a packet, handed to the functions given to Tap
+type Event struct {
+	Time time.Time
+	// "in", "out", "dropped", "duplicated", "zeroed", "blocked", "overflowed", "delayed", "flushed",
+	// "reset", "oversize" (dropped for the MTU) or "fragmented"
+	What   string
+	Packet []byte
+}
+
+// Endpoint is a registered pseudo client/server
+type Endpoint struct {
+	ID     byte
+	Remote string
+	Since  time.Time
+	// packets waiting to be written to it
+	Queued int
+
+	c net.Conn
+	// closed when the handleSend goroutine should exit
+	closed chan struct{}
+}
+
+// Link is the state of and counters for packets going from Src to Dest
+type Link struct {
+	Src, Dest byte
+	In        uint64
+	Out       uint64
+	Dropped   uint64
+	Corrupted uint64
+	// copies queued on top of the original, they're also counted in Out when written
+	Duplicated uint64
+	// thrown away because Src and Dest are partitioned, or the link is down
+	Blocked uint64
+	// thrown away because the queue for Dest was full
+	Overflowed uint64
+	// thrown away for being bigger than the MTU, and written in fragments
+	Oversize   uint64
+	Fragmented uint64
+	// packets stay queued while a link is paused
+	Paused bool
+	// everything on a link that is down gets thrown away, the other direction is unaffected
+	Down bool
+	// nil when the link uses the network wide impairments
+	Impairments *Impairments
+}
+
+type link struct {
+	in, out, dropped, corrupted, duplicated, blocked, overflowed, oversize, fragmented *metrics.Counter
+
+	paused bool
+	down   bool
+	// scenario steps that have it down as well, see holdDown
+	holds int
+	imp   *Impairments
+}
+
+func (l *link) isDown() bool {
+	return l.down || l.holds > 0
+}
+
+// Delay holds back packets with certain flags before they're queued, e.g. every DONE
+type Delay struct {
+	// 0 matches any src/dest
+	Src, Dest byte
+	// packets that have all of these flags, EMPTY only matches data packets
+	Flags byte
+	By    time.Duration
+}
+
+func (d Delay) matches(src byte, dest byte, flag byte) bool {
+	if (d.Src != 0 && d.Src != src) || (d.Dest != 0 && d.Dest != dest) {
+		return false
+	}
+	if d.Flags == packet.EMPTY {
+		return flag == packet.EMPTY
+	}
+	return flag&d.Flags == d.Flags
+}
+
+type Forwarder struct {
+	logger  packet.Logger
+	latency time.Duration
+	clock   clock.Clock
+
+	// make sure we dont update packets in different goroutines
+	m   sync.Mutex
+	imp Impairments
+	// id -> packets that need to be sent to it
+	packets   map[byte][][]byte
+	endpoints map[byte]*Endpoint
+	links     map[[2]byte]*link
+	// id -> which group of the partition it's in, ids that aren't there can reach everyone
+	partition map[byte]int
+	// partitions of scenario steps, on top of each other - the last one is in effect, and
+	// beneath is what was there before the first (see pushPartition)
+	stacked []*stackedPartition
+	beneath map[byte]int
+	delays  map[int]Delay
+	delayID int
+	taps    []func(Event)
+	// closed (and replaced) when there's something new to write, see notify
+	wake chan struct{}
+
+	packetsIn         metrics.CounterVec
+	packetsOut        metrics.CounterVec
+	packetsDropped    metrics.CounterVec
+	packetsCorrupted  metrics.CounterVec
+	packetsDuplicated metrics.CounterVec
+	packetsMalformed  metrics.CounterVec
+	packetsBlocked    metrics.CounterVec
+	packetsOverflowed metrics.CounterVec
+	packetsOversize   metrics.CounterVec
+	packetsFragmented metrics.CounterVec
+	resets            metrics.CounterVec
+	queueDepth        metrics.GaugeVec
+}
+
+func New(cfg Config) *Forwarder {
+	if cfg.Logger == nil {
+		cfg.Logger = nopLogger{}
+	}
+	if cfg.Registry == nil {
+		cfg.Registry = metrics.Default
+	}
+	if cfg.Latency <= 0 {
+		cfg.Latency = 10 * time.Millisecond
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real{}
+	}
+	r := cfg.Registry
+	// a link is src -> dest, as in who wrote the packet and who it's queued for
+	return &Forwarder{
+		logger:    cfg.Logger,
+		latency:   cfg.Latency,
+		clock:     cfg.Clock,
+		imp:       cfg.Impairments,
+		packets:   make(map[byte][][]byte),
+		endpoints: make(map[byte]*Endpoint),
+		links:     make(map[[2]byte]*link),
+		delays:    make(map[int]Delay),
+		wake:      make(chan struct{}),
+
+		packetsIn: r.CounterVec("forwarder_packets_in_total",
+			"Packets read from src and queued for dest.", "src", "dest"),
+		packetsOut: r.CounterVec("forwarder_packets_out_total",
+			"Packets written to dest.", "src", "dest"),
+		packetsDropped: r.CounterVec("forwarder_packets_dropped_total",
+			"Packets dropped on purpose (Impairments.Drop).", "src", "dest"),
+		packetsCorrupted: r.CounterVec("forwarder_packets_corrupted_total",
+			"Packets that got a byte zeroed on purpose (Impairments.Zero).", "src", "dest"),
+		packetsDuplicated: r.CounterVec("forwarder_packets_duplicated_total",
+			"Extra copies of packets queued on purpose (Impairments.Duplicate).", "src", "dest"),
+		packetsMalformed: r.CounterVec("forwarder_packets_malformed_total",
+			"Reads from src too short to be a packet, these are never forwarded.", "src"),
+		packetsBlocked: r.CounterVec("forwarder_packets_blocked_total",
+			"Packets thrown away because src and dest are in different partitions.", "src", "dest"),
+		packetsOverflowed: r.CounterVec("forwarder_packets_overflowed_total",
+			"Packets dropped because the queue for dest was full (Impairments.QueueLimit).", "src", "dest"),
+		packetsOversize: r.CounterVec("forwarder_packets_oversize_total",
+			"Packets dropped for being bigger than the link's MTU (Impairments.MTU).", "src", "dest"),
+		packetsFragmented: r.CounterVec("forwarder_packets_fragmented_total",
+			"Packets bigger than the link's MTU written in fragments (Impairments.Fragment).", "src", "dest"),
+		resets: r.CounterVec("forwarder_resets_total",
+			"RESETs queued for dest because src disconnected.", "src", "dest"),
+		queueDepth: r.GaugeVec("forwarder_queue_depth",
+			"Packets waiting to be written to dest.", "dest"),
+	}
+}
+
+type nopLogger struct{}
+
+// infoEnabled is like debugEnabled in packet, the per packet logging doesn't have to decode
+// every packet for a logger that throws it away
+func (f *Forwarder) infoEnabled() bool {
+	if _, ok := f.logger.(nopLogger); ok {
+		return false
+	}
+	if l, ok := f.logger.(interface {
+		Enabled(context.Context, slog.Level) bool
+	}); ok {
+		return l.Enabled(context.Background(), slog.LevelInfo)
+	}
+	return true
+}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// Clock is what the forwarder goes by, the times in Events and Endpoints are from it
+func (f *Forwarder) Clock() clock.Clock {
+	return f.clock
+}
+
+func (f *Forwarder) Impairments() Impairments {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.imp
+}
+
+// SetImpairments takes effect from the next packet that gets written
+func (f *Forwarder) SetImpairments(imp Impairments) {
+	f.m.Lock()
+	f.imp = imp
+	f.m.Unlock()
+	f.logger.Info("impairments changed", "jitter", imp.Jitter, "drop", imp.Drop, "zero", imp.Zero, "duplicate", imp.Duplicate,
+		"bandwidth", imp.Bandwidth, "queue_limit", imp.QueueLimit, "mtu", imp.MTU, "fragment", imp.Fragment)
+}
+
+// Tap calls fn for every Event, it's called with the forwarder locked so it has to be quick
+// and must not call back into the forwarder. Packet is only valid for the duration of the call
+func (f *Forwarder) Tap(fn func(Event)) {
+	f.m.Lock()
+	f.taps = append(f.taps, fn)
+	f.m.Unlock()
+}
+
+func (f *Forwarder) Endpoints() []Endpoint {
+	f.m.Lock()
+	defer f.m.Unlock()
+	eps := make([]Endpoint, 0, len(f.endpoints))
+	for id, ep := range f.endpoints {
+		e := *ep
+		e.Queued = len(f.packets[id])
+		e.c, e.closed = nil, nil
+		eps = append(eps, e)
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].ID < eps[j].ID })
+	return eps
+}
+
+// Links that have seen at least one packet
+func (f *Forwarder) Links() []Link {
+	f.m.Lock()
+	defer f.m.Unlock()
+	links := make([]Link, 0, len(f.links))
+	for k, l := range f.links {
+		link := Link{
+			Src: k[0], Dest: k[1],
+			In: l.in.Value(), Out: l.out.Value(),
+			Dropped: l.dropped.Value(), Corrupted: l.corrupted.Value(),
+			Duplicated: l.duplicated.Value(), Overflowed: l.overflowed.Value(),
+			Oversize: l.oversize.Value(), Fragmented: l.fragmented.Value(),
+			Blocked: l.blocked.Value(), Paused: l.paused, Down: l.isDown(),
+		}
+		if l.imp != nil {
+			imp := *l.imp
+			link.Impairments = &imp
+		}
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Src != links[j].Src {
+			return links[i].Src < links[j].Src
+		}
+		return links[i].Dest < links[j].Dest
+	})
+	return links
+}
+
+// SetLinkImpairments overrides the network wide impairments for packets going from src to dest,
+// nil makes the link go back to using the network wide ones
+func (f *Forwarder) SetLinkImpairments(src byte, dest byte, imp *Impairments) {
+	f.m.Lock()
+	l := f.link(src, dest)
+	if imp != nil {
+		cp := *imp
+		imp = &cp
+	}
+	l.imp = imp
+	f.m.Unlock()
+	if imp != nil {
+		f.logger.Info("link impairments changed", "src", string(rune(src)), "dest", string(rune(dest)),
+			"jitter", imp.Jitter, "drop", imp.Drop, "zero", imp.Zero, "duplicate", imp.Duplicate,
+			"bandwidth", imp.Bandwidth, "queue_limit", imp.QueueLimit, "mtu", imp.MTU, "fragment", imp.Fragment)
+	} else {
+		f.logger.Info("link impairments reset", "src", string(rune(src)), "dest", string(rune(dest)))
+	}
+}
+
+// Pause holds on to packets going from src to dest till Resume is called
+func (f *Forwarder) Pause(src byte, dest byte) {
+	f.m.Lock()
+	f.link(src, dest).paused = true
+	f.m.Unlock()
+	f.logger.Info("link paused", "src", string(rune(src)), "dest", string(rune(dest)))
+}
+
+func (f *Forwarder) Resume(src byte, dest byte) {
+	f.m.Lock()
+	f.link(src, dest).paused = false
+	f.notify()
+	f.m.Unlock()
+	f.logger.Info("link resumed", "src", string(rune(src)), "dest", string(rune(dest)))
+}
+
+// SetDown takes the link from src to dest down (or back up), while it's down whatever
+// comes in for it is thrown away - it's a black hole for that one direction
+func (f *Forwarder) SetDown(src byte, dest byte, down bool) {
+	f.m.Lock()
+	f.link(src, dest).down = down
+	f.m.Unlock()
+	f.logger.Info("link state", "src", string(rune(src)), "dest", string(rune(dest)), "down", down)
+}
+
+// holdDown takes the link from src to dest down for a scenario step, till release is called.
+// Every step that holds it counts, it's only up again once the last one lets go - and
+// SetDown didn't take it down as well
+func (f *Forwarder) holdDown(src byte, dest byte) (release func()) {
+	f.m.Lock()
+	f.link(src, dest).holds++
+	f.m.Unlock()
+	f.logger.Info("link state", "src", string(rune(src)), "dest", string(rune(dest)), "down", true)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.m.Lock()
+			l := f.link(src, dest)
+			l.holds--
+			down := l.isDown()
+			f.m.Unlock()
+			f.logger.Info("link state", "src", string(rune(src)), "dest", string(rune(dest)), "down", down)
+		})
+	}
+}
+
+// AddDelay starts holding back packets matching d, the returned id is for RemoveDelay.
+// When more than one matches, the longest one wins
+func (f *Forwarder) AddDelay(d Delay) int {
+	f.m.Lock()
+	f.delayID++
+	id := f.delayID
+	f.delays[id] = d
+	f.m.Unlock()
+	name := func(id byte) string {
+		if id == 0 {
+			return "*"
+		}
+		return string(rune(id))
+	}
+	f.logger.Info("delay added", "id", id, "src", name(d.Src), "dest", name(d.Dest),
+		"flags", packet.FmtFlags(d.Flags), "by", d.By)
+	return id
+}
+
+// RemoveDelay stops the delay, packets that are already held back still arrive
+func (f *Forwarder) RemoveDelay(id int) {
+	f.m.Lock()
+	delete(f.delays, id)
+	f.m.Unlock()
+	f.logger.Info("delay removed", "id", id)
+}
+
+// Partition splits the network in groups that can only talk among themselves,
+// packets between groups are thrown away as they come in. Ids that aren't in any
+// group can still talk to everyone - and a new partition replaces the old one, those of
+// scenario steps included
+func (f *Forwarder) Partition(groups [][]byte) {
+	f.m.Lock()
+	f.partition = partitionOf(groups)
+	f.stacked, f.beneath = nil, nil
+	f.m.Unlock()
+	f.logger.Info("partitioned", "groups", fmtGroups(groups))
+}
+
+// Heal removes the partition, those of scenario steps included
+func (f *Forwarder) Heal() {
+	f.m.Lock()
+	f.partition = nil
+	f.stacked, f.beneath = nil, nil
+	f.m.Unlock()
+	f.logger.Info("partition healed")
+}
+
+// validGroups is why groups can't be a partition, nil if they can - every group needs
+// someone in it, and nobody can be in two of them
+func validGroups(groups [][]byte) error {
+	in := make(map[byte]int)
+	for i, g := range groups {
+		if len(g) == 0 {
+			return fmt.Errorf("group %d is empty", i)
+		}
+		for _, id := range g {
+			if j, ok := in[id]; ok {
+				return fmt.Errorf("%c is in group %d and group %d", id, j, i)
+			}
+			in[id] = i
+		}
+	}
+	return nil
+}
+
+func partitionOf(groups [][]byte) map[byte]int {
+	partition := make(map[byte]int)
+	for i, g := range groups {
+		for _, id := range g {
+			partition[id] = i
+		}
+	}
+	return partition
+}
+
+type stackedPartition struct {
+	groups    [][]byte
+	partition map[byte]int
+}
+
+// pushPartition is Partition for a scenario step, undo takes away only this partition: the
+// one under it is back in effect, or if a later step's is on top it stays that way. A
+// Partition or Heal in the meantime replaced it already, then undo doesn't do anything
+func (f *Forwarder) pushPartition(groups [][]byte) (undo func()) {
+	p := &stackedPartition{groups, partitionOf(groups)}
+	f.m.Lock()
+	if len(f.stacked) == 0 {
+		f.beneath = f.partition
+	}
+	f.stacked = append(f.stacked, p)
+	f.partition = p.partition
+	f.m.Unlock()
+	f.logger.Info("partitioned", "groups", fmtGroups(groups))
+	return func() {
+		f.m.Lock()
+		defer f.m.Unlock()
+		i := slices.Index(f.stacked, p)
+		if i < 0 {
+			return
+		}
+		f.stacked = slices.Delete(f.stacked, i, i+1)
+		if len(f.stacked) == 0 {
+			f.partition, f.beneath = f.beneath, nil
+		} else {
+			f.partition = f.stacked[len(f.stacked)-1].partition
+		}
+		f.logger.Info("partition undone", "groups", fmtGroups(groups))
+	}
+}
+
+func fmtGroups(groups [][]byte) []string {
+	s := make([]string, len(groups))
+	for i, g := range groups {
+		s[i] = string(g)
+	}
+	return s
+}
+
+// Flush throws away everything queued for id, returning how many packets that was
+func (f *Forwarder) Flush(id byte) int {
+	f.m.Lock()
+	n := len(f.packets[id])
+	for _, p := range f.packets[id] {
+		f.emit("flushed", p)
+	}
+	f.packets[id] = nil
+	f.queueDepth.With(string(rune(id))).Set(0)
+	f.m.Unlock()
+	f.logger.Info("flushed", "id", string(rune(id)), "packets", n)
+	return n
+}
+
+// Disconnect closes the connection to id, false if it isn't registered
+func (f *Forwarder) Disconnect(id byte) bool {
+	f.m.Lock()
+	ep, ok := f.endpoints[id]
+	f.m.Unlock()
+	if !ok {
+		return false
+	}
+	f.logger.Info("disconnecting", "id", string(rune(id)))
+	// handleReceive notices and does the cleanup
+	ep.c.Close()
+	return true
+}
+
+// link from src to dest - f.m must be held
+func (f *Forwarder) link(src byte, dest byte) *link {
+	k := [2]byte{src, dest}
+	l, ok := f.links[k]
+	if !ok {
+		s, d := string(rune(src)), string(rune(dest))
+		l = &link{
+			in:         f.packetsIn.With(s, d),
+			out:        f.packetsOut.With(s, d),
+			dropped:    f.packetsDropped.With(s, d),
+			corrupted:  f.packetsCorrupted.With(s, d),
+			duplicated: f.packetsDuplicated.With(s, d),
+			blocked:    f.packetsBlocked.With(s, d),
+			overflowed: f.packetsOverflowed.With(s, d),
+			oversize:   f.packetsOversize.With(s, d),
+			fragmented: f.packetsFragmented.With(s, d),
+		}
+		f.links[k] = l
+	}
+	return l
+}
+
+// p has been decoded, so it's long enough to have dest and src - f.m must be held
+func (f *Forwarder) linkOf(p []byte) *link {
+	return f.link(p[1], p[0])
+}
+
+// f.m must be held
+func (f *Forwarder) impairments(l *link) Impairments {
+	if l.imp != nil {
+		return *l.imp
+	}
+	return f.imp
+}
+
+// f.m must be held
+func (f *Forwarder) partitioned(src byte, dest byte) bool {
+	a, ok := f.partition[src]
+	if !ok {
+		return false
+	}
+	b, ok := f.partition[dest]
+	return ok && a != b
+}
+
+// enqueue p (with header h) for its dest unless the link is down, from and dest are
+// partitioned, the queue is full or p is too big for the link
+func (f *Forwarder) enqueue(from byte, h packet.Header, p []byte) {
+	dest := h.Dest
+	f.m.Lock()
+	defer f.m.Unlock()
+	l := f.linkOf(p)
+	if l.isDown() || f.partitioned(from, dest) {
+		l.blocked.Inc()
+		f.emit("blocked", p)
+		return
+	}
+	// like a router with "don't fragment", the sender is told how big packets can be - it
+	// goes back the same way as a RESET does, past the impairments of the way back
+	if imp := f.impairments(l); imp.MTU > 0 && len(p) > imp.MTU && !imp.Fragment {
+		if f.infoEnabled() {
+			f.logger.Info("too big", append(packet.Fields(p), "mtu", imp.MTU)...)
+		}
+		l.oversize.Inc()
+		f.emit("oversize", p)
+		if _, ok := f.endpoints[from]; ok {
+			tb, _ := packet.TooBig(h, imp.MTU).MarshalBinary()
+			f.packets[from] = append(f.packets[from], tb)
+			f.queueDepth.With(string(rune(from))).Set(len(f.packets[from]))
+			f.notify()
+		}
+		return
+	}
+	// tail drop, like a router with a full buffer
+	if limit := f.impairments(l).QueueLimit; limit > 0 && len(f.packets[dest]) >= limit {
+		f.logger.Info("queue full", packet.Fields(p)...)
+		l.overflowed.Inc()
+		f.emit("overflowed", p)
+		return
+	}
+	f.packets[dest] = append(f.packets[dest], p)
+	f.queueDepth.With(string(rune(dest))).Set(len(f.packets[dest]))
+	f.notify()
+}
+
+// notify wakes up the handleSend goroutines waiting for something to write - f.m must be held
+func (f *Forwarder) notify() {
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// ready is true if next has something for id - f.m must be held
+func (f *Forwarder) ready(id byte) bool {
+	for _, p := range f.packets[id] {
+		if !f.linkOf(p).paused {
+			return true
+		}
+	}
+	return false
+}
+
+// next takes the packet to write to id out of its queue, skipping paused links - f.m must be held
+func (f *Forwarder) next(id byte) (p []byte, ok bool) {
+	q := f.packets[id]
+	ready := make([]int, 0, len(q))
+	for i, p := range q {
+		if !f.linkOf(p).paused {
+			ready = append(ready, i)
+		}
+	}
+	if len(ready) == 0 {
+		return nil, false
+	}
+	i := ready[0]
+	// picking at random is the same as shuffling the queue and taking the first, which
+	// simulates really bad jitter - model implementation can (sometimes) survive this attack
+	if f.impairments(f.linkOf(q[i])).Jitter {
+		i = ready[rand.Intn(len(ready))]
+	}
+	p = q[i]
+	f.packets[id] = append(q[:i], q[i+1:]...)
+	return p, true
+}
+
+// f.m must be held
+func (f *Forwarder) emit(what string, p []byte) {
+	if len(f.taps) == 0 {
+		return
+	}
+	ev := Event{Time: f.clock.Now(), What: what, Packet: p}
+	for _, fn := range f.taps {
+		fn(ev)
+	}
+}
+
+// Serve accepts endpoints on l till it fails
+func (f *Forwarder) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go f.handleReceive(c)
+	}
+}
+
+func (f *Forwarder) handleSend(c net.Conn, id byte, closed chan struct{}) {
+	// sleep is used to simulate latency, it only starts once there is something
+	// to write so an idle endpoint doesn't keep waking up for nothing
+	var pace time.Duration
+	for {
+		f.m.Lock()
+		for !f.ready(id) {
+			wake := f.wake
+			f.m.Unlock()
+			select {
+			case <-wake:
+			case <-closed:
+				return
+			}
+			f.m.Lock()
+		}
+		f.m.Unlock()
+		f.clock.Sleep(f.latency + pace)
+		pace = 0
+		select {
+		case <-closed:
+			return
+		default:
+		}
+		f.m.Lock()
+		if p, ok := f.next(id); ok {
+			f.queueDepth.With(string(rune(id))).Set(len(f.packets[id]))
+			l := f.linkOf(p)
+			imp := f.impairments(l)
+			// every fragment is a packet of its own on the way, only the time they take and
+			// whether they all make it are simulated - they're put back together here
+			fragments := 1
+			if imp.MTU > 0 && len(p) > imp.MTU && imp.Fragment {
+				fragments = (len(p) + imp.MTU - 1) / imp.MTU
+			}
+			n := rand.Intn(100)
+			for i := 1; i < fragments && imp.Drop <= n; i++ {
+				n = min(n, rand.Intn(100))
+			}
+			if imp.Drop > n {
+				if f.infoEnabled() {
+					f.logger.Info("dropped", packet.Fields(p)...)
+				}
+				l.dropped.Inc()
+				f.emit("dropped", p)
+			} else {
+				n = rand.Intn(100)
+				if imp.Duplicate > n {
+					// copied before zeroing, so the copy can make it through intact
+					if f.infoEnabled() {
+						f.logger.Info("duplicated", packet.Fields(p)...)
+					}
+					l.duplicated.Inc()
+					f.packets[id] = append(f.packets[id], append([]byte(nil), p...))
+					f.queueDepth.With(string(rune(id))).Set(len(f.packets[id]))
+					f.emit("duplicated", p)
+				}
+				n = rand.Intn(100)
+				if imp.Zero > n {
+					if f.infoEnabled() {
+						f.logger.Info("zeroed a byte", packet.Fields(p)...)
+					}
+					l.corrupted.Inc()
+					p[len(p)-3] &= 0x00
+					f.emit("zeroed", p)
+				}
+				if fragments > 1 {
+					l.fragmented.Inc()
+					f.emit("fragmented", p)
+				}
+				c.Write(p)
+				l.out.Inc()
+				f.emit("out", p)
+				// the time it takes to put p on a link that slow
+				if imp.Bandwidth > 0 {
+					pace = time.Duration(len(p)) * time.Second / time.Duration(imp.Bandwidth)
+				}
+				pace += time.Duration(fragments-1) * f.latency
+			}
+		}
+		f.m.Unlock()
+	}
+}
+
+func (f *Forwarder) handleReceive(nc net.Conn) {
+	// endpoints frame their packets, see packet.Conn
+	c := packet.NewConn(nc)
+	data := make([]byte, packet.MaxSize)
+	//id_info, err := bufio.NewReader(c).ReadBytes('\n')
+	n, err := c.Read(data)
+	if err == nil && n == 0 {
+		err = errors.New("empty frame")
+	}
+	if err != nil {
+		f.logger.Error("reading id", "remote", c.RemoteAddr(), "err", err)
+		c.Close()
+		return
+	}
+	id := data[0]
+	f.logger.Info("+ connection", "id", string(rune(id)), "remote", c.RemoteAddr())
+	// it is assumed that there will be no duplicate registrations with forwarder
+	// as in, no malicious actor that takes advantage of it being a model
+	ep := &Endpoint{ID: id, Remote: c.RemoteAddr().String(), Since: f.clock.Now(), c: c, closed: make(chan struct{})}
+	f.m.Lock()
+	f.endpoints[id] = ep
+	f.m.Unlock()
+	f.logger.Debug("started handleSend", "id", string(rune(id)))
+	go f.handleSend(c, id, ep.closed)
+
+	// decoded into again and again as well, it doesn't allocate once its Data is big enough
+	var pk packet.Packet
+	for {
+		// data is read into again and again, what's queued is a copy of the packet
+		// (only as big as the packet, not packet.MaxSize) since the queue holds on to it
+		n, err := c.Read(data)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				f.logger.Warn("read failed", "id", string(rune(id)), "err", err)
+			}
+			break
+		}
+
+		// a bad checksum is passed on as it is, checking is the endpoints' responsibility -
+		// only a packet without a header to route it by is dropped
+		err = pk.UnmarshalBinary(data[:n])
+		dest, src, flag := pk.Dest, pk.Src, pk.Flag
+		if f.infoEnabled() {
+			f.logger.Info("handleRecv", packet.Fields(data[:n])...)
+		}
+		var bad packet.DecodeError
+		if !errors.As(err, &bad) || !bad.Corrupt() {
+			p := bytes.Clone(data[:n])
+			f.m.Lock()
+			l := f.linkOf(p)
+			l.in.Inc()
+			f.emit("in", p)
+			var by time.Duration
+			for _, d := range f.delays {
+				if d.matches(src, dest, flag) && d.By > by {
+					by = d.By
+				}
+			}
+			if by > 0 {
+				f.emit("delayed", p)
+			}
+			f.m.Unlock()
+			if by > 0 {
+				h := pk.Header
+				f.clock.AfterFunc(by, func() { f.enqueue(id, h, p) })
+			} else {
+				f.enqueue(id, pk.Header, p)
+			}
+		} else {
+			f.packetsMalformed.With(string(rune(id))).Inc()
+		}
+	}
+	c.Close()
+	f.logger.Info("- connection", "id", string(rune(id)))
+	close(ep.closed)
+	f.m.Lock()
+	// it might have registered again already
+	if f.endpoints[id] == ep {
+		delete(f.endpoints, id)
+		f.reset(id)
+	}
+	f.m.Unlock()
+}
+
+// reset queues a RESET from id to everyone it has exchanged packets with, so they don't wait
+// for an answer that is never coming - it goes through the same impairments as everything
+// else, so it can get lost too. f.m must be held
+func (f *Forwarder) reset(id byte) {
+	peers := make(map[byte]bool)
+	for k := range f.links {
+		if k[0] == id && k[1] != id {
+			peers[k[1]] = true
+		} else if k[1] == id && k[0] != id {
+			peers[k[0]] = true
+		}
+	}
+	for peer := range peers {
+		if _, ok := f.endpoints[peer]; !ok {
+			continue
+		}
+		// nothing but a header, it can't be too big
+		p, _ := packet.Packet{Header: packet.Header{Dest: peer, Src: id, Flag: packet.RESET}}.MarshalBinary()
+		f.logger.Info("reset", packet.Fields(p)...)
+		f.resets.With(string(rune(id)), string(rune(peer))).Inc()
+		f.packets[peer] = append(f.packets[peer], p)
+		f.queueDepth.With(string(rune(peer))).Set(len(f.packets[peer]))
+		f.emit("reset", p)
+	}
+	f.notify()
+}
@@ -0,0 +1,263 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"handin2/packet"
+	"os"
+	"sync"
+	"time"
+)
+
+// Scenario is a timeline of faults, loaded from a JSON file like
+//
+//	{"steps": [
+//	  {"at": "2s", "for": "5s", "partition": ["c", "s"]},
+//	  {"at": "0s", "for": "30s", "flap": {"src": "c", "dest": "s", "both": true, "up": "2s", "down": "500ms"}},
+//	  {"at": "10s", "for": "5s", "blackhole": {"src": "s", "dest": "c"}},
+//	  {"at": "0s", "delay": {"flags": "DONE", "by": "3s"}}
+//	]}
+//
+// every step has exactly one of partition, flap, blackhole or delay
+type Scenario struct {
+	Steps []Step `json:"steps"`
+}
+
+type Step struct {
+	// when the step starts, counting from when the scenario is played
+	At Duration `json:"at"`
+	// how long it lasts before being undone, 0 means it's never undone
+	// (flapping needs to know when to stop, so it has to be set for that)
+	For Duration `json:"for"`
+
+	// groups of ids, see Forwarder.Partition
+	Partition []string `json:"partition,omitempty"`
+	// take a link down and up on a schedule
+	Flap *Flap `json:"flap,omitempty"`
+	// throw away everything in one direction
+	Blackhole *LinkRef `json:"blackhole,omitempty"`
+	// hold back packets of one type
+	Delay *DelayStep `json:"delay,omitempty"`
+}
+
+type LinkRef struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
+}
+
+type Flap struct {
+	LinkRef
+	// both directions at once, rather than only src -> dest
+	Both bool     `json:"both"`
+	Up   Duration `json:"up"`
+	Down Duration `json:"down"`
+}
+
+type DelayStep struct {
+	// empty src/dest matches any
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
+	// e.g. "DONE" or "ACCEPT|DONE", "EMPTY" is data packets
+	Flags string   `json:"flags"`
+	By    Duration `json:"by"`
+}
+
+// Duration is a time.Duration written like "1.5s" in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScenario(b)
+}
+
+func ParseScenario(b []byte) (*Scenario, error) {
+	var s Scenario
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, err
+	}
+	for i, st := range s.Steps {
+		if err := st.validate(); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+	}
+	return &s, nil
+}
+
+func (st Step) validate() error {
+	actions := 0
+	if st.Partition != nil {
+		actions++
+		groups := make([][]byte, len(st.Partition))
+		for i, g := range st.Partition {
+			groups[i] = []byte(g)
+		}
+		if err := validGroups(groups); err != nil {
+			return err
+		}
+	}
+	if st.Flap != nil {
+		actions++
+		if err := st.Flap.LinkRef.validate(false); err != nil {
+			return err
+		}
+		if st.For <= 0 || st.Flap.Up <= 0 || st.Flap.Down <= 0 {
+			return errors.New("flap needs for, up and down to be set")
+		}
+	}
+	if st.Blackhole != nil {
+		actions++
+		if err := st.Blackhole.validate(false); err != nil {
+			return err
+		}
+	}
+	if st.Delay != nil {
+		actions++
+		if err := (LinkRef{st.Delay.Src, st.Delay.Dest}).validate(true); err != nil {
+			return err
+		}
+		if _, err := packet.ParseFlags(st.Delay.Flags); err != nil {
+			return err
+		}
+		if st.Delay.By <= 0 {
+			return errors.New("delay needs by to be set")
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("needs exactly one of partition, flap, blackhole or delay, has %d", actions)
+	}
+	if st.At < 0 || st.For < 0 {
+		return errors.New("at and for can't be negative")
+	}
+	return nil
+}
+
+// ids are single characters, like when endpoints register
+func (l LinkRef) validate(emptyOK bool) error {
+	for _, id := range []string{l.Src, l.Dest} {
+		if len(id) != 1 && !(emptyOK && id == "") {
+			return fmt.Errorf("ids have to be a single character, got %q", id)
+		}
+	}
+	return nil
+}
+
+func idOf(s string) byte {
+	if s == "" {
+		return 0
+	}
+	return s[0]
+}
+
+// Play runs the timeline, returning once every step is over or ctx is done - steps that
+// are still in effect when ctx is done are undone, apart from the ones that are never undone
+func (f *Forwarder) Play(ctx context.Context, s *Scenario) {
+	var wg sync.WaitGroup
+	for i, st := range s.Steps {
+		wg.Add(1)
+		go func(i int, st Step) {
+			defer wg.Done()
+			f.play(ctx, i, st)
+		}(i, st)
+	}
+	wg.Wait()
+}
+
+// sleep for d, false if ctx was done first
+func (f *Forwarder) sleep(ctx context.Context, d time.Duration) bool {
+	t := f.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (f *Forwarder) play(ctx context.Context, i int, st Step) {
+	if !f.sleep(ctx, time.Duration(st.At)) {
+		return
+	}
+	f.logger.Info("scenario step", "step", i, "for", time.Duration(st.For))
+
+	if st.Flap != nil {
+		f.flap(ctx, st.Flap, time.Duration(st.For))
+		f.logger.Info("scenario step over", "step", i)
+		return
+	}
+
+	var undo func()
+	switch {
+	case st.Partition != nil:
+		groups := make([][]byte, len(st.Partition))
+		for i, g := range st.Partition {
+			groups[i] = []byte(g)
+		}
+		undo = f.pushPartition(groups)
+	case st.Blackhole != nil:
+		undo = f.holdDown(idOf(st.Blackhole.Src), idOf(st.Blackhole.Dest))
+	case st.Delay != nil:
+		flags, _ := packet.ParseFlags(st.Delay.Flags)
+		d := f.AddDelay(Delay{Src: idOf(st.Delay.Src), Dest: idOf(st.Delay.Dest), Flags: flags, By: time.Duration(st.Delay.By)})
+		undo = func() { f.RemoveDelay(d) }
+	}
+	if st.For == 0 {
+		return
+	}
+	f.sleep(ctx, time.Duration(st.For))
+	undo()
+	f.logger.Info("scenario step over", "step", i)
+}
+
+// flap goes down for fl.Down, then up for fl.Up, till d is over - and leaves it up
+func (f *Forwarder) flap(ctx context.Context, fl *Flap, d time.Duration) {
+	src, dest := idOf(fl.Src), idOf(fl.Dest)
+	// held down like a blackhole, so the flap going up doesn't take other steps with it
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+		releases = nil
+	}
+	hold := func() {
+		releases = append(releases, f.holdDown(src, dest))
+		if fl.Both {
+			releases = append(releases, f.holdDown(dest, src))
+		}
+	}
+	defer release()
+	end := f.clock.Now().Add(d)
+	for {
+		hold()
+		if !f.sleep(ctx, min(time.Duration(fl.Down), end.Sub(f.clock.Now()))) {
+			return
+		}
+		release()
+		if !f.sleep(ctx, min(time.Duration(fl.Up), end.Sub(f.clock.Now()))) || !f.clock.Now().Before(end) {
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package forwarder
+
+import (
+	"context"
+	"handin2/clock"
+	"handin2/metrics"
+	"testing"
+	"time"
+)
+
+func TestParseScenario(t *testing.T) {
+	if _, err := ParseScenario([]byte(`{"steps":[
+		{"at":"1s","for":"2s","partition":["ab","c"]},
+		{"at":"0s","for":"5s","flap":{"src":"a","dest":"b","up":"1s","down":"1s"}},
+		{"at":"0s","delay":{"flags":"ACCEPT|DONE","by":"1s"}}
+	]}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{
+		`{"steps":[{"at":"0s"}]}`,
+		`{"steps":[{"at":"0s","partition":["a"],"blackhole":{"src":"a","dest":"b"}}]}`,
+		`{"steps":[{"at":"0s","partition":["ab",""]}]}`,
+		`{"steps":[{"at":"0s","partition":["ab","bc"]}]}`,
+		`{"steps":[{"at":"0s","flap":{"src":"a","dest":"b","up":"1s","down":"1s"}}]}`,
+		`{"steps":[{"at":"0s","blackhole":{"src":"ab","dest":"b"}}]}`,
+		`{"steps":[{"at":"0s","delay":{"flags":"SOON","by":"1s"}}]}`,
+		`{"steps":[{"at":"-1s","for":"1s","blackhole":{"src":"a","dest":"b"}}]}`,
+		`{"steps":[{"at":"1 second","blackhole":{"src":"a","dest":"b"}}]}`,
+	} {
+		if _, err := ParseScenario([]byte(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+// what the test looks at, after every second of the scenario
+type state struct {
+	// a, b and c partitioned from each other, and x from y
+	ab, ac, bc, xy bool
+	// the link a->b, and b->a
+	down, back bool
+	// steps still running
+	waiters int
+}
+
+// steps that overlap only undo what they did themselves: the partition under one is back
+// when it's over, and a link two steps took down is only up once both are done with it
+func TestPlayOverlapping(t *testing.T) {
+	v := clock.NewVirtual(time.Unix(0, 0))
+	f := New(Config{Registry: metrics.NewRegistry(), Clock: v})
+	s, err := ParseScenario([]byte(`{"steps":[
+		{"at":"0s","for":"8s","partition":["ab","c"]},
+		{"at":"2s","for":"3s","partition":["a","bc"]},
+		{"at":"0s","for":"6s","flap":{"src":"a","dest":"b","up":"1s","down":"2s"}},
+		{"at":"4s","for":"4s","blackhole":{"src":"a","dest":"b"}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the one from before the scenario, it's back once all of them are over
+	f.Partition([][]byte{[]byte("x"), []byte("y")})
+	current := func() state {
+		f.m.Lock()
+		defer f.m.Unlock()
+		return state{
+			f.partitioned('a', 'b'), f.partitioned('a', 'c'), f.partitioned('b', 'c'), f.partitioned('x', 'y'),
+			f.link('a', 'b').isDown(), f.link('b', 'a').isDown(), v.Waiters(),
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.Play(context.Background(), s)
+		close(done)
+	}()
+	for i, want := range []state{
+		// 0s: ab|c, and the flap starts down
+		{false, true, true, false, true, false, 4},
+		{false, true, true, false, true, false, 4},
+		// 2s: a|bc on top, the flap is up
+		{true, true, false, false, false, false, 4},
+		// 3s: the flap goes down again
+		{true, true, false, false, true, false, 4},
+		// 4s: the blackhole takes a->b down as well
+		{true, true, false, false, true, false, 4},
+		// 5s: ab|c is back, the flap goes up - but the blackhole still holds it down
+		{false, true, true, false, true, false, 3},
+		// 6s: the flap is over
+		{false, true, true, false, true, false, 2},
+		{false, true, true, false, true, false, 2},
+		// 8s: everything is over, the partition from before is back and a->b is up
+		{false, false, false, true, false, false, 0},
+	} {
+		if i > 0 {
+			v.Advance(time.Second)
+		}
+		// the steps do their thing in goroutines of their own, once they're back to waiting
+		// for the clock they're done with this second
+		for deadline := time.Now().Add(5 * time.Second); current() != want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%ds: %+v, expected %+v", i, current(), want)
+			}
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Play didn't return once every step was over")
+	}
+}
@@ -1,3 +1,3 @@
 module handin2
 
-go 1.19
+go 1.22
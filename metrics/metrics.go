@@ -0,0 +1,297 @@
+// Package metrics is a small set of counters, gauges and histograms that can be
+// read back as a snapshot or written in the Prometheus text format - it's just
+// enough to graph what the network is doing without pulling in dependencies
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry that the packet package and the commands register with
+var Default = NewRegistry()
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n int)     { c.v.Add(uint64(n)) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Set(n int)    { g.v.Store(int64(n)) }
+func (g *Gauge) Add(n int)    { g.v.Add(int64(n)) }
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+type Histogram struct {
+	m      sync.Mutex
+	bounds []float64
+	// counts[i] is observations <= bounds[i], the last one is +Inf
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.total++
+}
+
+// Buckets are exponential upper bounds, start * factor^i for i < n
+func Buckets(start float64, factor float64, n int) []float64 {
+	b := make([]float64, n)
+	for i := range b {
+		b[i] = start
+		start *= factor
+	}
+	return b
+}
+
+type kind string
+
+const (
+	counter   kind = "counter"
+	gauge     kind = "gauge"
+	histogram kind = "histogram"
+)
+
+type family struct {
+	name   string
+	help   string
+	kind   kind
+	labels []string
+	bounds []float64
+
+	m sync.Mutex
+	// label values joined by \xff -> *Counter, *Gauge or *Histogram
+	children map[string]any
+}
+
+func (f *family) child(values []string) any {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.m.Lock()
+	defer f.m.Unlock()
+	if c, ok := f.children[key]; ok {
+		return c
+	}
+	var c any
+	switch f.kind {
+	case counter:
+		c = &Counter{}
+	case gauge:
+		c = &Gauge{}
+	case histogram:
+		c = &Histogram{bounds: f.bounds, counts: make([]uint64, len(f.bounds)+1)}
+	}
+	f.children[key] = c
+	return c
+}
+
+type CounterVec struct{ f *family }
+
+// With returns the counter for the given label values, in the order the labels were registered
+func (v CounterVec) With(values ...string) *Counter { return v.f.child(values).(*Counter) }
+
+type GaugeVec struct{ f *family }
+
+func (v GaugeVec) With(values ...string) *Gauge { return v.f.child(values).(*Gauge) }
+
+type Registry struct {
+	m        sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(name string, help string, k kind, bounds []float64, labels []string) *family {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic("metrics: " + name + " registered twice")
+		}
+	}
+	f := &family{name: name, help: help, kind: k, labels: labels, bounds: bounds, children: make(map[string]any)}
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *Registry) Counter(name string, help string) *Counter {
+	return r.register(name, help, counter, nil, nil).child(nil).(*Counter)
+}
+
+func (r *Registry) CounterVec(name string, help string, labels ...string) CounterVec {
+	return CounterVec{r.register(name, help, counter, nil, labels)}
+}
+
+func (r *Registry) Gauge(name string, help string) *Gauge {
+	return r.register(name, help, gauge, nil, nil).child(nil).(*Gauge)
+}
+
+func (r *Registry) GaugeVec(name string, help string, labels ...string) GaugeVec {
+	return GaugeVec{r.register(name, help, gauge, nil, labels)}
+}
+
+// Histogram with the given upper bounds, they have to be sorted
+func (r *Registry) Histogram(name string, help string, bounds []float64) *Histogram {
+	return r.register(name, help, histogram, bounds, nil).child(nil).(*Histogram)
+}
+
+// Snapshot maps every series to its current value, the keys are written
+// the same way as in the text format, e.g. `forwarder_packets_in_total{src="c",dest="s"}`
+type Snapshot map[string]float64
+
+func (r *Registry) Snapshot() Snapshot {
+	s := make(Snapshot)
+	r.each(func(f *family) {
+		f.samples(func(series string, v float64) {
+			s[series] = v
+		})
+	})
+	return s
+}
+
+// WriteText writes every metric in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	r.each(func(f *family) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		f.samples(func(series string, v float64) {
+			fmt.Fprintf(bw, "%s %s\n", series, formatFloat(v))
+		})
+	})
+	return bw.Flush()
+}
+
+func (r *Registry) each(fn func(f *family)) {
+	r.m.Lock()
+	families := append([]*family{}, r.families...)
+	r.m.Unlock()
+	for _, f := range families {
+		fn(f)
+	}
+}
+
+func (f *family) samples(fn func(series string, v float64)) {
+	f.m.Lock()
+	keys := make([]string, 0, len(f.children))
+	for k := range f.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]any, len(keys))
+	for i, k := range keys {
+		children[i] = f.children[k]
+	}
+	f.m.Unlock()
+
+	for i, k := range keys {
+		var values []string
+		if len(f.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		switch c := children[i].(type) {
+		case *Counter:
+			fn(series(f.name, f.labels, values), float64(c.Value()))
+		case *Gauge:
+			fn(series(f.name, f.labels, values), float64(c.Value()))
+		case *Histogram:
+			le := append(append([]string{}, f.labels...), "le")
+			c.m.Lock()
+			var cumulative uint64
+			for j, bound := range c.bounds {
+				cumulative += c.counts[j]
+				fn(series(f.name+"_bucket", le, append(values, formatFloat(bound))), float64(cumulative))
+			}
+			fn(series(f.name+"_bucket", le, append(values, "+Inf")), float64(c.total))
+			fn(series(f.name+"_sum", f.labels, values), c.sum)
+			fn(series(f.name+"_count", f.labels, values), float64(c.total))
+			c.m.Unlock()
+		}
+	}
+}
+
+func series(name string, labels []string, values []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(escaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the registry in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+// CheckLoopback is an error unless addr is on loopback (or localhost), for anything that
+// serves HTTP without authentication - the forwarder's admin API uses it too
+func CheckLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("refusing to listen on non-loopback address %q", addr)
+		}
+	}
+	return nil
+}
+
+// ListenAndServe exposes r on /metrics, it refuses to listen on anything but
+// loopback since there's no authentication whatsoever
+func ListenAndServe(addr string, r *Registry) error {
+	if err := CheckLoopback(addr); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,145 @@
+package packet_test
+
+import (
+	"bytes"
+	"handin2/packet"
+	"handin2/sim"
+	"strconv"
+	"testing"
+)
+
+// go test ./packet -run XXX -bench . - allocs/op is the number to watch, every packet
+// that allocates is work for the GC on top of the transfer itself
+
+var payload = bytes.Repeat([]byte("0123456789abcdef"), 64)
+
+// data sections from a tiny one to the largest there is, for the benchmarks that depend on it
+var sizes = []int{16, 1024, 16384, 0xffff}
+
+func bySize(b *testing.B, f func(b *testing.B, data []byte)) {
+	for _, size := range sizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			data := bytes.Repeat([]byte{0x5a}, size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			f(b, data)
+		})
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	bySize(b, func(b *testing.B, data []byte) {
+		for i := 0; i < b.N; i++ {
+			packet.Encode('b', 'a', uint16(i), 7, packet.EMPTY, 0, data)
+		}
+	})
+}
+
+func BenchmarkAppendEncode(b *testing.B) {
+	buf := make([]byte, 0, packet.MaxSize)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		buf = packet.AppendEncode(buf[:0], 'b', 'a', uint16(i), 7, packet.EMPTY, 0, payload)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	bySize(b, func(b *testing.B, data []byte) {
+		raw := packet.Encode('b', 'a', 1, 7, packet.EMPTY, 0, data)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			packet.Decode(raw)
+		}
+	})
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	raw := packet.Encode('b', 'a', 1, 7, packet.EMPTY, 0, payload)
+	var p packet.Packet
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	for i := 0; i < b.N; i++ {
+		p.UnmarshalBinary(raw)
+	}
+}
+
+func BenchmarkMarshalBinary(b *testing.B) {
+	p := packet.Packet{Header: packet.Header{Dest: 'b', Src: 'a', Seq: 1, Epoch: 7}, Data: payload}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		p.MarshalBinary()
+	}
+}
+
+// every packet is checksummed when it's encoded, and again when it's decoded
+func BenchmarkChecksum(b *testing.B) {
+	bySize(b, func(b *testing.B, data []byte) {
+		for i := 0; i < b.N; i++ {
+			packet.CalculateChecksum(data)
+		}
+	})
+}
+
+func BenchmarkVerifyChecksum(b *testing.B) {
+	bySize(b, func(b *testing.B, data []byte) {
+		raw := packet.Encode('b', 'a', 1, 7, packet.EMPTY, 0, data)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			packet.VerifyChecksum(raw)
+		}
+	})
+}
+
+// AppendEncode into a buffer that's big enough, Decode, and decoding into a Packet that
+// has been decoded into before shouldn't allocate at all
+func TestAllocs(t *testing.T) {
+	buf := make([]byte, 0, packet.MaxSize)
+	raw := packet.Encode('b', 'a', 1, 7, packet.START, 512, payload)
+	var p packet.Packet
+	for name, f := range map[string]func(){
+		"AppendEncode":          func() { buf = packet.AppendEncode(buf[:0], 'b', 'a', 1, 7, packet.START, 512, payload) },
+		"Decode":                func() { packet.Decode(raw) },
+		"Decode corrupt":        func() { packet.Decode(raw[:5]) },
+		"UnmarshalBinary":       func() { p.UnmarshalBinary(raw) },
+		"UnmarshalBinary error": func() { p.UnmarshalBinary(raw[:5]) },
+		"AppendBinary": func() {
+			p.Flag = packet.START
+			buf, _ = p.AppendBinary(buf[:0])
+		},
+	} {
+		if n := testing.AllocsPerRun(100, f); n != 0 {
+			t.Errorf("%s: %v allocations", name, n)
+		}
+	}
+}
+
+// a whole transfer of 64KiB in 1KiB segments, over a pipe with nothing in between
+func BenchmarkSendRecv(b *testing.B) {
+	x, y := sim.Pipe(nil, "send", "recv")
+	defer x.Close()
+	defer y.Close()
+	sender, receiver := packet.NewConn(x), packet.NewConn(y)
+	data := bytes.Repeat(payload, 64)
+	done := make(chan error)
+	go func() {
+		for {
+			if _, _, err := packet.Recv(receiver, 'b', 0); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := packet.Send(sender, 'a', 'b', data, uint16(len(payload)), 10); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	x.Close()
+	<-done
+}
@@ -0,0 +1,273 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Send once CloseWrite (or Close) has been called for that peer
+var ErrClosed = errors.New("Connection to the peer is closed for writing")
+
+// ClosedError is returned when Peer is done - either it sent FIN (it won't send anything more,
+// but it can still be sent to), or the forwarder sent RESET for it because it disconnected
+type ClosedError struct {
+	Peer  byte
+	Reset bool
+}
+
+func (e *ClosedError) Error() string {
+	if e.Reset {
+		return fmt.Sprintf("Connection reset, <%c> is gone", e.Peer)
+	}
+	return fmt.Sprintf("<%c> closed the connection", e.Peer)
+}
+
+// how long Close waits for the peer to send its own FIN, after its FIN was acknowledged
+const finWait = 10 * time.Second
+
+// how long Close hangs around after the peer's FIN, in case the FIN-ACK for it gets lost
+// and the peer sends it again - without it, the peer would be left waiting for an answer
+var (
+	timeWaitM sync.Mutex
+	timeWait  = 2 * time.Second
+)
+
+// SetTimeWait sets how long Close waits around after both sides have sent FIN, 0 skips it
+func SetTimeWait(d time.Duration) {
+	timeWaitM.Lock()
+	timeWait = d
+	timeWaitM.Unlock()
+}
+
+// what we know about closing between us and a peer, {us, them} -> state
+type closeState struct {
+	// we sent FIN and it was acknowledged
+	finSent bool
+	// they sent FIN, told is whether Recv (or Close) has let the caller know yet
+	finRecv bool
+	told    bool
+}
+
+var (
+	closesM sync.Mutex
+	closes  = make(map[[2]byte]*closeState)
+)
+
+// closesM must be held
+func closeStateOf(src byte, peer byte) *closeState {
+	k := [2]byte{src, peer}
+	st, ok := closes[k]
+	if !ok {
+		st = &closeState{}
+		closes[k] = st
+	}
+	return st
+}
+
+func writeClosed(src byte, peer byte) bool {
+	closesM.Lock()
+	defer closesM.Unlock()
+	st, ok := closes[[2]byte{src, peer}]
+	return ok && st.finSent
+}
+
+// gotFin acknowledges a FIN from peer, every time since the last FIN-ACK might have been
+// lost - fresh is false if it's one we already had
+func gotFin(c net.Conn, src byte, peer byte, seq uint16, epoch uint16) (fresh bool) {
+	fin_ack := Encode(peer, src, seq, epoch, FIN|ACCEPT, 0, []byte{})
+	if debugEnabled() {
+		logger.Debug("FIN-ACK", Fields(fin_ack)...)
+	}
+	c.Write(fin_ack)
+	if seenEpoch(src, peer, epoch) {
+		logger.Debug("FIN received twice, discarding", "epoch", epoch)
+		discarded.With("duplicate").Inc()
+		return false
+	}
+	finish(src, peer, Header{peer, src, seq, epoch, FIN | ACCEPT, 0})
+	see(src, peer, epoch)
+	closesM.Lock()
+	st := closeStateOf(src, peer)
+	st.finRecv = true
+	st.told = false
+	closesM.Unlock()
+	return true
+}
+
+// untold is a peer that sent FIN while we were busy with something else, so Recv can
+// report it before waiting for anything new
+func untold(src byte) (peer byte, ok bool) {
+	closesM.Lock()
+	defer closesM.Unlock()
+	for k, st := range closes {
+		if k[0] == src && st.finRecv && !st.told {
+			st.told = true
+			return k[1], true
+		}
+	}
+	return 0, false
+}
+
+func tell(src byte, peer byte) {
+	closesM.Lock()
+	closeStateOf(src, peer).told = true
+	closesM.Unlock()
+}
+
+// gotReset forgets everything about peer, it's gone - worth reporting is false if both
+// sides had closed already, then the RESET is just the forwarder noticing it left
+func gotReset(src byte, peer byte) (worthReporting bool) {
+	closesM.Lock()
+	defer closesM.Unlock()
+	k := [2]byte{src, peer}
+	st, ok := closes[k]
+	delete(closes, k)
+	return !ok || !(st.finSent && st.finRecv)
+}
+
+// reopen is for a START from peer - if it had closed, this is a new conversation
+func reopen(src byte, peer byte) {
+	closesM.Lock()
+	defer closesM.Unlock()
+	k := [2]byte{src, peer}
+	if st, ok := closes[k]; ok && st.finRecv {
+		delete(closes, k)
+	}
+}
+
+// CloseWrite tells dest that we won't send it anything more (a half-close), and waits for
+// it to acknowledge that - Recv still works, dest can keep sending till it closes too.
+// tolerance is like in Send
+func CloseWrite(c net.Conn, src byte, dest byte, tolerance uint16) (e error) {
+	if writeClosed(src, dest) {
+		return
+	}
+	bp := getBuffer()
+	defer putBuffer(bp)
+	buffer := *bp
+	var p Packet
+	var attempts uint16 = 0
+	var epoch uint16
+send_fin:
+	if attempts > tolerance {
+		e = errors.New("FIN wasn't acknowledged, attempts exceeded set tolerance")
+		return
+	}
+	attempts++
+	epoch = nextEpoch()
+	fin := Encode(dest, src, 0, epoch, FIN, 0, []byte{})
+	if debugEnabled() {
+		logger.Debug("CloseWrite(1): FIN", Fields(fin)...)
+	}
+	c.Write(fin)
+	deadline := now().Add(2 * time.Second)
+await_fin_ack:
+	c.SetReadDeadline(deadline)
+	n, err := c.Read(buffer)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			logger.Warn("timed out waiting for FIN-ACK", "src", string(rune(src)), "dest", string(rune(dest)), "attempt", attempts)
+			goto send_fin
+		}
+		e = err
+		return
+	}
+	err = p.UnmarshalBinary(buffer[:n])
+	if debugEnabled() {
+		logger.Debug("CloseWrite(2): response to FIN", Fields(buffer[:n])...)
+	}
+	if err != nil || p.Dest != src || p.Src != dest {
+		logger.Debug("CloseWrite(2A): not from who we're closing, discarding")
+		discarded.With("stale").Inc()
+		goto await_fin_ack
+	}
+	switch {
+	case p.IsReset():
+		gotReset(src, dest)
+		e = &ClosedError{Peer: dest, Reset: true}
+		return
+	case p.Flag == FIN:
+		// both closing at once
+		gotFin(c, src, dest, p.Seq, p.Epoch)
+		goto await_fin_ack
+	case p.Flag == FIN|ACCEPT && p.Epoch == epoch:
+		closesM.Lock()
+		closeStateOf(src, dest).finSent = true
+		closesM.Unlock()
+		return
+	}
+	logger.Debug("CloseWrite(2B): not a FIN-ACK for this FIN, discarding")
+	discarded.With("stale").Inc()
+	goto await_fin_ack
+}
+
+// Close is CloseWrite followed by waiting for dest to close its side as well - if it already
+// has, that's it. If it hasn't, anything dest sends meanwhile is thrown away, and once its
+// FIN shows up Close waits a little longer (see SetTimeWait) to answer it again if needed
+func Close(c net.Conn, src byte, dest byte, tolerance uint16) (e error) {
+	if e = CloseWrite(c, src, dest, tolerance); e != nil {
+		return
+	}
+	closesM.Lock()
+	st := closeStateOf(src, dest)
+	done := st.finRecv
+	st.told = true
+	closesM.Unlock()
+	if done {
+		return
+	}
+
+	bp := getBuffer()
+	defer putBuffer(bp)
+	buffer := *bp
+	var p Packet
+	timeWaitM.Lock()
+	linger := timeWait
+	timeWaitM.Unlock()
+	var deadline = now().Add(finWait)
+	closing := true
+await_fin:
+	c.SetReadDeadline(deadline)
+	n, err := c.Read(buffer)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if closing {
+				logger.Warn("peer never sent FIN, closing anyway", "src", string(rune(src)), "dest", string(rune(dest)))
+			}
+			return
+		}
+		e = err
+		return
+	}
+	err = p.UnmarshalBinary(buffer[:n])
+	if debugEnabled() {
+		logger.Debug("Close(1): waiting for FIN", Fields(buffer[:n])...)
+	}
+	if err != nil || p.Dest != src || p.Src != dest {
+		discarded.With("stale").Inc()
+		goto await_fin
+	}
+	if p.IsReset() {
+		gotReset(src, dest)
+		return
+	}
+	if p.Flag == FIN {
+		if gotFin(c, src, dest, p.Seq, p.Epoch) {
+			tell(src, dest)
+		}
+		if closing {
+			// TIME_WAIT
+			closing = false
+			deadline = now().Add(linger)
+		}
+		goto await_fin
+	}
+	logger.Debug("Close(1A): not a FIN, discarding")
+	discarded.With("stale").Inc()
+	goto await_fin
+}
@@ -0,0 +1,121 @@
+package packet_test
+
+import (
+	"errors"
+	"handin2/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+// closing is tested with the scripted peer from transfer_test.go - what's known about closing
+// is kept per {us, them} for the whole package, so every test starts with it forgotten
+
+func closeWrite(c net.Conn, src byte, dest byte) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- packet.CloseWrite(c, src, dest, 3) }()
+	return done
+}
+
+func closeBoth(c net.Conn, src byte, dest byte) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- packet.Close(c, src, dest, 3) }()
+	return done
+}
+
+func TestCloseWrite(t *testing.T) {
+	packet.ForgetCloses()
+	_, c, p := setup(t)
+	done := closeWrite(c, 'k', 'l')
+
+	fin := p.readFlag(packet.FIN)
+	if fin.dest != 'l' || fin.src != 'k' {
+		t.Fatalf("FIN: %+v", fin)
+	}
+	// a FIN-ACK for another FIN doesn't count
+	p.write(segment{'k', 'l', 0, fin.epoch + 1, packet.FIN | packet.ACCEPT, 0, nil})
+	p.write(segment{'k', 'l', 0, fin.epoch, packet.FIN | packet.ACCEPT, 0, nil})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := packet.Send(c, 'k', 'l', []byte("hello"), 8, 3); !errors.Is(err, packet.ErrClosed) {
+		t.Errorf("Send after CloseWrite: %v", err)
+	}
+	// it's only closed for writing, the peer can still send
+	received := recv(c, 'k', 0)
+	epoch := newEpoch()
+	p.write(segment{'k', 'l', 1, epoch, packet.START, 5, nil})
+	p.readFlag(packet.ACCEPT)
+	p.write(segment{'k', 'l', 0, epoch, packet.EMPTY, 0, []byte("hello")})
+	p.readFlag(packet.DONE)
+	if r := <-received; r.err != nil || string(r.data) != "hello" {
+		t.Errorf("Recv after CloseWrite: %q, %v", r.data, r.err)
+	}
+}
+
+// the FIN-ACK for the peer's FIN is lost, it sends its FIN again while Close is in TIME_WAIT
+func TestCloseTimeWait(t *testing.T) {
+	packet.ForgetCloses()
+	clk, c, p := setup(t)
+	done := closeBoth(c, 'm', 'n')
+
+	fin := p.readFlag(packet.FIN)
+	p.write(segment{'m', 'n', 0, fin.epoch, packet.FIN | packet.ACCEPT, 0, nil})
+	epoch := newEpoch()
+	for i := 0; i < 2; i++ {
+		p.write(segment{'m', 'n', 0, epoch, packet.FIN, 0, nil})
+		if ack := p.read(); ack.flag != packet.FIN|packet.ACCEPT || ack.epoch != epoch {
+			t.Fatalf("FIN %d: expected a FIN-ACK with epoch %d, got %+v", i, epoch, ack)
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Close returned before TIME_WAIT was over: %v", err)
+	default:
+	}
+	clk.BlockUntil(1)
+	clk.Advance(2 * time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// both send FIN at once, each acknowledges the other's - Close doesn't wait for a FIN it has
+func TestCloseSimultaneous(t *testing.T) {
+	packet.ForgetCloses()
+	_, c, p := setup(t)
+	done := closeBoth(c, 'o', 'p')
+
+	fin := p.readFlag(packet.FIN)
+	epoch := newEpoch()
+	p.write(segment{'o', 'p', 0, epoch, packet.FIN, 0, nil})
+	if ack := p.read(); ack.flag != packet.FIN|packet.ACCEPT || ack.epoch != epoch {
+		t.Fatalf("expected a FIN-ACK for the peer's FIN, got %+v", ack)
+	}
+	p.write(segment{'o', 'p', 0, fin.epoch, packet.FIN | packet.ACCEPT, 0, nil})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecvClosed(t *testing.T) {
+	packet.ForgetCloses()
+	_, c, p := setup(t)
+
+	done := recv(c, 'q', 0)
+	epoch := newEpoch()
+	p.write(segment{'q', 'r', 0, epoch, packet.FIN, 0, nil})
+	if ack := p.read(); ack.flag != packet.FIN|packet.ACCEPT || ack.epoch != epoch {
+		t.Fatalf("expected a FIN-ACK, got %+v", ack)
+	}
+	var closed *packet.ClosedError
+	if r := <-done; !errors.As(r.err, &closed) || closed.Peer != 'r' || closed.Reset || r.from != 'r' {
+		t.Fatalf("expected a ClosedError for a FIN from r, got %v (from %c)", r.err, r.from)
+	}
+
+	done = recv(c, 'q', 0)
+	p.write(segment{'q', 'r', 0, 0, packet.RESET, 0, nil})
+	if r := <-done; !errors.As(r.err, &closed) || closed.Peer != 'r' || !closed.Reset {
+		t.Fatalf("expected a ClosedError for a RESET from r, got %v", r.err)
+	}
+}
@@ -0,0 +1,176 @@
+package packet
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// CongestionControl decides how many segments Send can have in flight (sent, but not
+// acknowledged by the receiver yet). Send makes a new one for every transfer, see
+// SetCongestionControl
+type CongestionControl interface {
+	// the congestion window, in segments - Send never has less than 1 in flight
+	Window() int
+	// acked segments were acknowledged for the first time
+	OnAck(acked int)
+	// the receiver acknowledged the same thing again, so something after it is missing
+	OnDupAck()
+	// three duplicate acks in a row, the first missing segment is sent again right away
+	OnLoss()
+	// nothing was acknowledged for a whole retransmission timeout
+	OnTimeout()
+}
+
+var (
+	ccM   sync.Mutex
+	newCC func() CongestionControl = NewReno
+)
+
+// SetCongestionControl sets what Send uses from its next transfer, e.g. packet.NewCubic -
+// nil goes back to the default, NewReno
+func SetCongestionControl(f func() CongestionControl) {
+	if f == nil {
+		f = NewReno
+	}
+	ccM.Lock()
+	newCC = f
+	ccM.Unlock()
+}
+
+func congestionControl() CongestionControl {
+	ccM.Lock()
+	defer ccM.Unlock()
+	return newCC()
+}
+
+// the window starts here, and ssthresh (where slow start turns into congestion avoidance)
+// starts out high enough that only a loss ends slow start
+const (
+	initialWindow   = 2
+	initialSsthresh = 64
+)
+
+// Reno is TCP Reno: slow start doubles the window every round trip till ssthresh, after
+// that congestion avoidance adds one segment per round trip. Three duplicate acks halve it
+// (fast retransmit, then fast recovery till the missing segment is acked), a timeout puts
+// it back to one segment and starts over with slow start
+type Reno struct {
+	cwnd     float64
+	ssthresh float64
+	recovery bool
+}
+
+func NewReno() CongestionControl {
+	return &Reno{cwnd: initialWindow, ssthresh: initialSsthresh}
+}
+
+func (r *Reno) Window() int {
+	return max(1, int(r.cwnd))
+}
+
+func (r *Reno) OnAck(acked int) {
+	if r.recovery {
+		// the missing segment made it, deflate back to what the loss left us with
+		r.cwnd = r.ssthresh
+		r.recovery = false
+		return
+	}
+	for i := 0; i < acked; i++ {
+		if r.cwnd < r.ssthresh {
+			r.cwnd++
+		} else {
+			r.cwnd += 1 / r.cwnd
+		}
+	}
+}
+
+func (r *Reno) OnDupAck() {
+	// every duplicate ack means a segment left the network
+	if r.recovery {
+		r.cwnd++
+	}
+}
+
+func (r *Reno) OnLoss() {
+	r.ssthresh = max(r.cwnd/2, 2)
+	r.cwnd = r.ssthresh + 3
+	r.recovery = true
+}
+
+func (r *Reno) OnTimeout() {
+	r.ssthresh = max(r.cwnd/2, 2)
+	r.cwnd = 1
+	r.recovery = false
+}
+
+// Cubic is CUBIC (RFC 8312) - slow start and timeouts are like Reno, but in congestion
+// avoidance the window follows a cubic function of the time since the last loss, centered
+// on the window the loss happened at, instead of growing by one segment per round trip.
+// It never grows slower than Reno would
+type Cubic struct {
+	Reno
+	// window at the last loss, and when congestion avoidance started after it
+	wMax  float64
+	start time.Time
+	// what Reno would have, for the TCP friendly region
+	wEst float64
+}
+
+// constants from RFC 8312
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+func NewCubic() CongestionControl {
+	return &Cubic{Reno: Reno{cwnd: initialWindow, ssthresh: initialSsthresh}}
+}
+
+func (c *Cubic) OnAck(acked int) {
+	if c.recovery {
+		c.cwnd = c.ssthresh
+		c.recovery = false
+		return
+	}
+	for i := 0; i < acked; i++ {
+		if c.cwnd < c.ssthresh {
+			c.cwnd++
+			continue
+		}
+		if c.start.IsZero() {
+			c.start = now()
+			if c.wMax < c.cwnd {
+				c.wMax = c.cwnd
+			}
+			c.wEst = c.cwnd
+		}
+		t := since(c.start).Seconds()
+		k := math.Cbrt(c.wMax * (1 - cubicBeta) / cubicC)
+		target := cubicC*math.Pow(t-k, 3) + c.wMax
+		c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) / c.cwnd
+		target = max(target, c.wEst)
+		if target > c.cwnd {
+			c.cwnd += (target - c.cwnd) / c.cwnd
+		} else {
+			// close to wMax it barely grows
+			c.cwnd += 0.01 / c.cwnd
+		}
+	}
+}
+
+func (c *Cubic) OnLoss() {
+	c.wMax = c.cwnd
+	c.ssthresh = max(c.cwnd*cubicBeta, 2)
+	c.cwnd = c.ssthresh + 3
+	c.recovery = true
+	c.start = time.Time{}
+}
+
+func (c *Cubic) OnTimeout() {
+	c.wMax = c.cwnd
+	c.ssthresh = max(c.cwnd*cubicBeta, 2)
+	c.cwnd = 1
+	c.recovery = false
+	c.start = time.Time{}
+}
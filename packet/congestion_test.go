@@ -0,0 +1,161 @@
+package packet
+
+import (
+	"handin2/clock"
+	"testing"
+	"time"
+)
+
+// ack acknowledges n segments, one ack each
+func ack(cc CongestionControl, n int) {
+	for i := 0; i < n; i++ {
+		cc.OnAck(1)
+	}
+}
+
+func expectWindow(t *testing.T, cc CongestionControl, want int, when string) {
+	t.Helper()
+	if got := cc.Window(); got != want {
+		t.Fatalf("%s: window is %d, expected %d", when, got, want)
+	}
+}
+
+func TestRenoGrowth(t *testing.T) {
+	cc := NewReno()
+	expectWindow(t, cc, initialWindow, "new")
+	// slow start, a segment more for every ack
+	ack(cc, 10)
+	expectWindow(t, cc, 12, "after 10 acks")
+	ack(cc, initialSsthresh-12)
+	expectWindow(t, cc, initialSsthresh, "at ssthresh")
+	// congestion avoidance, a segment more for a window's worth of acks
+	ack(cc, initialSsthresh/2)
+	expectWindow(t, cc, initialSsthresh, "half a round trip later")
+	ack(cc, initialSsthresh/2+1)
+	expectWindow(t, cc, initialSsthresh+1, "a round trip later")
+}
+
+func TestRenoLoss(t *testing.T) {
+	cc := NewReno()
+	ack(cc, 18)
+	expectWindow(t, cc, 20, "before the loss")
+	// half, plus the three segments the duplicate acks said left the network
+	cc.OnLoss()
+	expectWindow(t, cc, 13, "fast retransmit")
+	cc.OnDupAck()
+	cc.OnDupAck()
+	expectWindow(t, cc, 15, "fast recovery")
+	cc.OnAck(1)
+	expectWindow(t, cc, 10, "after recovery")
+	// and it's past ssthresh now, so it grows slowly
+	ack(cc, 5)
+	expectWindow(t, cc, 10, "congestion avoidance")
+	ack(cc, 6)
+	expectWindow(t, cc, 11, "a round trip later")
+
+	// duplicate acks outside of recovery don't do anything
+	cc.OnDupAck()
+	expectWindow(t, cc, 11, "duplicate ack")
+
+	// it doesn't go below 2
+	small := NewReno()
+	small.OnLoss()
+	if r := small.(*Reno); r.ssthresh != 2 {
+		t.Errorf("ssthresh after a loss at 2 segments is %v, expected 2", r.ssthresh)
+	}
+}
+
+func TestRenoTimeout(t *testing.T) {
+	cc := NewReno()
+	ack(cc, 18)
+	cc.OnLoss()
+	cc.OnTimeout()
+	// it's back to one segment, and slow start till half of what it had - 13, inflated for
+	// the recovery it was in
+	expectWindow(t, cc, 1, "after the timeout")
+	ack(cc, 5)
+	expectWindow(t, cc, 6, "slow start")
+	ack(cc, 1)
+	expectWindow(t, cc, 7, "past ssthresh")
+	ack(cc, 1)
+	expectWindow(t, cc, 7, "congestion avoidance")
+	// the recovery it was in is over too, an ack doesn't deflate it
+	if cc.(*Reno).recovery {
+		t.Error("still in recovery after a timeout")
+	}
+}
+
+func virtualClock(t *testing.T) *clock.Virtual {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	SetClock(clk)
+	t.Cleanup(func() { SetClock(nil) })
+	return clk
+}
+
+func TestCubicGrowth(t *testing.T) {
+	clk := virtualClock(t)
+	cc := NewCubic()
+	// slow start is Reno's
+	ack(cc, 18)
+	expectWindow(t, cc, 20, "slow start")
+
+	// a loss at 20 takes it to 14, RFC 8312's beta of 0.7
+	cc.OnLoss()
+	expectWindow(t, cc, 17, "fast retransmit")
+	cc.OnAck(1)
+	expectWindow(t, cc, 14, "after recovery")
+
+	// it gets back to 20 after K = cbrt(20 * 0.3 / 0.4) seconds, about 2.47, and stays
+	// close to 20 around then
+	ack(cc, 14)
+	clk.Advance(2 * time.Second)
+	ack(cc, 50)
+	if w := cc.Window(); w < 15 || w > 20 {
+		t.Fatalf("window is %d 2s after the loss, expected it to be on its way back to 20", w)
+	}
+	clk.Advance(time.Second)
+	ack(cc, 50)
+	if w := cc.Window(); w < 19 || w > 21 {
+		t.Fatalf("window is %d 3s after the loss, expected it to be close to 20", w)
+	}
+	// and a while after that it grows much faster than Reno's one segment per round trip
+	clk.Advance(3 * time.Second)
+	ack(cc, 50)
+	if w := cc.Window(); w < 30 {
+		t.Fatalf("window is %d 6s after the loss, expected it to be well past 20", w)
+	}
+}
+
+// with no time passing the cubic function stays below the window, it grows along the TCP
+// friendly estimate instead - 3*(1-0.7)/(1+0.7), about half a segment per round trip, so
+// after a loss it's never stuck where it was
+func TestCubicFriendly(t *testing.T) {
+	virtualClock(t)
+	cc := NewCubic()
+	ack(cc, 18)
+	cc.OnLoss()
+	cc.OnAck(1)
+	// round trips of 14 to 19 acks, 200 of them is about 12 of those
+	ack(cc, 200)
+	if w := cc.Window(); w < 18 || w > 20 {
+		t.Errorf("window is %d after 200 acks with no time passing, expected about 19", w)
+	}
+}
+
+func TestCubicTimeout(t *testing.T) {
+	virtualClock(t)
+	cc := NewCubic()
+	ack(cc, 18)
+	cc.OnTimeout()
+	expectWindow(t, cc, 1, "after the timeout")
+	if c := cc.(*Cubic); c.wMax != 20 || !c.start.IsZero() {
+		t.Errorf("wMax %v start %v after the timeout, expected 20 and the cubic function to start over", c.wMax, c.start)
+	}
+	// slow start up to 0.7 of what it had
+	ack(cc, 12)
+	expectWindow(t, cc, 13, "slow start")
+	ack(cc, 1)
+	expectWindow(t, cc, 14, "at ssthresh")
+	ack(cc, 1)
+	expectWindow(t, cc, 14, "congestion avoidance")
+}
@@ -0,0 +1,84 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Conn keeps packets apart on a stream connection like TCP, which is free to hand two
+// writes to one read (or one write to two reads) - a packet has no length field, so a DONE
+// and the START written right after it used to arrive as one packet with a bad checksum.
+// Every Write goes out with its length in front of it and every Read returns exactly what
+// one Write wrote, so it behaves like the datagrams the protocol is meant for. Both ends
+// (the endpoint and the forwarder) have to use it
+type Conn struct {
+	net.Conn
+
+	// bytes read from Conn that aren't a whole frame yet, they're kept if a read times out
+	// part way through one, so the next Read carries on where it left off
+	rm  sync.Mutex
+	buf []byte
+	// where what hasn't been returned yet starts in buf, it's moved to the front once the
+	// rest of buf is needed for reading
+	off     int
+	scratch []byte
+
+	wm sync.Mutex
+	// frames are put together in here, a Write at a time
+	frame []byte
+}
+
+// a frame is the length (u32) followed by that many bytes
+const frameHeader = 4
+
+func NewConn(c net.Conn) *Conn {
+	return &Conn{Conn: c}
+}
+
+// Read reads one frame into b, if b is too small for it the rest is thrown away
+func (c *Conn) Read(b []byte) (n int, err error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	for {
+		if rest := c.buf[c.off:]; len(rest) >= frameHeader {
+			size := binary.LittleEndian.Uint32(rest)
+			if size > MaxSize {
+				return 0, fmt.Errorf("packet: frame of %d bytes is larger than any packet, the stream is out of sync", size)
+			}
+			if end := frameHeader + int(size); len(rest) >= end {
+				n = copy(b, rest[frameHeader:end])
+				c.off += end
+				if c.off == len(c.buf) {
+					c.buf, c.off = c.buf[:0], 0
+				}
+				return n, nil
+			}
+		}
+		if c.off > 0 {
+			c.buf = c.buf[:copy(c.buf, c.buf[c.off:])]
+			c.off = 0
+		}
+		if c.scratch == nil {
+			c.scratch = make([]byte, MaxSize+frameHeader)
+		}
+		k, err := c.Conn.Read(c.scratch)
+		c.buf = append(c.buf, c.scratch[:k]...)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes b as one frame
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	c.frame = binary.LittleEndian.AppendUint32(c.frame[:0], uint32(len(b)))
+	c.frame = append(c.frame, b...)
+	if _, err = c.Conn.Write(c.frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,33 @@
+package packet
+
+import "time"
+
+// for the tests in package packet_test, that can't be in package packet because they use sim
+var (
+	CalculateChecksum = calculateChecksum
+	VerifyChecksum    = verifyChecksum
+)
+
+// ForgetVersions forgets every peer's version, for tests that are about what Send offers
+func ForgetVersions() {
+	versionsM.Lock()
+	versions = make(map[[2]byte]byte)
+	versionsM.Unlock()
+}
+
+// ForgetCloses forgets which peers have closed, so a test can close the same pair again
+func ForgetCloses() {
+	closesM.Lock()
+	closes = make(map[[2]byte]*closeState)
+	closesM.Unlock()
+}
+
+// Heard is when src last heard from peer, zero if it has no keepalive for it
+func Heard(src byte, peer byte) time.Time {
+	keepalivesM.Lock()
+	defer keepalivesM.Unlock()
+	if ka, ok := keepalives[[2]byte{src, peer}]; ok {
+		return ka.heard
+	}
+	return time.Time{}
+}
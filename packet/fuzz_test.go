@@ -0,0 +1,225 @@
+package packet_test
+
+import (
+	"bytes"
+	"handin2/clock"
+	"handin2/packet"
+	"handin2/sim"
+	"testing"
+	"time"
+)
+
+// go test ./packet -fuzz FuzzDecode (or FuzzEncodeDecode, FuzzRecv, FuzzSend), without -fuzz they only
+// run the seeds
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{'b', 'a', 0, 0, 0, 0, packet.START | 1, 0, 0})
+	f.Add(packet.Encode('b', 'a', 1, 2, packet.START, 512, nil))
+	f.Add(packet.Encode('b', 'a', 1, 2, packet.EMPTY, 0, []byte("data")))
+	f.Add(packet.Encode('b', 'a', 1, 2, packet.ACCEPT|packet.DONE, 8, []byte{1}))
+	f.Add(packet.Encode('b', 'a', 1, 2, packet.FAILURE, 0, []byte{0, 0, 1, 0}))
+	f.Add(withOptions(packet.Packet{Header: packet.Header{Dest: 'b', Src: 'a', Flag: packet.START}, Options: packet.AppendOption(nil, packet.OptVersion, 1)}))
+	f.Add(withOptions(packet.Packet{Header: packet.Header{Dest: 'b', Src: 'a'}, Options: packet.AppendOption(nil, 200), Data: []byte{1}}))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		var p packet.Packet
+		if p.UnmarshalBinary(raw) != nil {
+			return
+		}
+		// every byte is accounted for: header, size if there is one, options, data and checksum
+		header := 7
+		if raw[6]&0b00000001 == 0 {
+			header++
+		}
+		if p.HasSize() {
+			header += 2
+		}
+		if len(p.Options) > 0 {
+			header += 1 + len(p.Options)
+		}
+		if header+len(p.Data)+2 != len(raw) {
+			t.Fatalf("% x: %d byte header, %d bytes of data and a checksum, but %d bytes", raw, header, len(p.Data), len(raw))
+		}
+		// and encoding what came out gives the same packet back, give or take the padding
+		again, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("% x decoded as %v, which doesn't encode: %v", raw, p, err)
+		}
+		var p2 packet.Packet
+		if err := p2.UnmarshalBinary(again); err != nil || p2.Header != p.Header || !bytes.Equal(p2.Options, p.Options) || !bytes.Equal(p2.Data, p.Data) {
+			t.Fatalf("% x didn't survive being encoded again", raw)
+		}
+		// Decode says the same as UnmarshalBinary, without the options
+		_, valid, dest, src, seq, epoch, flag, size, data := packet.Decode(raw)
+		if !valid || (packet.Header{Dest: dest, Src: src, Seq: seq, Epoch: epoch, Flag: flag, Size: size}) != p.Header || !bytes.Equal(data, p.Data) {
+			t.Fatalf("% x: Decode doesn't agree with UnmarshalBinary", raw)
+		}
+	})
+}
+
+func withOptions(p packet.Packet) []byte {
+	raw, err := p.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func FuzzEncodeDecode(f *testing.F) {
+	f.Add(byte('b'), byte('a'), uint16(1), uint16(2), packet.START, uint16(512), []byte{})
+	f.Add(byte('b'), byte('a'), uint16(0xffff), uint16(0), byte(packet.EMPTY), uint16(0), []byte("data"))
+	f.Add(byte(0), byte(0xff), uint16(3), uint16(4), byte(packet.ACCEPT|packet.DONE), uint16(7), []byte{0, 1, 2})
+	f.Fuzz(func(t *testing.T, dest byte, src byte, seq uint16, epoch uint16, flag byte, size uint16, data []byte) {
+		// only the six flags, the rest of the byte is OPTIONS and padding - Encode makes
+		// packets without options, the property tests cover those through MarshalBinary
+		flag &= 0b11111100
+		raw := packet.Encode(dest, src, seq, epoch, flag, size, data)
+		if len(raw)%2 != 0 || len(raw) > packet.MaxSize {
+			t.Fatalf("%d bytes", len(raw))
+		}
+		corrupt, valid, destR, srcR, seqR, epochR, flagR, sizeR, dataR := packet.Decode(raw)
+		if flag&(packet.START|packet.ACCEPT|packet.DONE) == 0 {
+			size = 0
+		}
+		if corrupt || !valid || destR != dest || srcR != src || seqR != seq || epochR != epoch || flagR != flag || sizeR != size || !bytes.Equal(dataR, data) {
+			t.Fatalf("got %c %c %d %d %08b %d % x, corrupt %v valid %v", destR, srcR, seqR, epochR, flagR, sizeR, dataR, corrupt, valid)
+		}
+	})
+}
+
+// packets splits b up into packets: a length byte and that many bytes (at most 127), with a
+// checksum added unless the high bit of the length is set - so most of them get past the
+// checksum and into the interesting parts of Recv
+func packets(b []byte) (ps [][]byte) {
+	for len(b) > 0 {
+		n := int(b[0] & 0x7f)
+		raw := b[0]&0x80 > 0
+		b = b[1:]
+		n = min(n, len(b))
+		p := append([]byte{}, b[:n]...)
+		b = b[n:]
+		if !raw {
+			p = append(p, packet.CalculateChecksum(p)...)
+		}
+		ps = append(ps, p)
+	}
+	return
+}
+
+func seed(ps ...[]byte) []byte {
+	var b []byte
+	for _, p := range ps {
+		// the checksum is added again by packets
+		p = p[:len(p)-2]
+		b = append(b, byte(len(p)))
+		b = append(b, p...)
+	}
+	return b
+}
+
+func FuzzRecv(f *testing.F) {
+	f.Add(seed(packet.Encode('b', 'a', 2, 7, packet.START, 4, nil),
+		packet.Encode('b', 'a', 1, 7, packet.EMPTY, 0, []byte("1---")),
+		packet.Encode('b', 'a', 0, 7, packet.EMPTY, 0, []byte("0---"))))
+	f.Add(seed(packet.Encode('b', 'a', 3, 8, packet.START, 2, nil),
+		packet.Encode('b', 'a', 9, 8, packet.EMPTY, 0, []byte("xx")),
+		packet.Encode('b', 'a', 0, 9, packet.START, 2, nil)))
+	f.Add(seed(packet.Encode('b', 'a', 0, 0, packet.FIN, 0, nil)))
+	f.Add(seed(packet.Encode('b', 'a', 0, 0, packet.RESET, 0, nil)))
+	f.Add(seed(packet.Encode('b', 'a', 0, 0, packet.START|packet.DONE, 0, nil)))
+	f.Add([]byte{0x83, 'b', 'a', 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		clk := clock.NewVirtual(time.Unix(0, 0))
+		packet.SetClock(clk)
+		defer packet.SetClock(nil)
+		a, z := sim.Pipe(clk, "recv", "fuzz")
+		defer a.Close()
+		defer z.Close()
+		peer := packet.NewConn(z)
+		// all of it is there before Recv starts, so the clock is only moved once it's waiting
+		// for more
+		for _, p := range packets(b) {
+			peer.Write(p)
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := packet.Recv(packet.NewConn(a), 'b', 1)
+			done <- err
+		}()
+		start, wall := clk.Now(), time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if d := clock.Since(clk, start); d > time.Minute {
+				t.Fatalf("Recv is still going after %v", d)
+			}
+			if time.Since(wall) > 5*time.Second {
+				t.Fatal("Recv is stuck, and not on the clock")
+			}
+			if !clk.AdvanceToNext() {
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	})
+}
+
+// FuzzSend is FuzzRecv the other way around, the packets are the answers to a Send of 3
+// segments - the ones with a good checksum get the epoch of its START, so they're not all
+// just thrown away as left over from another round
+func FuzzSend(f *testing.F) {
+	accept := packet.Encode('a', 'b', 3, 0, packet.ACCEPT, 4, nil)
+	ack := func(seq uint16) []byte { return packet.Encode('a', 'b', seq, 0, packet.ACCEPT, 0, nil) }
+	f.Add(seed(accept, ack(1), ack(2), packet.Encode('a', 'b', 3, 0, packet.DONE, 4, nil)))
+	// an ack of everything without DONE, and duplicates of it
+	f.Add(seed(accept, ack(3), ack(3), ack(3), ack(3)))
+	f.Add(seed(accept, packet.Encode('a', 'b', 3, 0, packet.FAILURE, 0, []byte{2, 0}), ack(3), ack(3), ack(3)))
+	f.Add(seed(accept, packet.Encode('a', 'b', 9, 0, packet.FAILURE, 0, []byte{8, 0})))
+	f.Add(seed(packet.Encode('a', 'b', 0, 0, packet.FIN, 0, nil)))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		clk := clock.NewVirtual(time.Unix(0, 0))
+		packet.SetClock(clk)
+		defer packet.SetClock(nil)
+		a, z := sim.Pipe(clk, "send", "fuzz")
+		defer a.Close()
+		defer z.Close()
+		peer := packet.NewConn(z)
+		done := make(chan error, 1)
+		go func() {
+			done <- packet.Send(packet.NewConn(a), 'a', 'b', []byte("0123456789"), 4, 1)
+		}()
+		buf := make([]byte, packet.MaxSize)
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, _, _, epoch, _, _, _ := packet.Decode(buf[:n])
+		for _, p := range packets(b) {
+			if len(p) >= 8 && packet.VerifyChecksum(p) {
+				p = p[:len(p)-2]
+				p[4], p[5] = byte(epoch), byte(epoch>>8)
+				p = append(p, packet.CalculateChecksum(p)...)
+			}
+			peer.Write(p)
+		}
+		start, wall := clk.Now(), time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if d := clock.Since(clk, start); d > time.Minute {
+				t.Fatalf("Send is still going after %v", d)
+			}
+			if time.Since(wall) > 5*time.Second {
+				t.Fatal("Send is stuck, and not on the clock")
+			}
+			if !clk.AdvanceToNext() {
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	})
+}
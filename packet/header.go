@@ -0,0 +1,187 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Header is a packet without its data and checksum
+type Header struct {
+	Dest, Src  byte
+	Seq, Epoch uint16
+	Flag       byte
+	// only on the wire if Flag has START, ACCEPT or DONE, it's 0 otherwise
+	Size uint16
+}
+
+// Packet is a whole packet, what Encode takes and Decode gives back in one piece
+type Packet struct {
+	Header
+	// the options area without its length byte, see options.go - none means the OPTIONS
+	// bit isn't set
+	Options []byte
+	Data    []byte
+}
+
+func hasSize(flag byte) bool {
+	return flag&(START|ACCEPT|DONE) > 0
+}
+
+// the flags are tested on their own, e.g. IsFin is true for a RESET and a FIN-ACK as well -
+// compare Flag to see that it's only that one
+func (h Header) IsStart() bool   { return h.Flag&START > 0 }
+func (h Header) HasAck() bool    { return h.Flag&ACCEPT > 0 }
+func (h Header) IsIgnore() bool  { return h.Flag&IGNORE > 0 }
+func (h Header) IsFailure() bool { return h.Flag&FAILURE > 0 }
+func (h Header) IsDone() bool    { return h.Flag&DONE > 0 }
+func (h Header) IsFin() bool     { return h.Flag&FIN > 0 }
+func (h Header) IsReset() bool   { return h.Flag == RESET }
+
+// HasSize is whether the size field is on the wire, without it Size is always 0
+func (h Header) HasSize() bool { return hasSize(h.Flag) }
+
+// IsNak is a FAILURE with the seqs that are missing in it, instead of one that means start over
+func (p Packet) IsNak() bool { return p.Flag == FAILURE && len(p.Data) > 0 }
+
+// e.g. "a->b ACCEPT|DONE seq=3 epoch=1041 size=512"
+func (h Header) String() string {
+	return fmt.Sprintf("%c->%c %s seq=%d epoch=%d size=%d", h.Src, h.Dest, FmtFlags(h.Flag), h.Seq, h.Epoch, h.Size)
+}
+
+func (p Packet) String() string {
+	if len(p.Options) > 0 {
+		return fmt.Sprintf("%s options=%s data=%d", p.Header, FmtOptions(p.Options), len(p.Data))
+	}
+	return fmt.Sprintf("%s data=%d", p.Header, len(p.Data))
+}
+
+// DecodeError is why UnmarshalBinary couldn't decode a packet
+type DecodeError uint8
+
+const (
+	// not even the header could be read
+	ErrShort DecodeError = iota + 1
+	ErrTruncated
+	// the header is there, the packet is no good though
+	ErrOptions
+	ErrChecksum
+)
+
+func (e DecodeError) Error() string {
+	switch e {
+	case ErrShort:
+		return "Packet is shorter than the smallest packet there is"
+	case ErrTruncated:
+		return "Packet ends before its header does"
+	case ErrOptions:
+		return "Packet's options don't add up"
+	case ErrChecksum:
+		return "Packet doesn't match its checksum"
+	}
+	return fmt.Sprintf("DecodeError(%d)", uint8(e))
+}
+
+// Corrupt is true if the header couldn't be read either, with the other errors it's been
+// filled in as far as it goes - all of it for ErrChecksum
+func (e DecodeError) Corrupt() bool {
+	return e == ErrShort || e == ErrTruncated
+}
+
+// ErrTooLarge is returned by MarshalBinary for more data (or options) than a packet can hold
+var ErrTooLarge = errors.New("Too much data for one packet")
+
+// MarshalBinary is Encode, except it says so when the packet can't be encoded instead of
+// returning nothing
+func (p Packet) MarshalBinary() ([]byte, error) {
+	return p.AppendBinary(make([]byte, 0, 12+len(p.Data)))
+}
+
+// AppendBinary is MarshalBinary appending to dst, like AppendEncode
+func (p Packet) AppendBinary(dst []byte) ([]byte, error) {
+	if len(p.Data) > 0xffff || len(p.Options) > 0xff {
+		return dst, ErrTooLarge
+	}
+	if p.Flag&0b00000011 > 0 {
+		return dst, fmt.Errorf("Flag %08b has the options or the padding bit set, they're set when it's encoded", p.Flag)
+	}
+	if !validOptions(p.Options) {
+		return dst, ErrOptions
+	}
+	return appendPacket(dst, p.Header, p.Options, p.Data), nil
+}
+
+// UnmarshalBinary decodes raw into p, the error is a DecodeError. The data and options are
+// copied into p.Data and p.Options, reusing them if they're big enough, so a Packet that is
+// decoded into again and again doesn't allocate. Whatever could be read is filled in even if there's an error - the
+// forwarder passes packets with a bad checksum on, checking is up to the endpoints
+func (p *Packet) UnmarshalBinary(raw []byte) error {
+	h, opts, off, err := decodeHeader(raw)
+	p.Header = h
+	p.Options = append(p.Options[:0], opts...)
+	p.Data = p.Data[:0]
+	if err == 0 || err == ErrChecksum {
+		p.Data = append(p.Data, raw[off:len(raw)-2]...)
+	}
+	if err != 0 {
+		return err
+	}
+	return nil
+}
+
+// decodeHeader reads the header of raw, opts is the options area (without its length byte)
+// and off is where the data starts - with 0 or ErrChecksum the data and checksum are all there
+func decodeHeader(raw []byte) (h Header, opts []byte, off int, err DecodeError) {
+	// minimum packet length
+	if len(raw) < 9 {
+		if debugEnabled() {
+			logger.Debug("Decode: shorter than minimum packet", "len", len(raw))
+		}
+		return h, nil, 0, ErrShort
+	}
+	h.Dest = raw[0]
+	h.Src = raw[1]
+	h.Seq = btoi16(raw[2:4])
+	h.Epoch = btoi16(raw[4:6])
+	h.Flag = raw[6]
+	off = 7
+	if h.Flag&0b00000001 == 1 {
+		h.Flag &= 0b11111110
+	} else {
+		off += 1
+	}
+	hasOptions := h.Flag&OPTIONS > 0
+	h.Flag &^= OPTIONS
+	// the rest of the header and the checksum have to fit, or size would be read out of
+	// the checksum of a packet that was cut short
+	need := off + 2
+	if hasSize(h.Flag) {
+		need += 2
+	}
+	if hasOptions {
+		need += 1
+	}
+	if need > len(raw) {
+		if debugEnabled() {
+			logger.Debug("Decode: header runs past end of packet", "need", need, "len", len(raw))
+		}
+		return h, nil, 0, ErrTruncated
+	}
+	if hasSize(h.Flag) {
+		h.Size = btoi16(raw[off : off+2])
+		off += 2
+	}
+	if hasOptions {
+		n := int(raw[off])
+		off += 1
+		// an options bit with nothing after it is as wrong as options that run into the checksum
+		if n == 0 || off+n > len(raw)-2 || !validOptions(raw[off:off+n]) {
+			return h, nil, 0, ErrOptions
+		}
+		opts = raw[off : off+n]
+		off += n
+	}
+	if !verifyChecksum(raw) {
+		return h, opts, off, ErrChecksum
+	}
+	return h, opts, off, 0
+}
@@ -0,0 +1,140 @@
+package packet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// a keepalive probe is START and DONE together, which is never used otherwise - it's the
+// empty START of a ping, except it isn't handed to the caller of Recv. Whoever gets one
+// answers it with ACCEPT|DONE, like a ping, from Send as well as Recv
+const probe = START | DONE
+
+// DeadPeerError is returned by Recv when Peer has had keepalive turned on (see SetKeepalive)
+// and nothing has been heard from it for Silent, probes included
+type DeadPeerError struct {
+	Peer   byte
+	Silent time.Duration
+}
+
+func (e *DeadPeerError) Error() string {
+	return fmt.Sprintf("Nothing heard from <%c> for %s, assuming it's dead", e.Peer, e.Silent.Truncate(time.Millisecond))
+}
+
+type keepalive struct {
+	interval, timeout time.Duration
+	heard, probed     time.Time
+}
+
+// whichever was last, hearing from the peer or probing it
+func (ka *keepalive) lastActivity() time.Time {
+	if ka.probed.After(ka.heard) {
+		return ka.probed
+	}
+	return ka.heard
+}
+
+// {us, them} -> keepalive
+var (
+	keepalivesM sync.Mutex
+	keepalives  = make(map[[2]byte]*keepalive)
+)
+
+// SetKeepalive makes Recv (on src) probe peer once it has been quiet for interval, and return
+// a *DeadPeerError once it has been quiet for timeout - otherwise Recv with wait 0 waits forever
+// for a peer that crashed. Every packet from peer counts, not just answers to probes. An
+// interval of 0 turns it off again.
+//
+// Nothing reads the connection in the background, probes are only answered by a Send or
+// Recv running on peer's end - so peer has to keep a Recv pending whenever it's idle (like
+// the loop of a server), a peer that's in neither for timeout is reported dead even though
+// it's alive
+func SetKeepalive(src byte, peer byte, interval time.Duration, timeout time.Duration) {
+	keepalivesM.Lock()
+	defer keepalivesM.Unlock()
+	k := [2]byte{src, peer}
+	if interval <= 0 {
+		delete(keepalives, k)
+		return
+	}
+	if timeout < interval {
+		timeout = interval
+	}
+	keepalives[k] = &keepalive{interval: interval, timeout: timeout, heard: now()}
+}
+
+// heard is called for every valid packet from peer to src
+func heard(src byte, peer byte) {
+	keepalivesM.Lock()
+	if ka, ok := keepalives[[2]byte{src, peer}]; ok {
+		ka.heard = now()
+	}
+	keepalivesM.Unlock()
+}
+
+// nextKeepalive is when keepaliveDue needs to run next, zero if src has no keepalives
+func nextKeepalive(src byte) (next time.Time) {
+	keepalivesM.Lock()
+	defer keepalivesM.Unlock()
+	for k, ka := range keepalives {
+		if k[0] != src {
+			continue
+		}
+		// the next probe, unless it's dead before that
+		t := ka.lastActivity().Add(ka.interval)
+		if dead := ka.heard.Add(ka.timeout); dead.Before(t) {
+			t = dead
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return
+}
+
+// keepaliveDue probes the peers of src that have been quiet for long enough, and returns a
+// *DeadPeerError for one that has been quiet for too long - the clock starts over for it, so
+// if Recv is called again it gets another timeout before it's reported again
+func keepaliveDue(c net.Conn, src byte) error {
+	keepalivesM.Lock()
+	defer keepalivesM.Unlock()
+	current := now()
+	for k, ka := range keepalives {
+		if k[0] != src {
+			continue
+		}
+		silent := current.Sub(ka.heard)
+		if silent >= ka.timeout {
+			logger.Warn("peer is dead", "src", string(rune(src)), "peer", string(rune(k[1])), "silent", silent)
+			deadPeers.Inc()
+			ka.heard = current
+			ka.probed = time.Time{}
+			return &DeadPeerError{Peer: k[1], Silent: silent}
+		}
+		if current.Sub(ka.lastActivity()) >= ka.interval {
+			probe_packet := Encode(k[1], src, 0, nextEpoch(), probe, 0, []byte{})
+			if debugEnabled() {
+				logger.Debug("keepalive probe", Fields(probe_packet)...)
+			}
+			c.Write(probe_packet)
+			probesSent.Inc()
+			ka.probed = current
+		}
+	}
+	return nil
+}
+
+// answerProbe answers h if it's a probe for src, true means it was and can be thrown away
+func answerProbe(c net.Conn, src byte, h Header) bool {
+	if h.Dest != src || h.Flag != probe {
+		return false
+	}
+	answer := Encode(h.Src, src, h.Seq, h.Epoch, ACCEPT|DONE, 0, []byte{})
+	if debugEnabled() {
+		logger.Debug("keepalive probe answered", Fields(answer)...)
+	}
+	c.Write(answer)
+	return true
+}
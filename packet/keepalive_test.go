@@ -0,0 +1,103 @@
+package packet_test
+
+import (
+	"errors"
+	"handin2/packet"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveDeadPeer(t *testing.T) {
+	clk, c, p := setup(t)
+	packet.SetKeepalive('s', 't', time.Second, 3*time.Second)
+	t.Cleanup(func() { packet.SetKeepalive('s', 't', 0, 0) })
+	done := recv(c, 's', 0)
+
+	// a probe every second nobody answers, and after 3 of them it's dead
+	for i := 0; i < 2; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second)
+		probe := p.read()
+		if probe.flag != packet.START|packet.DONE || probe.dest != 't' || probe.src != 's' {
+			t.Fatalf("expected probe %d, got %+v", i, probe)
+		}
+	}
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	var dead *packet.DeadPeerError
+	if r := <-done; !errors.As(r.err, &dead) || dead.Peer != 't' || dead.Silent != 3*time.Second || r.from != 't' {
+		t.Fatalf("expected a DeadPeerError for t after 3s, got %v (from %c)", r.err, r.from)
+	}
+}
+
+func TestKeepaliveAnswered(t *testing.T) {
+	clk, c, p := setup(t)
+	packet.SetKeepalive('u', 'v', time.Second, 3*time.Second)
+	t.Cleanup(func() { packet.SetKeepalive('u', 'v', 0, 0) })
+	done := recv(c, 'u', 0)
+
+	// well past the timeout, but every probe is answered
+	for i := 0; i < 6; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second)
+		probe := p.read()
+		if probe.flag != packet.START|packet.DONE {
+			t.Fatalf("expected probe %d, got %+v", i, probe)
+		}
+		p.write(segment{'u', 'v', probe.seq, probe.epoch, packet.ACCEPT | packet.DONE, 0, nil})
+		// the answer has to be read before the clock moves on, or it counts for later
+		for !packet.Heard('u', 'v').Equal(clk.Now()) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// the answers aren't handed to the caller, the empty transfer after them is
+	epoch := newEpoch()
+	p.write(segment{'u', 'v', 0, epoch, packet.START, 0, nil})
+	if ack := p.read(); ack.flag != packet.ACCEPT|packet.DONE || ack.epoch != epoch {
+		t.Fatalf("expected ACCEPT|DONE for the empty transfer, got %+v", ack)
+	}
+	if r := <-done; r.err != nil || len(r.data) != 0 || r.from != 'v' {
+		t.Fatalf("got %q from %c, %v", r.data, r.from, r.err)
+	}
+}
+
+// a probe that comes in while Send is running is answered by Send
+func TestKeepaliveProbeAnswered(t *testing.T) {
+	_, c, p := setup(t)
+	done := send(c, 'w', 'x', []byte("hello"), 8, 3)
+
+	start := p.readFlag(packet.START)
+	p.write(segment{'w', 'x', 0, 1234, packet.START | packet.DONE, 0, nil})
+	if ans := p.read(); ans.flag != packet.ACCEPT|packet.DONE || ans.epoch != 1234 {
+		t.Fatalf("expected ACCEPT|DONE for the probe, got %+v", ans)
+	}
+	p.accept(start)
+	p.receive(start, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the peer is alive, but idle instead of in Recv - nothing answers the probes, so it's
+// reported dead. Once it calls Recv it answers the ones that are waiting
+func TestKeepaliveIdlePeer(t *testing.T) {
+	clk, c, p := setup(t)
+	packet.SetKeepalive('G', 'H', time.Second, 3*time.Second)
+	t.Cleanup(func() { packet.SetKeepalive('G', 'H', 0, 0) })
+	done := recv(c, 'G', 0)
+	for i := 0; i < 3; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second)
+	}
+	var dead *packet.DeadPeerError
+	if r := <-done; !errors.As(r.err, &dead) || dead.Peer != 'H' {
+		t.Fatalf("expected a DeadPeerError for H, got %v", r.err)
+	}
+
+	clk.Advance(500 * time.Millisecond)
+	recv(p.c, 'H', 0)
+	recv(c, 'G', 0)
+	for !packet.Heard('G', 'H').Equal(clk.Now()) {
+		time.Sleep(time.Millisecond)
+	}
+}
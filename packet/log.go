@@ -0,0 +1,123 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Logger is the subset of *slog.Logger that the package logs through,
+// meaning a *slog.Logger can be handed straight to SetLogger
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// by default the package is silent, library code shouldn't decide where output goes
+var logger Logger = nopLogger{}
+
+// SetLogger makes the package log through l, nil turns logging off again
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
+
+// debugEnabled lets us skip decoding packets just to throw the fields away,
+// only loggers that can tell us their level (like *slog.Logger) get the benefit
+func debugEnabled() bool {
+	if _, ok := logger.(nopLogger); ok {
+		return false
+	}
+	if l, ok := logger.(interface {
+		Enabled(context.Context, slog.Level) bool
+	}); ok {
+		return l.Enabled(context.Background(), slog.LevelDebug)
+	}
+	return true
+}
+
+// NewTextLogger is a convenience for the commands, level is one of
+// debug, info, warn, error or off - where off gives zero output
+func NewTextLogger(w io.Writer, level string) (*slog.Logger, error) {
+	if strings.EqualFold(level, "off") {
+		w = io.Discard
+		level = "error"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: l})), nil
+}
+
+var flagNames = []struct {
+	bit  byte
+	name string
+}{{START, "START"}, {ACCEPT, "ACCEPT"}, {IGNORE, "IGNORE"}, {FAILURE, "FAILURE"}, {DONE, "DONE"}, {FIN, "FIN"}}
+
+// FmtFlags gives a readable version of the flags in a packet, e.g. "ACCEPT|DONE"
+func FmtFlags(flag byte) string {
+	names := []string{}
+	for _, f := range flagNames {
+		if flag&f.bit > 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "EMPTY"
+	}
+	return strings.Join(names, "|")
+}
+
+// ParseFlags is the opposite of FmtFlags, names are case insensitive
+func ParseFlags(s string) (byte, error) {
+	var flag byte
+	for _, name := range strings.Split(s, "|") {
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, "EMPTY") {
+			continue
+		}
+		found := false
+		for _, f := range flagNames {
+			if strings.EqualFold(name, f.name) {
+				flag |= f.bit
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	return flag, nil
+}
+
+// Fields decodes raw and returns its header as key/value pairs for a Logger
+func Fields(raw []byte) []any {
+	corrupt, valid, dest, src, seq, epoch, flag, size, data := Decode(raw)
+	if corrupt {
+		return []any{"corrupt", true, "len", len(raw)}
+	}
+	return []any{
+		"src", string(rune(src)),
+		"dest", string(rune(dest)),
+		"seq", seq,
+		"epoch", epoch,
+		"flags", FmtFlags(flag),
+		"size", size,
+		"data", len(data),
+		"valid", valid,
+	}
+}
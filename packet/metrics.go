@@ -0,0 +1,50 @@
+package packet
+
+import "handin2/metrics"
+
+// everything is registered on metrics.Default, side is either "send" or "recv"
+var (
+	transfersStarted = metrics.Default.CounterVec("packet_transfers_started_total",
+		"Transfers started, for recv that is a START being accepted.", "side")
+	transfersCompleted = metrics.Default.CounterVec("packet_transfers_completed_total",
+		"Transfers that ended with DONE.", "side")
+	transfersFailed = metrics.Default.CounterVec("packet_transfers_failed_total",
+		"Transfers that gave up (send) or had to send FAILURE (recv).", "side")
+	restarts = metrics.Default.Counter("packet_restarts_total",
+		"Times Send went back to sending START after its first attempt.")
+	bytesSent = metrics.Default.Counter("packet_bytes_sent_total",
+		"Data bytes written by Send, retransmissions included.")
+	bytesRetransmitted = metrics.Default.Counter("packet_bytes_retransmitted_total",
+		"Data bytes written by Send in any attempt but the first.")
+	bytesDelivered = metrics.Default.Counter("packet_bytes_delivered_total",
+		"Data bytes of transfers that Send saw DONE for, i.e. goodput.")
+	bytesReceived = metrics.Default.Counter("packet_bytes_received_total",
+		"Data bytes handed back by Recv.")
+	discarded = metrics.Default.CounterVec("packet_discarded_total",
+		"Packets thrown away because they were duplicates, left over from an earlier exchange or corrupt.", "reason")
+	retransmitTimeouts = metrics.Default.Counter("packet_retransmit_timeouts_total",
+		"Times Send heard nothing for a whole retransmission timeout and went back to the first unacknowledged segment.")
+	fastRetransmits = metrics.Default.Counter("packet_fast_retransmits_total",
+		"Segments Send sent again after three duplicate acks.")
+	nakRetransmits = metrics.Default.Counter("packet_nak_retransmits_total",
+		"Segments Send sent again because the receiver listed them in a NAK.")
+	naksSent = metrics.Default.Counter("packet_naks_sent_total",
+		"NAKs (FAILURE listing missing segments) Recv sent.")
+	probesSent = metrics.Default.Counter("packet_keepalive_probes_total",
+		"Keepalive probes Recv sent to peers that had been quiet.")
+	deadPeers = metrics.Default.Counter("packet_dead_peers_total",
+		"Times Recv gave up on a peer that didn't answer its keepalive probes.")
+	tooBigs = metrics.Default.Counter("packet_too_big_total",
+		"FAILUREs from a forwarder saying segments Send sent were bigger than the path MTU.")
+	cwnd = metrics.Default.Gauge("packet_cwnd_segments",
+		"Congestion window of the last transfer Send worked on.")
+	rtt = metrics.Default.Histogram("packet_rtt_seconds",
+		"Round trips Send measured, START to its ACCEPT - and with timestamps every ack that acknowledged something new.",
+		metrics.Buckets(0.001, 2, 14))
+)
+
+// Metrics is a snapshot of metrics.Default, which has the package's counters
+// along with anything else the program registered there
+func Metrics() metrics.Snapshot {
+	return metrics.Default.Snapshot()
+}
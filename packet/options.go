@@ -0,0 +1,202 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// options go after size when the OPTIONS bit is set, a length byte and then one option after
+// the other: a kind, the length of its value and the value
+//
+//	| len | kind | len | value ... | kind | len | value ... |
+//
+// a START offers what the sender can do, and the ACCEPT answers with what the receiver can do
+// of that - kinds it doesn't know are skipped and not answered, so the sender knows they're
+// not supported. Once timestamps are agreed on, data, acks, NAKs and DONE carry them as well,
+// and a forwarder says how big packets can be with one (see pmtu.go).
+//
+// Before options there was a spare bit in their place that made a packet invalid, so a peer
+// that's older than options (version 0) drops a START that has them. Send remembers whether
+// the peer answered options the last time, and starting over it alternates between a START
+// with and one without them (see offerOptions)
+
+// Version is the version of the protocol spoken here, 0 is the one without options
+const Version = 1
+
+// option kinds
+const (
+	// the highest version the sender speaks in START, the one both do in ACCEPT (1 byte)
+	OptVersion byte = 1
+	// when the packet was sent and the one from the other side it answers, both in
+	// milliseconds of the sender's clock (TSval and TSecr, 4 bytes each), see Timestamps
+	OptTimestamps byte = 2
+	// the largest packet a link takes, in a FAILURE from a forwarder that had to drop one
+	// that was bigger (2 bytes), see TooBig
+	OptMTU byte = 3
+)
+
+var optionNames = map[byte]string{OptVersion: "version", OptTimestamps: "timestamps", OptMTU: "mtu"}
+
+// AppendOption adds an option to opts, the value can be at most 255 bytes
+func AppendOption(opts []byte, kind byte, value ...byte) []byte {
+	opts = append(opts, kind, byte(len(value)))
+	return append(opts, value...)
+}
+
+// Option is the value of the first option of kind in p
+func (p Packet) Option(kind byte) (value []byte, ok bool) {
+	for o := p.Options; len(o) >= 2 && 2+int(o[1]) <= len(o); o = o[2+int(o[1]):] {
+		if o[0] == kind {
+			return o[2 : 2+int(o[1])], true
+		}
+	}
+	return nil, false
+}
+
+// validOptions is whether every option in opts fits, unknown kinds are fine
+func validOptions(opts []byte) bool {
+	for len(opts) > 0 {
+		if len(opts) < 2 || 2+int(opts[1]) > len(opts) {
+			return false
+		}
+		opts = opts[2+int(opts[1]):]
+	}
+	return true
+}
+
+// FmtOptions gives a readable version of opts, e.g. "version=1,kind7=0a0b"
+func FmtOptions(opts []byte) string {
+	names := []string{}
+	for o := opts; len(o) >= 2 && 2+int(o[1]) <= len(o); o = o[2+int(o[1]):] {
+		name, ok := optionNames[o[0]]
+		if !ok {
+			name = fmt.Sprintf("kind%d", o[0])
+		}
+		value := o[2 : 2+int(o[1])]
+		if o[0] == OptTimestamps && len(value) == 8 {
+			names = append(names, fmt.Sprintf("%s=%d/%d", name, binary.LittleEndian.Uint32(value), binary.LittleEndian.Uint32(value[4:])))
+		} else if o[0] == OptMTU && len(value) == 2 {
+			names = append(names, fmt.Sprintf("%s=%d", name, binary.LittleEndian.Uint16(value)))
+		} else if len(value) == 1 {
+			names = append(names, fmt.Sprintf("%s=%d", name, value[0]))
+		} else {
+			names = append(names, fmt.Sprintf("%s=%x", name, value))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Timestamps are TSval and TSecr of p, the time it was sent and the TSval of the packet it
+// answers - false if it doesn't have them
+func (p Packet) Timestamps() (val uint32, ecr uint32, ok bool) {
+	v, ok := p.Option(OptTimestamps)
+	if !ok || len(v) != 8 {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(v), binary.LittleEndian.Uint32(v[4:]), true
+}
+
+// AppendTimestamps adds a timestamps option to opts
+func AppendTimestamps(opts []byte, val uint32, ecr uint32) []byte {
+	opts = append(opts, OptTimestamps, 8)
+	opts = binary.LittleEndian.AppendUint32(opts, val)
+	return binary.LittleEndian.AppendUint32(opts, ecr)
+}
+
+// whether a START from us offers timestamps, and a START with them gets them answered
+var timestamps atomic.Bool
+
+func init() {
+	timestamps.Store(true)
+}
+
+// SetTimestamps turns the timestamps option on or off (it's on by default), from the next
+// transfer - without it RTT is only measured on START, and only epochs tell rounds apart
+func SetTimestamps(on bool) {
+	timestamps.Store(on)
+}
+
+// tsNow is TSval for a packet sent now, it wraps around after about 49 days
+func tsNow() uint32 {
+	return uint32(now().UnixMilli())
+}
+
+// tsBefore is whether timestamp a is from before b, allowing for wrap around
+func tsBefore(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// offer is the options a START from us has, val is its TSval
+func offer(val uint32) []byte {
+	opts := AppendOption(nil, OptVersion, Version)
+	if timestamps.Load() {
+		opts = AppendTimestamps(opts, val, 0)
+	}
+	return opts
+}
+
+// answer is the options of the ACCEPT for a START with opts, the version the two of us speak
+// and whether the transfer has timestamps - nil if the START didn't have any options, the
+// sender might not understand them
+func answer(opts []byte) (ans []byte, version byte, stamped bool) {
+	if len(opts) == 0 {
+		return nil, 0, false
+	}
+	p := Packet{Options: opts}
+	// a peer that sends options at all speaks 1 at least
+	version = 1
+	if v, ok := p.Option(OptVersion); ok && len(v) == 1 {
+		version = min(v[0], Version)
+	}
+	ans = AppendOption(ans, OptVersion, version)
+	if val, _, ok := p.Timestamps(); ok && timestamps.Load() {
+		ans = AppendTimestamps(ans, tsNow(), val)
+		stamped = true
+	}
+	return ans, version, stamped
+}
+
+// accepted is the version an ACCEPT with opts says the two of us speak
+func accepted(opts []byte) (version byte) {
+	if len(opts) == 0 {
+		return 0
+	}
+	p := Packet{Options: opts}
+	if v, ok := p.Option(OptVersion); ok && len(v) == 1 {
+		return min(v[0], Version)
+	}
+	return 1
+}
+
+// {us, them} -> the version we agreed on the last time
+var (
+	versionsM sync.Mutex
+	versions  = make(map[[2]byte]byte)
+)
+
+// PeerVersion is the version src and peer agreed on the last time one of them started a
+// transfer to the other, false if they haven't yet
+func PeerVersion(src byte, peer byte) (version byte, ok bool) {
+	versionsM.Lock()
+	defer versionsM.Unlock()
+	version, ok = versions[[2]byte{src, peer}]
+	return
+}
+
+func setPeerVersion(src byte, peer byte, version byte) {
+	versionsM.Lock()
+	versions[[2]byte{src, peer}] = version
+	versionsM.Unlock()
+}
+
+// offerOptions is whether Send's START number attempt (from 1) to peer has options - the
+// odd ones are sent the way that's most likely to work, the even ones the other way, in case
+// the peer has been swapped for an older or newer one since
+func offerOptions(src byte, peer byte, attempt uint16) bool {
+	v, ok := PeerVersion(src, peer)
+	prefer := !ok || v > 0
+	return (attempt%2 == 1) == prefer
+}
@@ -2,19 +2,28 @@ package packet
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var verbose bool = false
-
 // "packet" from pseudo-client/server
-// | dest | src  | seq    | flags | padding | * size | data     | checksum |
-// | 0x00 | 0x00 | 0x0000 | 00000 | 00...1  | 0x0000 | 0x...    | 0x0000   |
-// | i8   | i8   | i16    | SAIFD | 3/11 b  | i16    | max size | i16      |
+// | dest | src  | seq    | epoch  | flags   | padding | * size | ** options | data     | checksum |
+// | 0x00 | 0x00 | 0x0000 | 0x0000 | 0000000 | 0...1   | 0x0000 | 0x00 0x... | 0x...    | 0x0000   |
+// | i8   | i8   | i16    | i16    | SAIFDEO | 1/9 b   | i16    | i8 + len   | max size | i16      |
+//
+// epoch = which round of a transfer the packet belongs to, the sender picks a new one
+//	every time it sends START (so also when it starts over), and every other packet of
+//	that round - ACCEPT, data, FAILURE and DONE - carries the same one. That way packets
+//	left over from an earlier round, or another transfer between the same two, can be
+//	told apart from the ones that matter and thrown away
 //
 // size = amount of bits in datasection, this only exists if S is 1
 //	it allows the server to expect the amount of data coming in
@@ -23,6 +32,9 @@ var verbose bool = false
 // padding = upto 15 bits, parser needs to not read size/data
 //	till first 1 is spotted after flags - this ensures the checksum is valid
 //
+// options = only there if O is 1, a length byte and that many bytes of options - each of
+//	them a kind, a length and that many bytes of value (TLV, like TCP options). See options.go
+//
 // ___ * = explanation of what it means if flag is 1 ___
 // S = start of transmission
 //	sequence will hold the total amount of incoming packets
@@ -32,15 +44,27 @@ var verbose bool = false
 //
 // A = accepted start of transmission
 //	sequence & size should hold same value as when S flag was received
+//	with size 0 it acknowledges data instead, sequence is then how many of the
+//	segments the receiver has in a row from the first one (a cumulative ack)
 //
 // I = ignoring you, i can't talk to you right now
 //	response to S flag packets if server/client exists/online but not seeking that data
 //
 // F = failed to receive all of the data
 //	e.g. some sequence is missing
-//	implicit prompt for restarting transmission from S flag
+//	without data it's an implicit prompt for restarting transmission from S flag,
+//	with data it's a NAK - the data is the seqs that are missing (i16 each), only
+//	those are sent again, and seq is a cumulative ack like for A with size 0
 //
 // D = done, i received all sequences :D
+//
+// E = end, i won't send you anything more (FIN)
+//	answered with E and A (FIN-ACK) with the same seq & epoch, see close.go
+//	with F it's RESET instead, the forwarder sends that for an endpoint that disconnected
+//
+// O = there are options after size, it used to be a spare bit that made a packet invalid -
+//	so it's only sent to peers that are known to understand it (see options.go). It's
+//	not part of Header.Flag, Packet.Options being there is what says it's set
 
 const (
 	START   byte = 0b10000000
@@ -48,9 +72,158 @@ const (
 	IGNORE       = 0b00100000
 	FAILURE      = 0b00010000
 	DONE         = 0b00001000
+	FIN          = 0b00000100
+	OPTIONS      = 0b00000010
 	EMPTY        = 0b00000000
+
+	RESET = FIN | FAILURE
+)
+
+// MaxSize is the largest a packet can be, a full data section plus header (with size and
+// options) and checksum - 7 + 2 + 256 + 65535 + 2, which is even already so there's no padding byte
+const MaxSize = 65802
+
+// buffers to read packets into, every Send and Recv needs one - Recv used to make a new
+// one for every data packet, at MaxSize each that kept the GC busier than the transfer
+var buffers = sync.Pool{New: func() any {
+	b := make([]byte, MaxSize)
+	return &b
+}}
+
+func getBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	buffers.Put(b)
+}
+
+// epochs handed out by Send, they only ever count up (and wrap around), starting
+// somewhere random so a restarted program doesn't reuse the ones from before
+var epochs atomic.Uint32
+
+func init() {
+	epochs.Store(rand.Uint32())
+}
+
+func nextEpoch() uint16 {
+	return uint16(epochs.Add(1))
+}
+
+// the last round Recv finished with each peer, {us, them} -> the answer that ended it (DONE,
+// ACCEPT|DONE, or the FIN-ACK for a FIN), so a sender whose DONE got lost can be sent it again.
+// seen has the epochs of the last seenEpochs rounds (and FINs) Recv took on from each peer, a
+// duplicated START that shows up after its round doesn't get its data delivered a second
+// time. Only epochs that were actually seen count - a peer that restarted picks a new random
+// starting point, which can be anywhere, just below the epochs it had before included
+const seenEpochs = 16
+
+var (
+	finishedM sync.Mutex
+	finished  = make(map[[2]byte]Header)
+	seen      = make(map[[2]byte][]uint16)
 )
 
+func finish(src byte, peer byte, last Header) {
+	finishedM.Lock()
+	finished[[2]byte{src, peer}] = last
+	finishedM.Unlock()
+}
+
+// see records a round Recv took on
+func see(src byte, peer byte, epoch uint16) {
+	finishedM.Lock()
+	k := [2]byte{src, peer}
+	seen[k] = append(seen[k], epoch)
+	if len(seen[k]) > seenEpochs {
+		seen[k] = seen[k][1:]
+	}
+	finishedM.Unlock()
+}
+
+// seenEpoch is whether Recv took on a round with epoch from peer already
+func seenEpoch(src byte, peer byte, epoch uint16) bool {
+	finishedM.Lock()
+	defer finishedM.Unlock()
+	return slices.Contains(seen[[2]byte{src, peer}], epoch)
+}
+
+// doneFor is the DONE Recv ended the round with epoch with, if that's the last one it finished
+// with peer - the sender keeps sending till it has it
+func doneFor(src byte, peer byte, epoch uint16) (Header, bool) {
+	finishedM.Lock()
+	last, ok := finished[[2]byte{src, peer}]
+	finishedM.Unlock()
+	return last, ok && last.Epoch == epoch && last.IsDone()
+}
+
+// a START for src that showed up while it was busy with something else - in Send, waiting
+// for the DONE that the peer sent before it (the two got reordered), or in Recv from another
+// peer. The next Recv picks it up instead of the sender having to time out and send it again.
+// Only the latest from each peer is kept, and only for as long as its sender waits for ACCEPT
+type heldStart struct {
+	b  []byte
+	at time.Time
+}
+
+var (
+	heldM sync.Mutex
+	held  = make(map[[2]byte]heldStart)
+)
+
+// hold keeps p (a START for src) for the next Recv
+func hold(src byte, p Header, b []byte) {
+	if debugEnabled() {
+		logger.Debug("START while busy, holding on to it", Fields(b)...)
+	}
+	heldM.Lock()
+	held[[2]byte{src, p.Src}] = heldStart{bytes.Clone(b), now()}
+	heldM.Unlock()
+}
+
+// readStart is c.Read for Recv, a START that was held for src comes first
+func readStart(c net.Conn, src byte, b []byte) (int, error) {
+	heldM.Lock()
+	for k, h := range held {
+		if k[0] != src {
+			continue
+		}
+		delete(held, k)
+		if since(h.at) < 2*time.Second {
+			heldM.Unlock()
+			return copy(b, h.b), nil
+		}
+	}
+	heldM.Unlock()
+	return c.Read(b)
+}
+
+// a NAK lists at most this many seqs, the rest are asked for in the next one
+const maxNak = 512
+
+// a missing seq isn't asked for again in a NAK before this long has passed, unless the
+// packet for it showed up with a bad checksum - it's also how long Recv waits for data
+// before asking for everything it's missing
+const nakInterval = time.Second
+
+func encodeNak(seqs []uint16) []byte {
+	data := make([]byte, 0, 2*len(seqs))
+	for _, seq := range seqs {
+		data = binary.LittleEndian.AppendUint16(data, seq)
+	}
+	return data
+}
+
+func decodeNak(data []byte) (seqs []uint16, ok bool) {
+	if len(data)%2 != 0 || len(data) > 2*maxNak {
+		return nil, false
+	}
+	for i := 0; i < len(data); i += 2 {
+		seqs = append(seqs, btoi16(data[i:i+2]))
+	}
+	return seqs, true
+}
+
 // https://gist.github.com/chiro-hiro/2674626cebbcb5a676355b7aaac4972d
 func i16tob(val uint16) []byte {
 	r := make([]byte, 2)
@@ -61,11 +234,7 @@ func i16tob(val uint16) []byte {
 }
 
 func btoi16(val []byte) uint16 {
-	r := uint16(0)
-	for i := uint16(0); i < 2; i++ {
-		r |= uint16(val[i]) << (8 * i)
-	}
-	return r
+	return uint16(val[0]) | uint16(val[1])<<8
 }
 
 // ------------------------
@@ -82,244 +251,524 @@ func FmtBits(data []byte) []byte {
 	return buf.Bytes()
 }
 
-func calculateChecksum(data []byte) []byte {
-	var checksum uint16 = 0
-	for i := 0; i <= (len(data) - 2); i += 2 {
-		checksum += btoi16(data[i : i+2])
+// sum16 adds up data as little endian i16s, an odd byte at the end is left out
+func sum16(data []byte) (sum uint16) {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint16(data[i]) | uint16(data[i+1])<<8
 	}
-	checksum ^= 0xffff
-	return i16tob(checksum)
+	return
+}
+
+func calculateChecksum(data []byte) []byte {
+	return i16tob(sum16(data) ^ 0xffff)
 }
 
 func verifyChecksum(data []byte) bool {
-	var checksum uint16 = 0
-	for i := 0; i <= (len(data) - 2); i += 2 {
-		checksum += btoi16(data[i : i+2])
-	}
-	if checksum == math.MaxUint16 {
-		return true
-	} else {
-		return false
+	return sum16(data) == math.MaxUint16
+}
+
+// Encode is a packet as bytes, with a padding bit and a checksum. A packet can't hold more
+// than 65535 bytes of data, with more than that Encode returns an empty slice - Packet's
+// MarshalBinary returns ErrTooLarge instead
+func Encode(dest byte, src byte, seq uint16, epoch uint16, flag byte, size uint16, data []byte) (buffer []byte) {
+	// too much data transmitted at once
+	if len(data) > 0xffff {
+		return []byte{}
 	}
+	return AppendEncode(make([]byte, 0, 12+len(data)), dest, src, seq, epoch, flag, size, data)
 }
 
-func Encode(dest byte, src byte, seq uint16, flag byte, size uint16, data []byte) (buffer []byte) {
-	buffer = make([]byte, 0)
+// AppendEncode is Encode, except the packet is appended to dst - with a dst that's big enough
+// it doesn't allocate, so a buffer can be used for one packet after the other. With more
+// data than a packet can hold dst is returned as it is
+func AppendEncode(dst []byte, dest byte, src byte, seq uint16, epoch uint16, flag byte, size uint16, data []byte) []byte {
+	return appendPacket(dst, Header{dest, src, seq, epoch, flag, size}, nil, data)
+}
+
+// appendPacket is AppendEncode with options, opts is what goes after the length byte. The
+// OPTIONS bit in h.Flag is ignored, it's set if there are any options
+func appendPacket(dst []byte, h Header, opts []byte, data []byte) []byte {
+	if len(data) > 0xffff || len(opts) > 0xff {
+		return dst
+	}
+	start := len(dst)
+	flag := h.Flag &^ OPTIONS
+	if len(opts) > 0 {
+		flag |= OPTIONS
+	}
 
 	// ---------- ensuring that final buffer is 2byte padded (technically everything but bytes and slices of bytes can be ignored)
-	// byte, src, seq, checksum
-	length := 1 + 1 + 2 + 2
-	if (flag & (START | ACCEPT | DONE)) > 0 {
+	// byte, src, seq, epoch, checksum
+	length := 1 + 1 + 2 + 2 + 2
+	if hasSize(flag) {
 		// size
 		length += 2
 	}
-	length += len(data)
-	// too much data transmitted at once
-	if len(data) > 0xffff {
-		return
+	if len(opts) > 0 {
+		length += 1 + len(opts)
 	}
-	flags_and_padding := []byte{flag}
+	length += len(data)
+
+	dst = append(dst, h.Dest, h.Src)
+	dst = binary.LittleEndian.AppendUint16(dst, h.Seq)
+	dst = binary.LittleEndian.AppendUint16(dst, h.Epoch)
 	if length%2 == 0 {
-		flags_and_padding = append(flags_and_padding, 0b00000000)
+		dst = append(dst, flag, 0b00000001)
+	} else {
+		dst = append(dst, flag|0b00000001)
 	}
-	flags_and_padding[len(flags_and_padding)-1] |= 0b00000001
-
-	buffer = append(buffer, dest, src)
-	seq_bytes := i16tob(seq)
-	buffer = append(buffer, seq_bytes...)
-	buffer = append(buffer, flags_and_padding...)
-	if (flag & (START | ACCEPT | DONE)) > 0 {
-		size_bytes := i16tob(size)
-		buffer = append(buffer, size_bytes...)
+	if hasSize(flag) {
+		dst = binary.LittleEndian.AppendUint16(dst, h.Size)
 	}
-	buffer = append(buffer, data...)
+	if len(opts) > 0 {
+		dst = append(dst, byte(len(opts)))
+		dst = append(dst, opts...)
+	}
+	dst = append(dst, data...)
 
-	buffer = append(buffer, calculateChecksum(buffer)...)
-	return
+	return binary.LittleEndian.AppendUint16(dst, sum16(dst[start:])^0xffff)
 }
 
-func Decode(raw []byte) (corrupt bool, valid bool, dest byte, src byte, seq uint16, flag byte, size uint16, data []byte) {
-	valid = verifyChecksum(raw)
-	// minimum packet length
-	if len(raw) < 7 {
-		if verbose {
-			fmt.Println("D1-", len(raw))
+// Decode is the packet in raw with every field on its own, corrupt if not even its header could be
+// read, !valid if it could but the packet is no good (checksum, options) - data is a slice of raw
+// and the options are skipped. Packet.UnmarshalBinary says why instead of just that something is wrong
+func Decode(raw []byte) (corrupt bool, valid bool, dest byte, src byte, seq uint16, epoch uint16, flag byte, size uint16, data []byte) {
+	h, _, off, err := decodeHeader(raw)
+	if err == 0 || err == ErrChecksum {
+		// it's all there, just not right
+		data = raw[off : len(raw)-2]
+		if len(data) == 0 {
+			data = nil
 		}
-		corrupt = true
-		return
-	}
-	dest = raw[0]
-	src = raw[1]
-	seq = btoi16(raw[2:4])
-	flag = raw[4]
-	offset := 5
-	if flag&0b00000001 == 1 {
-		flag &= 0b11111110
-	} else {
-		offset += 1
 	}
-	// these flags have no meaning, it should never be true
-	if flag&0b00000110 > 0 {
-		valid = false
-		return
-	}
-	if offset+2 > len(raw) {
-		if verbose {
-			fmt.Println("D2-", offset+2, len(raw))
-		}
-		corrupt = true
-		return
-	}
-	if (flag & (START | ACCEPT | DONE)) > 0 {
-		size = btoi16(raw[offset : offset+2])
-		offset += 2
-	}
-	if offset < len(raw)-2 {
-		data = raw[offset : len(raw)-2]
-	}
-	return
+	return err.Corrupt(), err == 0, h.Dest, h.Src, h.Seq, h.Epoch, h.Flag, h.Size, data
 }
 
 // Send is a wrapper of net.Conn.Read/write - making sure that data is verified by receiver
 // it can be thought of as a localized state machine (modelling simplified TCP) for a specific data transfer.
-// window is how many bytes (of data) it is allowed to send per 'packet'
+// window is how many bytes (of data) it is allowed to send per 'packet', with 0 Send finds the
+// largest that gets through to dest itself (see pmtu.go)
 // tolerance is how many times it will allow restarting communication process before it fails
+// how many packets are sent before waiting for acks is up to the CongestionControl, and c has
+// to be a Conn (or something else that keeps packets apart), or they'll run together
 func Send(c net.Conn, src byte, dest byte, data []byte, window uint16, tolerance uint16) (e error) {
-	// 65543 is max size of our 'packet'
-	buffer := make([]byte, 65543)
+	bp := getBuffer()
+	defer putBuffer(bp)
+	buffer := *bp
+	// data packets are encoded into this one after the other, Write doesn't hold on to it
+	var out []byte
+	// and responses are decoded into this one
+	var p Packet
 	var attempts uint16 = 0
+	auto := window == 0 && len(data) > 0
 
 	// if its not possible to transmit all of the data
-	if (int(window) * int(math.MaxUint16)) < len(data) {
-		e = errors.New("Window needs to be larger to allow transmit of data")
+	if !auto && (int(window)*int(math.MaxUint16)) < len(data) {
+		e = errors.New("Window needs to be larger to allow transmit of data, or use SendStream")
 		return
 	}
 
 	var seqs uint16 = 0
-	if window != 0 {
-		seqs = uint16(len(data) / int(window))
-		if len(data)%int(window) != 0 {
-			seqs++
+	segments := func() {
+		seqs = 0
+		if window != 0 {
+			seqs = uint16(len(data) / int(window))
+			if len(data)%int(window) != 0 {
+				seqs++
+			}
 		}
 	}
+	segments()
 
-	query := Encode(dest, src, seqs, START, window, []byte{})
-	if verbose {
-		fmt.Printf("Send(1): <%s>\n", FmtBits(query))
+	if writeClosed(src, dest) {
+		e = ErrClosed
+		return
 	}
+
+	transfersStarted.With("send").Inc()
+	defer func() {
+		if e != nil {
+			transfersFailed.With("send").Inc()
+		} else {
+			transfersCompleted.With("send").Inc()
+			bytesDelivered.Add(len(data))
+		}
+	}()
+
+	var epoch uint16
+	var started time.Time
+	// TSval of the START
+	var startTs uint32
 await_confirm:
 	if attempts > tolerance {
 		e = errors.New("Attempts exceeded set tolerance")
 		return
 	}
+	if attempts > 0 {
+		restarts.Inc()
+	}
 	attempts++
+	if auto {
+		mtu, _ := PathMTU(src, dest)
+		window = segmentSize(mtu)
+		if window == 0 {
+			e = &TooBigError{Peer: dest, MTU: mtu}
+			return
+		}
+		if (int(window) * int(math.MaxUint16)) < len(data) {
+			e = errors.New("Path MTU is too small to transmit all of the data, use SendStream")
+			return
+		}
+		segments()
+	}
 
+	// a new round, whatever is still out there from the last one gets thrown away
+	epoch = nextEpoch()
+	start := Packet{Header: Header{dest, src, seqs, epoch, START, window}}
+	startTs = tsNow()
+	offered := offerOptions(src, dest, attempts)
+	if offered {
+		start.Options = offer(startTs)
+	}
+	query, _ := start.MarshalBinary()
+	if debugEnabled() {
+		logger.Debug("Send(1): START", Fields(query)...)
+	}
+	started = now()
 	c.Write(query)
-	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// packets that aren't a response to this START don't restart anything, they're
+	// just thrown away - but only till the deadline for a response is up
+	deadline := now().Add(2 * time.Second)
+await_accept:
+	c.SetReadDeadline(deadline)
 	n, err := c.Read(buffer)
 	// remove the deadline
 	c.SetReadDeadline(time.Time{})
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			fmt.Println("Timed out waiting for initial response")
+			logger.Warn("timed out waiting for initial response", "src", string(rune(src)), "dest", string(rune(dest)), "attempt", attempts)
 			goto await_confirm
 		}
 		e = err
 		return
 	}
 
-	if verbose {
-		fmt.Printf("Send(2): <%s>\n", FmtBits(buffer[:n]))
+	if debugEnabled() {
+		logger.Debug("Send(2): response to START", Fields(buffer[:n])...)
 	}
 
-	corrupt, valid, destR, srcR, seqR, flag, size, _ := Decode(buffer[:n])
-	if corrupt || !valid {
-		if verbose {
-			fmt.Printf("Send(2A): Failed...\n")
-		}
+	if err = p.UnmarshalBinary(buffer[:n]); err != nil {
+		logger.Debug("Send(2A): response corrupt or invalid", "err", err)
 		goto await_confirm
 	}
-	if src != destR || dest != srcR || seqs != seqR || window != size {
-		if verbose {
-			fmt.Printf("Send(2B): Failed...\n")
-			fmt.Printf("src: %v != destR %v, dest: %v != srcR %v\n", src, destR, dest, srcR)
-			fmt.Printf("seqs: %v != seqR %v, window: %v != size %v\n", seqs, seqR, window, size)
+	if src == p.Dest {
+		heard(src, p.Src)
+	}
+	if answerProbe(c, src, p.Header) {
+		goto await_accept
+	}
+	if mtu, ok := p.MTU(); ok && src == p.Dest && dest == p.Src && epoch == p.Epoch {
+		if e = tooBig(src, dest, mtu, auto); e != nil {
+			return
 		}
 		goto await_confirm
 	}
-	if flag&IGNORE > 0 {
-		if verbose {
-			fmt.Printf("Send(2C): Failed...\n")
+	if src == p.Dest && dest == p.Src && p.IsFin() {
+		if e = sendClosing(c, src, dest, p.Header); e != nil {
+			return
+		}
+		goto await_accept
+	}
+	// IGNORE doesn't need ACCEPT's size, without one of START, ACCEPT or DONE it has none
+	if src == p.Dest && p.IsStart() && !p.IsDone() {
+		hold(src, p.Header, buffer[:n])
+		goto await_accept
+	}
+	if src != p.Dest || dest != p.Src || epoch != p.Epoch || seqs != p.Seq || (window != p.Size && !p.IsIgnore()) {
+		if debugEnabled() {
+			logger.Debug("Send(2B): not a response to this START, discarding",
+				"src", src, "destR", p.Dest, "dest", dest, "srcR", p.Src, "epoch", epoch, "epochR", p.Epoch,
+				"seqs", seqs, "seqR", p.Seq, "window", window, "size", p.Size)
 		}
+		discarded.With("stale").Inc()
+		goto await_accept
+	}
+	if p.IsIgnore() {
+		logger.Debug("Send(2C): ignored by receiver")
 		e = errors.New("Server is not accepting communication right now")
 		return
-	} else if flag&ACCEPT == 0 {
-		if verbose {
-			fmt.Printf("Send(2D): Failed...\n")
+	} else if !p.HasAck() {
+		logger.Debug("Send(2D): response isn't ACCEPT, discarding")
+		discarded.With("stale").Inc()
+		goto await_accept
+	}
+	// with timestamps the ACCEPT says which START it's for as well, the epoch alone can come
+	// up again - it's only 16 bits, and starts somewhere random
+	peerTs, ecr, stamped := p.Timestamps()
+	stamped = stamped && offered
+	if stamped && ecr != startTs {
+		if debugEnabled() {
+			logger.Debug("Send(2E): ACCEPT for an earlier START, discarding", "ecr", ecr, "tsval", startTs)
 		}
-		goto await_confirm
+		discarded.With("stale").Inc()
+		goto await_accept
+	}
+	// the epoch says which START this ACCEPT is for, so every round can be timed
+	rtt.Observe(since(started).Seconds())
+	// a START goes without options if the peer didn't answer one with them the last time,
+	// or didn't answer the one before this in the same Send - either way it's most likely
+	// older. If it isn't, it'll say so when it sends a START itself
+	version := byte(0)
+	if offered {
+		version = accepted(p.Options)
 	}
+	setPeerVersion(src, dest, version)
 
-	data_to_send := len(data)
-	data_sent, slice_offset := 0, 0
-	var seq uint16 = 0
-	// note how it diverges from good TCP practice here, since it doesnt ACK
-	// individual "packets" in split up data, but instead just does it once at the end
-	// this means that if the server already way at the start knows its receiving junk data
-	// this will still finish sending all of its packets - before receiving the info from server
-	for data_sent < data_to_send {
-		slice_offset = data_sent + int(window)
-		if slice_offset > data_to_send {
-			slice_offset = data_to_send
-		}
-		data_packet := Encode(dest, src, seq, EMPTY, 0, data[data_sent:slice_offset])
-		if verbose {
-			fmt.Printf("Send(3-%v): <%s>\n", seq, FmtBits(data_packet))
-			fmt.Printf("Send(3+%v): <%s>\n", seq, FmtBits(data[data_sent:slice_offset]))
-		}
-		// it might deceptively seem like we can timeout waiting here forever, but we actually cant
-		// due to communication going through forwarder, it will always be able to send
-		c.Write(data_packet)
-		data_sent += int(window)
-		seq++
-	}
-	if data_sent > 0 {
-		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// the data is cut into seqs segments of window bytes, and at most cc.Window() of them are
+	// in flight at once. The receiver acknowledges them cumulatively - an ACCEPT without a size,
+	// with seq = how many segments it has in a row from the first one - and sends DONE once it
+	// has all of them. base is the first segment that isn't acknowledged, next the first one
+	// that hasn't been sent in this round
+	cc := congestionControl()
+	rto := min(max(3*since(started), 200*time.Millisecond), time.Second)
+	initialRto := rto
+	var base, next uint16 = 0, 0
+	dupacks := 0
+	progress := now()
+	// losses are only taken out on the window once per round trip, till everything that was
+	// in flight when it was last cut (up to recover) has been acknowledged
+	var recover uint16 = 0
+	// with timestamps every ack that acknowledges something new is a round trip, even for
+	// segments that were sent more than once - the ack echoes the TSval of the one that made
+	// it. rto goes back to 3 round trips (smoothed) after them, instead of the first guess
+	srtt := since(started)
+	observe := func(ecr uint32) {
+		r := time.Duration(tsNow()-ecr) * time.Millisecond
+		rtt.Observe(r.Seconds())
+		srtt += (r - srtt) / 8
+		initialRto = min(max(3*srtt, 200*time.Millisecond), time.Second)
+	}
+	// what data packets carry, TSval now and TSecr the latest one from the receiver
+	var stamp []byte
+	stampOf := func() []byte {
+		if !stamped {
+			return nil
+		}
+		stamp = AppendTimestamps(stamp[:0], tsNow(), peerTs)
+		return stamp
+	}
+	loss := func() {
+		if base >= recover {
+			cc.OnLoss()
+			recover = next
+		}
+	}
+	advance := func(to uint16) {
+		cc.OnAck(int(to - base))
+		base = to
+		// acks for segments that were sent again after a timeout could have been for the
+		// first time they were sent, so without timestamps it only goes back to the first guess
+		rto = initialRto
+		dupacks = 0
+		progress = now()
+		if next < base {
+			next = base
+		}
+	}
+	sent := make([]bool, seqs)
+	segment := func(i uint16) {
+		from := int(i) * int(window)
+		to := min(from+int(window), len(data))
+		out = appendPacket(out[:0], Header{dest, src, i, epoch, EMPTY, 0}, stampOf(), data[from:to])
+		if debugEnabled() {
+			logger.Debug("Send(3): data", Fields(out)...)
+		}
+		c.Write(out)
+		bytesSent.Add(to - from)
+		if sent[i] || attempts > 1 {
+			bytesRetransmitted.Add(to - from)
+		}
+		sent[i] = true
+	}
+	if seqs > 0 {
+	send_window:
+		for next < seqs && int(next-base) < cc.Window() {
+			segment(next)
+			next++
+		}
+		cwnd.Set(cc.Window())
+		deadline := now().Add(rto)
+	await_ack:
+		c.SetReadDeadline(deadline)
 		n, err := c.Read(buffer)
 		c.SetReadDeadline(time.Time{})
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				fmt.Println("DONE packet not received, assuming transmission failed - restarting.")
-				goto await_confirm
+				if since(progress) > 5*time.Second {
+					logger.Warn("DONE packet not received, assuming transmission failed - restarting", "src", string(rune(src)), "dest", string(rune(dest)), "attempt", attempts)
+					if auto && base == 0 {
+						// not one segment got through, they might be too big for a path that
+						// doesn't say so - or it's loss
+						if e = probeSize(c, src, dest, int(window)+segmentOverhead); e != nil {
+							return
+						}
+					}
+					goto await_confirm
+				}
+				// go back to the first segment that wasn't acknowledged, with a window of
+				// (most likely) one segment and twice the patience
+				cc.OnTimeout()
+				retransmitTimeouts.Inc()
+				rto = min(2*rto, 2*time.Second)
+				dupacks = 0
+				recover = next
+				next = base
+				logger.Debug("Send(4): retransmission timeout", "base", base, "cwnd", cc.Window(), "rto", rto)
+				goto send_window
 			}
 			e = err
 			return
 		}
 
-		corrupt, valid, destR, srcR, seqR, flag, size, _ = Decode(buffer[:n])
-		if verbose {
-			fmt.Printf("Send(4): <%s>\n", FmtBits(buffer[:n]))
+		err = p.UnmarshalBinary(buffer[:n])
+		if debugEnabled() {
+			logger.Debug("Send(4): response to data", Fields(buffer[:n])...)
 		}
-		if corrupt || !valid {
-			if verbose {
-				fmt.Printf("Send(4A): Failed...\n")
+		if err != nil {
+			// it's as good as lost, a later ack or the timeout covers for it
+			if debugEnabled() {
+				logger.Debug("Send(4A): response corrupt or invalid, discarding", "err", err)
 			}
-			goto await_confirm
+			discarded.With("corrupt").Inc()
+			goto await_ack
+		}
+		if src == p.Dest {
+			heard(src, p.Src)
 		}
-		if src != destR || dest != srcR || seqs != seqR || window != size {
-			if verbose {
-				fmt.Printf("Send(4B): Failed...\n")
-				fmt.Printf("src: %v != destR %v, dest: %v != srcR %v\n", src, destR, dest, srcR)
-				fmt.Printf("seqs: %v != seqR %v, window: %v != size %v\n", seqs, seqR, window, size)
+		if answerProbe(c, src, p.Header) {
+			goto await_ack
+		}
+		if mtu, ok := p.MTU(); ok && src == p.Dest && dest == p.Src && epoch == p.Epoch {
+			if e = tooBig(src, dest, mtu, auto); e != nil {
+				return
 			}
 			goto await_confirm
 		}
-		if flag&FAILURE > 0 {
-			if verbose {
-				fmt.Printf("Send(4C): Failed...\n")
+		if src == p.Dest && dest == p.Src && p.IsFin() {
+			if e = sendClosing(c, src, dest, p.Header); e != nil {
+				return
+			}
+			goto await_ack
+		}
+		if src == p.Dest && p.IsStart() && !p.IsDone() {
+			hold(src, p.Header, buffer[:n])
+			goto await_ack
+		}
+		if src != p.Dest || dest != p.Src || epoch != p.Epoch {
+			if debugEnabled() {
+				logger.Debug("Send(4B): not a response to this round, discarding",
+					"src", src, "destR", p.Dest, "dest", dest, "srcR", p.Src, "epoch", epoch, "epochR", p.Epoch)
+			}
+			discarded.With("stale").Inc()
+			goto await_ack
+		}
+		// PAWS (like TCP's), an answer to something sent before this round's START is left
+		// over from an earlier round - whatever its epoch says
+		val, ecr, echoed := p.Timestamps()
+		echoed = echoed && stamped
+		if echoed && tsBefore(ecr, startTs) {
+			if debugEnabled() {
+				logger.Debug("Send(4E): answers a packet from an earlier round, discarding", "ecr", ecr, "tsval", startTs)
 			}
+			discarded.With("stale").Inc()
+			goto await_ack
+		}
+		if echoed && !tsBefore(val, peerTs) {
+			peerTs = val
+		}
+		if p.IsFailure() && len(p.Data) == 0 {
+			logger.Debug("Send(4C): receiver reported FAILURE")
 			goto await_confirm
 		}
+		if p.IsNak() {
+			missing, ok := decodeNak(p.Data)
+			// a NAK always has something missing, so it can't acknowledge every segment
+			if !ok || p.Seq >= seqs {
+				if debugEnabled() {
+					logger.Debug("Send(6A): NAK doesn't make sense, discarding", "seq", p.Seq, "data", len(p.Data))
+				}
+				discarded.With("corrupt").Inc()
+				goto await_ack
+			}
+			if p.Seq > base {
+				if echoed {
+					observe(ecr)
+				}
+				advance(p.Seq)
+			}
+			// only what's been sent and not acknowledged yet, the rest is either on its way
+			// or acknowledged by a later ack already
+			resent := 0
+			for _, seq := range missing {
+				if seq < base || seq >= next {
+					continue
+				}
+				if resent == 0 {
+					loss()
+				}
+				segment(seq)
+				nakRetransmits.Inc()
+				resent++
+			}
+			if debugEnabled() {
+				logger.Debug("Send(6): NAK, sending missing segments again", "missing", len(missing), "resent", resent, "acked", base, "cwnd", cc.Window())
+			}
+			goto send_window
+		}
+		if p.IsDone() && p.Seq == seqs && p.Size == window {
+			if echoed {
+				observe(ecr)
+			}
+			return
+		}
+		// the receiver sends DONE instead of an ack for the last segment, so an ack of every
+		// segment isn't one - it would make base seqs, past the last segment there is
+		if p.Flag != ACCEPT || p.Size != 0 || p.Seq >= seqs {
+			// most likely the ACCEPT for START got duplicated on the way
+			logger.Debug("Send(4D): not an ack, discarding")
+			discarded.With("duplicate").Inc()
+			goto await_ack
+		}
+		if p.Seq > base {
+			if echoed {
+				observe(ecr)
+			}
+			advance(p.Seq)
+			if debugEnabled() {
+				logger.Debug("Send(5): ack", "acked", base, "of", seqs, "cwnd", cc.Window())
+			}
+			goto send_window
+		}
+		if p.Seq < base {
+			if debugEnabled() {
+				logger.Debug("Send(5A): old ack, discarding", "ack", p.Seq, "acked", base)
+			}
+			discarded.With("stale").Inc()
+			goto await_ack
+		}
+		dupacks++
+		if dupacks == 3 && base >= recover && base < seqs {
+			// fast retransmit, base is most likely lost - unless a NAK already had it sent again
+			loss()
+			fastRetransmits.Inc()
+			if debugEnabled() {
+				logger.Debug("Send(5B): 3 duplicate acks, sending segment again", "seq", base, "cwnd", cc.Window())
+			}
+			segment(base)
+		} else if dupacks > 3 {
+			cc.OnDupAck()
+		}
+		goto send_window
 	}
 	// if the response from the server doesn't have the flag DONE, even though we're not sending
 	// more packets - then just try again, obviously this isn't ideal either - since that means if the
@@ -328,120 +777,400 @@ await_confirm:
 	// to clarify, if all the previous logic has gotten us here, there is no logical flow that could lead to it
 	// not needing to be DONE from the server side - however, since the checksum said it was valid, and the flag is not
 	// what we expect, the network is proven unstable enough to change multiple bits - so we can only start over
-	if flag&DONE == 0 {
+	if !p.IsDone() {
 		goto await_confirm
 	}
 	return
 }
 
+// tooBig deals with a FAILURE from a forwarder saying packets to dest can be at most mtu
+// bytes, Send starts over with smaller segments if it picked the size itself
+func tooBig(src byte, dest byte, mtu int, auto bool) error {
+	if debugEnabled() {
+		logger.Debug("Send: segments too big for the path", "mtu", mtu)
+	}
+	tooBigs.Inc()
+	if !auto || segmentSize(mtu) == 0 {
+		return &TooBigError{Peer: dest, MTU: mtu}
+	}
+	lowerPathMTU(src, dest, mtu)
+	return nil
+}
+
+// sendClosing deals with a FIN or RESET from dest that came while Send was waiting for
+// something else, the FIN is acknowledged and left for Recv to report
+func sendClosing(c net.Conn, src byte, dest byte, h Header) error {
+	switch h.Flag {
+	case RESET:
+		logger.Debug("Send: RESET, peer is gone")
+		gotReset(src, dest)
+		return &ClosedError{Peer: dest, Reset: true}
+	case FIN:
+		gotFin(c, src, dest, h.Seq, h.Epoch)
+	default:
+		logger.Debug("Send: stray FIN-ACK, discarding")
+		discarded.With("stale").Inc()
+	}
+	return nil
+}
+
 // Recv is the complimentary wrapper to Send - they need to be used in combination
+// once a peer has sent FIN (see CloseWrite) or has been reset, Recv returns a *ClosedError
+// for it, that is also the case if the FIN came while Send was running
 func Recv(c net.Conn, src byte, wait uint8) (data []byte, srcR byte, e error) {
-	// 65543 is max size of our 'packet'
-	buffer := make([]byte, 65543)
+	bp := getBuffer()
+	defer putBuffer(bp)
+	buffer := *bp
+	mp := getBuffer()
+	defer putBuffer(mp)
+	msg_buffer := *mp
+	// acks and NAKs are encoded into this one after the other
+	var out []byte
+	// the START of the transfer, and the segments after it are decoded into seg
+	var start, seg Packet
 
-await_start:
+	if peer, ok := untold(src); ok {
+		srcR = peer
+		e = &ClosedError{Peer: peer}
+		return
+	}
+
+	var waitUntil time.Time
 	if wait > 0 {
-		c.SetReadDeadline(time.Now().Add(time.Duration(wait) * time.Second))
+		waitUntil = now().Add(time.Duration(wait) * time.Second)
 	}
-	n, err := c.Read(buffer)
+await_start:
+	// the deadline might come sooner if keepalive has something to do
+	deadline := waitUntil
+	probing := false
+	if ka := nextKeepalive(src); !ka.IsZero() && (deadline.IsZero() || ka.Before(deadline)) {
+		deadline = ka
+		probing = true
+	}
+	c.SetReadDeadline(deadline)
+	n, err := readStart(c, src, buffer)
 	c.SetReadDeadline(time.Time{})
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			fmt.Println("Timed out waiting for START-packet")
+			if probing {
+				if e = keepaliveDue(c, src); e != nil {
+					if dead, ok := e.(*DeadPeerError); ok {
+						srcR = dead.Peer
+					}
+					return
+				}
+				goto await_start
+			}
+			logger.Warn("timed out waiting for START-packet", "src", string(rune(src)))
 		}
 		e = err
 		return
 	}
 
-	corrupt, valid, destR, srcR, seqR, flag, size, data := Decode(buffer[:n])
-	if verbose {
-		fmt.Printf("Recv(1): <%s>\n", FmtBits(buffer[:n]))
+decode_start:
+	err = start.UnmarshalBinary(buffer[:n])
+	if debugEnabled() {
+		logger.Debug("Recv(1): waiting for START", Fields(buffer[:n])...)
 	}
-	if corrupt || !valid {
-		fmt.Printf("Received an invalid packet, waiting for another response\n")
+	if err != nil {
+		logger.Warn("received an invalid packet, waiting for another response", "src", string(rune(src)), "err", err)
 		goto await_start
 	}
-	if src != destR {
-		if verbose {
-			fmt.Printf("Recv(1B): Failed here...\n")
-		}
+	srcR = start.Src
+	if src != start.Dest {
+		logger.Debug("Recv(1B): packet isn't for us")
 		goto await_start
 	}
-	if flag&START == 0 {
-		if verbose {
-			fmt.Printf("Recv(1C): Failed here...\n")
+	heard(src, srcR)
+	if answerProbe(c, src, start.Header) {
+		goto await_start
+	}
+	if start.IsReset() {
+		if !gotReset(src, srcR) {
+			logger.Debug("Recv(1E): RESET for a peer that closed already, discarding")
+			goto await_start
+		}
+		e = &ClosedError{Peer: srcR, Reset: true}
+		return
+	}
+	if start.Flag == FIN {
+		if !gotFin(c, src, srcR, start.Seq, start.Epoch) {
+			goto await_start
 		}
+		tell(src, srcR)
+		e = &ClosedError{Peer: srcR}
+		return
+	}
+	if done, ok := doneFor(src, srcR, start.Epoch); ok {
+		// a segment (or START) of the round we finished last, the DONE for it was lost and the
+		// sender is still waiting for it - without it, it would start over and be delivered twice
+		out = appendPacket(out[:0], done, nil, nil)
+		if debugEnabled() {
+			logger.Debug("Recv(1F): round is already done, sending DONE again", Fields(out)...)
+		}
+		c.Write(out)
+		discarded.With("duplicate").Inc()
+		goto await_start
+	}
+	if !start.IsStart() {
+		logger.Debug("Recv(1C): packet isn't START")
 		goto await_start
 	}
-	if seqR == 0 || size == 0 {
-		accept_packet := Encode(srcR, src, seqR, ACCEPT|DONE, size, []byte{})
+	if seenEpoch(src, srcR, start.Epoch) {
+		logger.Debug("Recv(1D): START of a round that's already done, discarding", "epoch", start.Epoch)
+		discarded.With("stale").Inc()
+		goto await_start
+	}
+	see(src, srcR, start.Epoch)
+	reopen(src, srcR)
+	transfersStarted.With("recv").Inc()
+	opts, version, stamped := answer(start.Options)
+	setPeerVersion(src, srcR, version)
+	if start.Seq == 0 || start.Size == 0 {
+		accept_packet := appendPacket(nil, Header{srcR, src, start.Seq, start.Epoch, ACCEPT | DONE, start.Size}, opts, nil)
 		c.Write(accept_packet)
+		finish(src, srcR, Header{srcR, src, start.Seq, start.Epoch, ACCEPT | DONE, start.Size})
+		transfersCompleted.With("recv").Inc()
+		// copied out of buffer already
+		data = start.Data
 		return
 	}
 
-	accept_packet := Encode(srcR, src, seqR, ACCEPT, size, []byte{})
+	accept_packet := appendPacket(nil, Header{srcR, src, start.Seq, start.Epoch, ACCEPT, start.Size}, opts, nil)
 	c.Write(accept_packet)
-	if verbose {
-		fmt.Printf("Recv(2): <%s>\n", FmtBits(accept_packet))
+	if debugEnabled() {
+		logger.Debug("Recv(2): ACCEPT", Fields(accept_packet)...)
 	}
 
-	received := make([][]byte, seqR)
+	// with timestamps startTs is the START's TSval, anything from the sender that's older is
+	// from an earlier round. tsRecent is the TSval acks echo, it only moves on with the
+	// segment that acks move on with - so the sender gets the round trip of that one, even if
+	// it was sent more than once, and not of something that happened to come in later
+	startTs, _, _ := start.Timestamps()
+	tsRecent := startTs
+	var stamp []byte
+	stampOf := func() []byte {
+		if !stamped {
+			return nil
+		}
+		stamp = AppendTimestamps(stamp[:0], tsNow(), tsRecent)
+		return stamp
+	}
 
+	received := make([][]byte, start.Seq)
+	got := make([]bool, start.Seq)
+	// every data packet is acknowledged, with how many segments we have in a row from the
+	// first one (cum) - a duplicate ack tells the sender something after that is missing.
+	// the last one isn't acknowledged, DONE is sent for it instead
+	var cum uint16 = 0
+	ack := func() {
+		out = appendPacket(out[:0], Header{srcR, src, cum, start.Epoch, ACCEPT, 0}, stampOf(), nil)
+		if debugEnabled() {
+			logger.Debug("Recv(3J): ack", Fields(out)...)
+		}
+		c.Write(out)
+	}
+	// a segment that three later ones got here before (so it's not just reordered), or that
+	// showed up with a bad checksum, is asked for by name in a NAK - which acknowledges cum
+	// as well, so it's sent instead of the ack
+	nakked := make([]time.Time, start.Seq)
+	missing := func(upto uint16, force bool) (m []uint16) {
+		for i := cum; i < upto && len(m) < maxNak; i++ {
+			if !got[i] && (force || since(nakked[i]) >= nakInterval) {
+				m = append(m, i)
+			}
+		}
+		return
+	}
+	nak := func(m []uint16) {
+		for _, i := range m {
+			nakked[i] = now()
+		}
+		out = appendPacket(out[:0], Header{srcR, src, cum, start.Epoch, FAILURE, 0}, stampOf(), encodeNak(m))
+		if debugEnabled() {
+			logger.Debug("Recv(3K): NAK", append(Fields(out), "missing", m)...)
+		}
+		c.Write(out)
+		naksSent.Inc()
+	}
+	progress := now()
 	var seqs uint16 = 0
-	// note how it diverges from good TCP practice here, since it doesnt ACK
-	// individual "packets" in split up data, but instead just does it once at the end
-	for seqs < seqR {
-		msg_buffer := make([]byte, 65543)
-		c.SetReadDeadline(time.Now().Add(2 * time.Second))
-		n, err := c.Read(msg_buffer)
+	// the sender starts over after 5 seconds without an ack, so after 6 without progress
+	// it's either gone, or its new START has been read
+	fail := func() {
+		logger.Warn("missing data packets, sending failure-packet and awaiting START", "src", string(rune(src)), "dest", string(rune(srcR)), "received", seqs, "expected", start.Seq)
+		fail_packet := Encode(srcR, src, start.Seq, start.Epoch, FAILURE, start.Size, []byte{})
+		if debugEnabled() {
+			logger.Debug("Recv(3A): FAILURE", Fields(fail_packet)...)
+		}
+		c.Write(fail_packet)
+		transfersFailed.With("recv").Inc()
+	}
+
+	for seqs < start.Seq {
+		// checked here as well as on a timeout, packets that don't get us anywhere (junk,
+		// or duplicates) coming in often enough would keep the read from ever timing out
+		if since(progress) >= 6*time.Second {
+			fail()
+			goto await_start
+		}
+		c.SetReadDeadline(now().Add(nakInterval))
+		k, err := c.Read(msg_buffer)
 		c.SetReadDeadline(time.Time{})
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				fmt.Println("Missing data packets, sending failure-packet and awaiting START")
-				fail_packet := Encode(srcR, src, seqR, FAILURE, size, []byte{})
-				if verbose {
-					fmt.Printf("Recv(3A-%v): <%s>\n", seqs, FmtBits(fail_packet))
+				// till then it's worth asking for what's missing
+				if since(progress) < 6*time.Second {
+					if m := missing(start.Seq, true); len(m) > 0 {
+						logger.Debug("Recv(3L): nothing for a while, asking for what's missing", "missing", len(m))
+						nak(m)
+					}
+					continue
 				}
-				c.Write(fail_packet)
+				fail()
 				goto await_start
 			}
+			e = err
 			return
 		}
 
-		corrupt, valid, _, _, seqTmp, flagTmp, _, dataTmp := Decode(msg_buffer[:n])
-		if verbose {
-			fmt.Printf("Recv(3-%v): <%s>\n", seqs, FmtBits(msg_buffer[:n]))
+		err = seg.UnmarshalBinary(msg_buffer[:k])
+		if debugEnabled() {
+			logger.Debug("Recv(3): data", Fields(msg_buffer[:k])...)
 		}
-		if corrupt || !valid || flagTmp != EMPTY {
-			fail_packet := Encode(srcR, src, seqR, FAILURE, size, []byte{})
-			if verbose {
-				fmt.Printf("Recv(3A-%v): <%s>\n", seqs, FmtBits(fail_packet))
+		if err == nil && seg.Dest == src {
+			heard(src, seg.Src)
+			if answerProbe(c, src, seg.Header) {
+				continue
 			}
-			c.Write(fail_packet)
-			goto await_start
 		}
-		if len(received[seqTmp]) != 0 {
-			if verbose {
-				fmt.Printf("Recv(3B-%v): Failed...\n", seqs)
+		if err != nil {
+			// as good as lost - but if the header looks like one of ours, its seq is most
+			// likely right, so the sender doesn't have to wait for the acks to find out
+			logger.Debug("Recv(3A): corrupt or invalid, discarding")
+			discarded.With("corrupt").Inc()
+			if err == ErrChecksum && seg.Dest == src && seg.Src == srcR && seg.Epoch == start.Epoch && seg.Flag == EMPTY && seg.Seq < start.Seq && !got[seg.Seq] {
+				nak([]uint16{seg.Seq})
 			}
-			goto await_start
-		} else {
-			received[seqTmp] = dataTmp
-			if verbose {
-				fmt.Printf("Recv(3+%v): <%s>\n", seqs, FmtBits(dataTmp))
+			continue
+		}
+		// from here on, anything that doesn't belong to this transfer is thrown away without
+		// a word - the network can duplicate packets, and packets from earlier exchanges can
+		// show up late, neither of them are a reason to start over
+		if seg.Dest == src && seg.Src != srcR && seg.IsStart() && !seg.IsDone() {
+			hold(src, seg.Header, msg_buffer[:k])
+			continue
+		}
+		if seg.Dest != src || seg.Src != srcR {
+			logger.Debug("Recv(3B): not from who we're receiving from, discarding")
+			discarded.With("stale").Inc()
+			continue
+		}
+		if seg.IsReset() {
+			gotReset(src, srcR)
+			transfersFailed.With("recv").Inc()
+			e = &ClosedError{Peer: srcR, Reset: true}
+			return
+		}
+		if seg.Flag == FIN {
+			// left for the next Recv to report, the sender can't have meant to close
+			// in the middle of sending, so it's most likely a FIN sent again
+			gotFin(c, src, srcR, seg.Seq, seg.Epoch)
+			continue
+		}
+		if seg.IsStart() {
+			if seg.Epoch == start.Epoch {
+				logger.Debug("Recv(3C): duplicate START, discarding")
+				discarded.With("duplicate").Inc()
+				continue
 			}
+			val, _, ok := seg.Timestamps()
+			if seenEpoch(src, srcR, seg.Epoch) || (stamped && ok && tsBefore(val, startTs)) {
+				if debugEnabled() {
+					logger.Debug("Recv(3D): START of an earlier round, discarding", "epoch", seg.Epoch, "current", start.Epoch)
+				}
+				discarded.With("stale").Inc()
+				continue
+			}
+			// the sender gave up on this round and started a new one
+			logger.Debug("Recv(3E): START of a new round, starting over", "epoch", seg.Epoch, "current", start.Epoch)
+			n = copy(buffer, msg_buffer[:k])
+			goto decode_start
 		}
+		if seg.Epoch != start.Epoch {
+			if debugEnabled() {
+				logger.Debug("Recv(3F): packet from another round, discarding", "epoch", seg.Epoch, "current", start.Epoch)
+			}
+			discarded.With("stale").Inc()
+			continue
+		}
+		if seg.Flag != EMPTY {
+			logger.Debug("Recv(3G): not a data packet, discarding")
+			discarded.With("stale").Inc()
+			continue
+		}
+		if seg.Seq >= start.Seq {
+			if debugEnabled() {
+				logger.Debug("Recv(3H): seq out of range, discarding", "seq", seg.Seq, "expected", start.Seq)
+			}
+			discarded.With("stale").Inc()
+			continue
+		}
+		// PAWS (like TCP's), data sent before this round's START is from an earlier one with
+		// an epoch that came up again
+		if val, _, ok := seg.Timestamps(); stamped && ok {
+			if tsBefore(val, startTs) {
+				if debugEnabled() {
+					logger.Debug("Recv(3M): sent before this round's START, discarding", "tsval", val, "start", startTs)
+				}
+				discarded.With("stale").Inc()
+				continue
+			}
+			if seg.Seq == cum && !tsBefore(val, tsRecent) {
+				tsRecent = val
+			}
+		}
+		if got[seg.Seq] {
+			// the ack for it might have been lost
+			if debugEnabled() {
+				logger.Debug("Recv(3I): duplicate seq, discarding", "seq", seg.Seq)
+			}
+			discarded.With("duplicate").Inc()
+			ack()
+			continue
+		}
+		// seg is decoded into again
+		received[seg.Seq] = bytes.Clone(seg.Data)
+		got[seg.Seq] = true
 		seqs++
+		progress = now()
+		for cum < start.Seq && got[cum] {
+			cum++
+		}
+		if seqs < start.Seq {
+			if m := missing(max(seg.Seq, 2)-2, false); len(m) > 0 {
+				nak(m)
+			} else {
+				ack()
+			}
+		}
+	}
+	total := 0
+	for _, r := range received {
+		total += len(r)
 	}
-	data = []byte{}
+	data = make([]byte, 0, total)
 	for i := 0; i < int(seqs); i++ {
 		data = append(data, received[i]...)
 	}
-	done_packet := Encode(srcR, src, seqR, DONE, size, []byte{})
-	if verbose {
-		fmt.Printf("Recv(4): <%s>\n", FmtBits(done_packet))
+	done_packet := appendPacket(nil, Header{srcR, src, start.Seq, start.Epoch, DONE, start.Size}, stampOf(), nil)
+	if debugEnabled() {
+		logger.Debug("Recv(4): DONE", Fields(done_packet)...)
 	}
 
 	c.Write(done_packet)
+	finish(src, srcR, Header{srcR, src, start.Seq, start.Epoch, DONE, start.Size})
+	transfersCompleted.With("recv").Inc()
+	bytesReceived.Add(len(data))
 	return
 }
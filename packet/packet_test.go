@@ -0,0 +1,467 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// every combination of the six flags
+func allFlags() []byte {
+	flags := make([]byte, 0, 64)
+	for i := 0; i < 64; i++ {
+		flags = append(flags, byte(i)<<2)
+	}
+	return flags
+}
+
+func TestEncodeDecode(t *testing.T) {
+	datas := [][]byte{nil, {0x01}, {0x01, 0x02}, {0x01, 0x02, 0x03}, bytes.Repeat([]byte{0xab}, 512)}
+	for _, flag := range allFlags() {
+		for _, data := range datas {
+			t.Run(fmt.Sprintf("%08b/%d", flag, len(data)), func(t *testing.T) {
+				raw := Encode('b', 'a', 0x1234, 0xbeef, flag, 512, data)
+				corrupt, valid, dest, src, seq, epoch, flagR, size, dataR := Decode(raw)
+				if corrupt || !valid {
+					t.Fatalf("corrupt %v, valid %v: % x", corrupt, valid, raw)
+				}
+				if dest != 'b' || src != 'a' || seq != 0x1234 || epoch != 0xbeef || flagR != flag {
+					t.Errorf("got dest %c src %c seq %#x epoch %#x flag %08b", dest, src, seq, epoch, flagR)
+				}
+				wantSize := uint16(0)
+				if hasSize(flag) {
+					wantSize = 512
+				}
+				if size != wantSize {
+					t.Errorf("size %d, expected %d", size, wantSize)
+				}
+				if !bytes.Equal(dataR, data) {
+					t.Errorf("data % x, expected % x", dataR, data)
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeLayout(t *testing.T) {
+	tests := []struct {
+		flag byte
+		data int
+		// bytes in front of the data: dest, src, seq, epoch, flags, padding and size
+		header int
+		padded bool
+	}{
+		{EMPTY, 0, 8, true},
+		{EMPTY, 1, 7, false},
+		{EMPTY, 2, 8, true},
+		{START, 0, 10, true},
+		{START, 1, 9, false},
+		{ACCEPT | DONE, 0, 10, true},
+		{FAILURE, 2, 8, true},
+		{FAILURE, 3, 7, false},
+		{FIN, 0, 8, true},
+	}
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte{0xff}, tt.data)
+		raw := Encode('b', 'a', 1, 2, tt.flag, 3, data)
+		if len(raw)%2 != 0 {
+			t.Errorf("flag %08b, %d bytes of data: packet is %d bytes, it should always be even", tt.flag, tt.data, len(raw))
+		}
+		if want := tt.header + tt.data + 2; len(raw) != want {
+			t.Errorf("flag %08b, %d bytes of data: packet is %d bytes, expected %d", tt.flag, tt.data, len(raw), want)
+			continue
+		}
+		// the last bit of the flags and padding is the 1 the padding ends with
+		if tt.padded {
+			if raw[6] != tt.flag || raw[7] != 0b00000001 {
+				t.Errorf("flag %08b: expected a padding byte, got %08b %08b", tt.flag, raw[6], raw[7])
+			}
+		} else if raw[6] != tt.flag|0b00000001 {
+			t.Errorf("flag %08b: expected no padding byte, got %08b", tt.flag, raw[6])
+		}
+	}
+}
+
+func TestEncodeMaxLength(t *testing.T) {
+	data := bytes.Repeat([]byte{0x5a}, 0xffff)
+	for _, flag := range []byte{EMPTY, START, ACCEPT | DONE} {
+		raw := Encode('b', 'a', 1, 2, flag, 0xffff, data)
+		if len(raw) > MaxSize {
+			t.Errorf("flag %08b: %d bytes, larger than MaxSize (%d)", flag, len(raw), MaxSize)
+		}
+		corrupt, valid, _, _, _, _, _, _, dataR := Decode(raw)
+		if corrupt || !valid || !bytes.Equal(dataR, data) {
+			t.Errorf("flag %08b: corrupt %v, valid %v, %d bytes of data", flag, corrupt, valid, len(dataR))
+		}
+	}
+	if raw := Encode('b', 'a', 1, 2, EMPTY, 0, make([]byte, 0x10000)); len(raw) != 0 {
+		t.Errorf("more data than a packet can hold was encoded into %d bytes", len(raw))
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, flag := range []byte{EMPTY, START, ACCEPT, DONE, FAILURE, FIN} {
+		for _, data := range [][]byte{nil, {1}, {1, 2, 3, 4}} {
+			raw := Encode('b', 'a', 7, 9, flag, 4, data)
+			for i := 0; i < len(raw); i++ {
+				corrupt, valid, _, _, _, _, _, _, _ := Decode(raw[:i])
+				if !corrupt && valid {
+					t.Errorf("flag %08b, %d bytes of data: the first %d of %d bytes decoded as a valid packet", flag, len(data), i, len(raw))
+				}
+			}
+		}
+	}
+
+	short := [][]byte{{}, {'b'}, {'b', 'a', 0, 0, 0, 0, 0, 0}}
+	for _, raw := range short {
+		if corrupt, _, _, _, _, _, _, _, _ := Decode(raw); !corrupt {
+			t.Errorf("%d bytes wasn't corrupt", len(raw))
+		}
+	}
+}
+
+// withOptionsBit is a packet with area as its data, and the OPTIONS bit set - so that the
+// data is read as the options area, the checksum is fixed up by hand
+func withOptionsBit(area []byte) []byte {
+	raw := Encode('b', 'a', 1, 2, EMPTY, 0, area)
+	raw[6] |= OPTIONS
+	copy(raw[len(raw)-2:], calculateChecksum(raw[:len(raw)-2]))
+	return raw
+}
+
+func TestDecodeBadOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		area []byte
+		err  DecodeError
+	}{
+		// what used to be the spare bit, set on its own - there isn't even a length byte
+		{"nothing after the bit", []byte{}, ErrTruncated},
+		{"empty area", []byte{0, 0xff}, ErrOptions},
+		{"area past the end", []byte{5, 1, 0}, ErrOptions},
+		{"option past the area", []byte{3, 7, 4, 1, 2, 3}, ErrOptions},
+		{"half an option", []byte{1, 7, 0}, ErrOptions},
+	}
+	for _, tt := range tests {
+		raw := withOptionsBit(tt.area)
+		if !verifyChecksum(raw) {
+			t.Fatal("checksum wasn't fixed up")
+		}
+		var p Packet
+		if err := p.UnmarshalBinary(raw); err != tt.err {
+			t.Errorf("%s: got %v, expected %v", tt.name, err, tt.err)
+		}
+		if _, valid, _, _, _, _, _, _, _ := Decode(raw); valid {
+			t.Errorf("%s: valid", tt.name)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	// an option this package doesn't know, before and after one it does
+	opts := AppendOption(nil, 200, 1, 2, 3)
+	opts = AppendOption(opts, OptVersion, 9)
+	opts = AppendOption(opts, 201)
+	want := Packet{Header: Header{Dest: 'b', Src: 'a', Seq: 4, Epoch: 5, Flag: START, Size: 512}, Options: opts, Data: []byte("data")}
+	raw, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw)%2 != 0 {
+		t.Errorf("%d bytes, it should always be even", len(raw))
+	}
+	var got Packet
+	if err := got.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	if got.Header != want.Header || !bytes.Equal(got.Options, opts) || !bytes.Equal(got.Data, want.Data) {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+	if v, ok := got.Option(OptVersion); !ok || !bytes.Equal(v, []byte{9}) {
+		t.Errorf("version option: % x %v", v, ok)
+	}
+	if v, ok := got.Option(201); !ok || len(v) != 0 {
+		t.Errorf("empty option: % x %v", v, ok)
+	}
+	if _, ok := got.Option(OptVersion + 1); ok {
+		t.Error("found an option that isn't there")
+	}
+	// Decode skips them
+	_, valid, _, _, _, _, flag, size, data := Decode(raw)
+	if !valid || flag != START || size != 512 || !bytes.Equal(data, want.Data) {
+		t.Errorf("Decode: valid %v, flag %08b, size %d, data %q", valid, flag, size, data)
+	}
+
+	// the unknown ones aren't answered, and the version is the lower of the two
+	ans, version, stamped := answer(opts)
+	if version != Version || stamped || !bytes.Equal(ans, AppendOption(nil, OptVersion, Version)) {
+		t.Errorf("answered % x, version %d, timestamps %v", ans, version, stamped)
+	}
+	if accepted(ans) != Version {
+		t.Errorf("accepted %d", accepted(ans))
+	}
+	// no options, no answer - the sender might not understand them
+	if ans, version, _ := answer(nil); ans != nil || version != 0 {
+		t.Errorf("answered % x, version %d to a START without options", ans, version)
+	}
+
+	if _, err := (Packet{Options: []byte{7, 3, 1}}).MarshalBinary(); err != ErrOptions {
+		t.Errorf("an option longer than the options got %v", err)
+	}
+	if _, err := (Packet{Options: make([]byte, 0x100)}).MarshalBinary(); err != ErrTooLarge {
+		t.Errorf("more options than fit got %v", err)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	opts := AppendOption(nil, OptVersion, Version)
+	opts = AppendTimestamps(opts, 0xfffffff0, 7)
+	p := Packet{Options: opts}
+	if val, ecr, ok := p.Timestamps(); !ok || val != 0xfffffff0 || ecr != 7 {
+		t.Errorf("got %d/%d (%v)", val, ecr, ok)
+	}
+	if got := FmtOptions(opts); got != "version=1,timestamps=4294967280/7" {
+		t.Errorf("FmtOptions: %s", got)
+	}
+	if _, _, ok := (Packet{Options: AppendOption(nil, OptTimestamps, 1, 2, 3)}).Timestamps(); ok {
+		t.Error("timestamps that are too short")
+	}
+
+	// the answer echoes the START's TSval
+	ans, _, stamped := answer(opts)
+	if _, ecr, ok := (Packet{Options: ans}).Timestamps(); !stamped || !ok || ecr != 0xfffffff0 {
+		t.Errorf("answered % x, timestamps %v", ans, stamped)
+	}
+	SetTimestamps(false)
+	ans, _, stamped = answer(opts)
+	SetTimestamps(true)
+	if _, _, ok := (Packet{Options: ans}).Timestamps(); stamped || ok {
+		t.Errorf("answered timestamps with them turned off: % x", ans)
+	}
+
+	// across the wrap around
+	if !tsBefore(0xfffffff0, 7) || tsBefore(7, 0xfffffff0) || tsBefore(7, 7) {
+		t.Error("tsBefore doesn't wrap around")
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	h := Header{Dest: 'b', Src: 'a', Seq: 3, Epoch: 77}
+	raw, err := TooBig(h, 1500).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Packet
+	if err := p.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	if p.Dest != 'a' || p.Src != 'b' || p.Seq != 3 || p.Epoch != 77 || p.Flag != FAILURE {
+		t.Errorf("not an answer to %v: %v", h, p)
+	}
+	if mtu, ok := p.MTU(); !ok || mtu != 1500 {
+		t.Errorf("MTU %d (%v)", mtu, ok)
+	}
+	if got := FmtOptions(p.Options); got != "mtu=1500" {
+		t.Errorf("FmtOptions: %s", got)
+	}
+	// only a FAILURE says it
+	p.Flag = ACCEPT
+	if _, ok := p.MTU(); ok {
+		t.Error("an ACCEPT with an MTU option is too big")
+	}
+
+	if segmentSize(1500) != 1500-segmentOverhead || segmentSize(segmentOverhead) != 0 || segmentSize(MaxSize) != 0xffff {
+		t.Errorf("segment sizes %d, %d, %d", segmentSize(1500), segmentSize(segmentOverhead), segmentSize(MaxSize))
+	}
+	// the largest segment there is fits in a packet with timestamps
+	raw = appendPacket(nil, Header{Flag: EMPTY}, AppendTimestamps(nil, 1, 2), make([]byte, segmentSize(1500)))
+	if len(raw) > 1500 {
+		t.Errorf("a segment for an MTU of 1500 is %d bytes", len(raw))
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want []byte
+	}{
+		{[]byte{}, []byte{0xff, 0xff}},
+		{[]byte{0x00, 0x00}, []byte{0xff, 0xff}},
+		{[]byte{0x01, 0x00}, []byte{0xfe, 0xff}},
+		{[]byte{0xff, 0xff}, []byte{0x00, 0x00}},
+		// it wraps around without the carry being added back
+		{[]byte{0xff, 0xff, 0x02, 0x00}, []byte{0xfe, 0xff}},
+		{[]byte{0x34, 0x12, 0x78, 0x56}, []byte{0x53, 0x97}},
+	}
+	for _, tt := range tests {
+		got := calculateChecksum(tt.data)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("checksum of % x is % x, expected % x", tt.data, got, tt.want)
+		}
+		if !verifyChecksum(append(append([]byte{}, tt.data...), got...)) {
+			t.Errorf("% x with its checksum doesn't verify", tt.data)
+		}
+	}
+}
+
+func TestChecksumBitFlips(t *testing.T) {
+	raw := Encode('b', 'a', 3, 4, START, 512, []byte("some data"))
+	for i := range raw {
+		for bit := 0; bit < 8; bit++ {
+			flipped := append([]byte{}, raw...)
+			flipped[i] ^= 1 << bit
+			if verifyChecksum(flipped) {
+				t.Errorf("byte %d bit %d flipped, still verified", i, bit)
+			}
+		}
+	}
+	// what the forwarder does to a packet with -zero
+	for i := range raw {
+		if raw[i] == 0 {
+			continue
+		}
+		zeroed := append([]byte{}, raw...)
+		zeroed[i] = 0
+		if verifyChecksum(zeroed) {
+			t.Errorf("byte %d zeroed, still verified", i)
+		}
+	}
+}
+
+func TestNak(t *testing.T) {
+	seqs := []uint16{0, 1, 0x0102, 0xffff}
+	got, ok := decodeNak(encodeNak(seqs))
+	if !ok || fmt.Sprint(got) != fmt.Sprint(seqs) {
+		t.Errorf("got %v (%v), expected %v", got, ok, seqs)
+	}
+	if _, ok := decodeNak([]byte{1, 2, 3}); ok {
+		t.Error("a NAK with half a seq decoded")
+	}
+	if _, ok := decodeNak(make([]byte, 2*maxNak+2)); ok {
+		t.Error("a NAK with more than maxNak seqs decoded")
+	}
+}
+
+func TestPacketMarshal(t *testing.T) {
+	for _, flag := range allFlags() {
+		want := Packet{Header: Header{Dest: 'b', Src: 'a', Seq: 0x1234, Epoch: 0xbeef, Flag: flag}, Data: []byte("some data")}
+		if hasSize(flag) {
+			want.Size = 512
+		}
+		raw, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatalf("flag %08b: %v", flag, err)
+		}
+		if !bytes.Equal(raw, Encode('b', 'a', 0x1234, 0xbeef, flag, 512, want.Data)) {
+			t.Errorf("flag %08b: encoded differently from Encode", flag)
+		}
+		var got Packet
+		if err := got.UnmarshalBinary(raw); err != nil {
+			t.Fatalf("flag %08b: %v", flag, err)
+		}
+		if got.Header != want.Header || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("got %v, expected %v", got, want)
+		}
+		// the data is copied, raw can be reused
+		raw[len(raw)-3] ^= 0xff
+		if !bytes.Equal(got.Data, want.Data) {
+			t.Error("Data points into what it was decoded from")
+		}
+	}
+
+	if _, err := (Packet{Data: make([]byte, 0x10000)}).MarshalBinary(); err != ErrTooLarge {
+		t.Errorf("more data than a packet can hold: %v", err)
+	}
+	if _, err := (Packet{Header: Header{Flag: START | OPTIONS}}).MarshalBinary(); err == nil {
+		t.Error("a packet with the options bit in Flag was encoded")
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	raw := Encode('b', 'a', 1, 2, START, 3, []byte{1})
+	badChecksum := bytes.Clone(raw)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+	badOptions := withOptionsBit([]byte{1})
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		err     DecodeError
+		corrupt bool
+	}{
+		{"short", raw[:5], ErrShort, true},
+		{"truncated", raw[:9], ErrTruncated, true},
+		{"options", badOptions, ErrOptions, false},
+		{"checksum", badChecksum, ErrChecksum, false},
+	}
+	for _, tt := range tests {
+		var p Packet
+		err := p.UnmarshalBinary(tt.raw)
+		var de DecodeError
+		if !errors.As(err, &de) || de != tt.err {
+			t.Errorf("%s: got %v, expected %v", tt.name, err, tt.err)
+			continue
+		}
+		if de.Corrupt() != tt.corrupt {
+			t.Errorf("%s: corrupt %v, expected %v", tt.name, de.Corrupt(), tt.corrupt)
+		}
+		// Decode says the same, just less
+		corrupt, valid, _, _, _, _, _, _, _ := Decode(tt.raw)
+		if corrupt != tt.corrupt || valid {
+			t.Errorf("%s: Decode gave corrupt %v, valid %v", tt.name, corrupt, valid)
+		}
+	}
+
+	// with a bad checksum all of it is still there, the forwarder routes by it
+	var p Packet
+	p.UnmarshalBinary(badChecksum)
+	if want := (Header{Dest: 'b', Src: 'a', Seq: 1, Epoch: 2, Flag: START, Size: 3}); p.Header != want || !bytes.Equal(p.Data, []byte{1}) {
+		t.Errorf("got %v with a bad checksum, expected %v", p, want)
+	}
+}
+
+func TestFlagHelpers(t *testing.T) {
+	tests := []struct {
+		p    Packet
+		want string
+	}{
+		{Packet{Header: Header{Flag: START}}, "IsStart HasSize"},
+		{Packet{Header: Header{Flag: ACCEPT | DONE}}, "HasAck IsDone HasSize"},
+		{Packet{Header: Header{Flag: IGNORE}}, "IsIgnore"},
+		{Packet{Header: Header{Flag: FAILURE}}, "IsFailure"},
+		{Packet{Header: Header{Flag: FAILURE}, Data: encodeNak([]uint16{1})}, "IsFailure IsNak"},
+		{Packet{Header: Header{Flag: FIN | ACCEPT}}, "HasAck IsFin HasSize"},
+		{Packet{Header: Header{Flag: RESET}}, "IsFailure IsFin IsReset"},
+		{Packet{}, ""},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, h := range []struct {
+			name string
+			is   bool
+		}{
+			{"IsStart", tt.p.IsStart()}, {"HasAck", tt.p.HasAck()}, {"IsIgnore", tt.p.IsIgnore()},
+			{"IsFailure", tt.p.IsFailure()}, {"IsDone", tt.p.IsDone()}, {"IsFin", tt.p.IsFin()},
+			{"IsReset", tt.p.IsReset()}, {"IsNak", tt.p.IsNak()}, {"HasSize", tt.p.HasSize()},
+		} {
+			if h.is {
+				got = append(got, h.name)
+			}
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: got %q, expected %q", FmtFlags(tt.p.Flag), strings.Join(got, " "), tt.want)
+		}
+	}
+}
+
+func TestPacketString(t *testing.T) {
+	p := Packet{Header: Header{Dest: 'b', Src: 'a', Seq: 3, Epoch: 1041, Flag: ACCEPT | DONE, Size: 512}, Data: []byte{1, 2}}
+	if got, want := p.String(), "a->b ACCEPT|DONE seq=3 epoch=1041 size=512 data=2"; got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+	if got, want := fmt.Sprint(p.Header), "a->b ACCEPT|DONE seq=3 epoch=1041 size=512"; got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+}
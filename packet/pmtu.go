@@ -0,0 +1,169 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Send with a window of 0 picks the segment size itself, from the path MTU - the largest
+// packet that makes it all the way to the peer. It starts out assuming any packet does, and
+// a forwarder that has to drop one for being too big sends back a FAILURE with an MTU option
+// saying how big they can be (like ICMP's "fragmentation needed"), Send then starts over with
+// segments that fit. That's remembered for the next transfer to the same peer, for a while -
+// after pmtuTimeout the largest size is tried again, in case the path got better.
+//
+// A forwarder can also be one that doesn't say anything (or a peer from before options, that
+// throws the FAILURE away as invalid), then the segments just never arrive. But a round that
+// gets nothing acknowledged can just as well be loss, so before Send gives up on it, it probes
+// the path (see probeSize) - only if a probe as big as its packets is lost while an empty one
+// gets through does the next round try half the size
+
+// what a data packet needs on top of its data, with padding and timestamps:
+// dest, src, seq, epoch, flag, padding, options length, timestamps and checksum
+const segmentOverhead = 1 + 1 + 2 + 2 + 1 + 1 + 1 + 10 + 2
+
+// how long a path MTU is remembered for, like RFC 1191
+const pmtuTimeout = 10 * time.Minute
+
+// halving the segments for a path that's a black hole for them stops here
+const minPMTU = 256
+
+type pmtu struct {
+	mtu int
+	at  time.Time
+}
+
+// {us, them} -> the largest packet that made it through
+var (
+	pmtusM sync.Mutex
+	pmtus  = make(map[[2]byte]pmtu)
+)
+
+// PathMTU is the largest packet Send found that it can send from src to peer, false if it
+// hasn't found anything (or it's been too long) and would try the largest there is
+func PathMTU(src byte, peer byte) (mtu int, ok bool) {
+	pmtusM.Lock()
+	defer pmtusM.Unlock()
+	p, ok := pmtus[[2]byte{src, peer}]
+	if !ok || since(p.at) > pmtuTimeout {
+		return MaxSize, false
+	}
+	return p.mtu, true
+}
+
+// lowerPathMTU makes the path MTU to peer mtu, if that's lower than what it was
+func lowerPathMTU(src byte, peer byte, mtu int) {
+	cur, _ := PathMTU(src, peer)
+	pmtusM.Lock()
+	pmtus[[2]byte{src, peer}] = pmtu{min(cur, mtu), now()}
+	pmtusM.Unlock()
+}
+
+// ResetPathMTUs forgets what Send found out about every path, e.g. between runs that aren't
+// over the same network
+func ResetPathMTUs() {
+	pmtusM.Lock()
+	pmtus = make(map[[2]byte]pmtu)
+	pmtusM.Unlock()
+}
+
+// probeSize sends dest two keepalive probes (see keepalive.go), one padded to mtu bytes (or
+// as close as a packet's data gets) and one empty, and waits up to 2 seconds for the answers. If the empty one is answered but the
+// big one isn't, packets of mtu bytes don't make it to dest and the path MTU is halved - if
+// both are (or neither is) it's loss, or dest is gone, and it stays what it was
+func probeSize(c net.Conn, src byte, dest byte, mtu int) error {
+	if mtu <= minPMTU {
+		return nil
+	}
+	epoch := nextEpoch()
+	empty := Encode(dest, src, 0, epoch, probe, 0, []byte{})
+	big := Encode(dest, src, 1, epoch, probe, 0, make([]byte, min(max(mtu-len(empty), 0), 0xffff)))
+	if debugEnabled() {
+		logger.Debug("Send(4F): nothing acknowledged, probing the path", "mtu", mtu)
+	}
+	c.Write(big)
+	c.Write(empty)
+
+	bp := getBuffer()
+	defer putBuffer(bp)
+	buffer := *bp
+	var p Packet
+	var answered [2]bool
+	deadline := now().Add(2 * time.Second)
+	for !answered[1] {
+		c.SetReadDeadline(deadline)
+		n, err := c.Read(buffer)
+		c.SetReadDeadline(time.Time{})
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return err
+		}
+		if p.UnmarshalBinary(buffer[:n]) != nil || p.Dest != src {
+			continue
+		}
+		heard(src, p.Src)
+		if answerProbe(c, src, p.Header) {
+			continue
+		}
+		if p.Src != dest || p.Epoch != epoch {
+			if p.IsStart() && !p.IsDone() {
+				hold(src, p.Header, buffer[:n])
+			}
+			continue
+		}
+		if too, ok := p.MTU(); ok {
+			// the forwarder said so after all
+			lowerPathMTU(src, dest, too)
+			return nil
+		}
+		if p.Flag == ACCEPT|DONE && p.Seq <= 1 {
+			answered[p.Seq] = true
+		}
+	}
+	if answered[0] && !answered[1] {
+		lower := max(mtu/2, minPMTU)
+		logger.Debug("Send(4F): only the empty probe got through, trying smaller segments", "mtu", lower)
+		lowerPathMTU(src, dest, lower)
+	}
+	return nil
+}
+
+// segmentSize is the window for packets of at most mtu bytes, 0 if not even one byte of data fits
+func segmentSize(mtu int) uint16 {
+	return uint16(min(max(mtu-segmentOverhead, 0), 0xffff))
+}
+
+// TooBig is what a forwarder sends back for a packet with header h that is bigger than mtu:
+// a FAILURE with the same seq and epoch, from the one it was meant for
+func TooBig(h Header, mtu int) Packet {
+	return Packet{
+		Header:  Header{Dest: h.Src, Src: h.Dest, Seq: h.Seq, Epoch: h.Epoch, Flag: FAILURE},
+		Options: AppendOption(nil, OptMTU, byte(min(mtu, 0xffff)), byte(min(mtu, 0xffff)>>8)),
+	}
+}
+
+// MTU is what a packet from TooBig says the MTU is, false if p isn't one of those
+func (p Packet) MTU() (mtu int, ok bool) {
+	v, ok := p.Option(OptMTU)
+	if !ok || len(v) != 2 || p.Flag != FAILURE {
+		return 0, false
+	}
+	return int(binary.LittleEndian.Uint16(v)), true
+}
+
+// TooBigError is returned by Send when its segments are bigger than the path to Peer takes,
+// and it can't make them smaller - the window was picked by the caller, or MTU doesn't have
+// room for any data
+type TooBigError struct {
+	Peer byte
+	MTU  int
+}
+
+func (e *TooBigError) Error() string {
+	return fmt.Sprintf("Packets to <%c> can be at most %d bytes, segments have to be smaller", e.Peer, e.MTU)
+}
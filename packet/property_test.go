@@ -0,0 +1,325 @@
+package packet
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// properties of the wire format that have to hold for any header and data, checked on random
+// ones - a failure is shrunk (fields towards 0, flags cleared, options and data dropped) till nothing
+// smaller fails, so what's reported is the simplest packet that breaks it. testing/quick
+// can't shrink, hence the little harness at the bottom
+//
+//	go test ./packet -run Property -args -seed 1234 -cases 100000
+
+var (
+	propertySeed  = flag.Int64("seed", 0, "seed for the property tests, 0 picks one")
+	propertyCases = flag.Int("cases", 2000, "random cases per property")
+)
+
+type header struct {
+	dest, src  byte
+	seq, epoch uint16
+	flag       byte
+	size       uint16
+	// the options area without its length byte, see options.go
+	opts []byte
+	data []byte
+}
+
+func (h header) String() string {
+	data := fmt.Sprintf("% x", h.data)
+	if len(h.data) > 16 {
+		data = fmt.Sprintf("% x ... (%d bytes)", h.data[:16], len(h.data))
+	}
+	opts := ""
+	if len(h.opts) > 0 {
+		opts = fmt.Sprintf(" options [% x]", h.opts)
+	}
+	return fmt.Sprintf("dest %#x src %#x seq %d epoch %d flags %s size %d%s data [%s]",
+		h.dest, h.src, h.seq, h.epoch, FmtFlags(h.flag), h.size, opts, data)
+}
+
+func (h header) packet() Packet {
+	return Packet{Header: Header{h.dest, h.src, h.seq, h.epoch, h.flag, h.size}, Options: h.opts, Data: h.data}
+}
+
+// encode goes through MarshalBinary, Encode can't make packets with options - generate only
+// makes headers it takes
+func (h header) encode() []byte {
+	raw, err := h.packet().MarshalBinary()
+	if err != nil {
+		panic(fmt.Sprintf("%v: %v", h, err))
+	}
+	return raw
+}
+
+func TestPropertyRoundTrip(t *testing.T) {
+	check(t, func(h header) error {
+		raw := h.encode()
+		want := h
+		if h.flag&(START|ACCEPT|DONE) == 0 {
+			// there's no size field to carry it
+			want.size = 0
+		}
+		var p Packet
+		if err := p.UnmarshalBinary(raw); err != nil {
+			return err
+		}
+		got := header{p.Dest, p.Src, p.Seq, p.Epoch, p.Flag, p.Size, p.Options, p.Data}
+		if got.String() != want.String() || !bytes.Equal(got.opts, want.opts) || !bytes.Equal(got.data, want.data) {
+			return fmt.Errorf("decoded as %v", got)
+		}
+
+		// Decode skips the options, otherwise it's the same
+		corrupt, valid, dest, src, seq, epoch, flag, size, data := Decode(raw)
+		if corrupt || !valid {
+			return fmt.Errorf("corrupt %v, valid %v", corrupt, valid)
+		}
+		want.opts = nil
+		got = header{dest, src, seq, epoch, flag, size, nil, data}
+		if got.String() != want.String() || !bytes.Equal(got.data, want.data) {
+			return fmt.Errorf("Decode gave %v", got)
+		}
+		// and without options Encode makes the same packet
+		if len(h.opts) == 0 && !bytes.Equal(raw, Encode(h.dest, h.src, h.seq, h.epoch, h.flag, h.size, h.data)) {
+			return fmt.Errorf("Encode and MarshalBinary differ")
+		}
+		return nil
+	})
+}
+
+func TestPropertyAligned(t *testing.T) {
+	check(t, func(h header) error {
+		if raw := h.encode(); len(raw)%2 != 0 {
+			return fmt.Errorf("%d bytes", len(raw))
+		}
+		return nil
+	})
+}
+
+func TestPropertyBitFlip(t *testing.T) {
+	check(t, func(h header) error {
+		raw := h.encode()
+		for _, bit := range flipBits(raw) {
+			flipped := append([]byte{}, raw...)
+			flipped[bit/8] ^= 1 << (bit % 8)
+			if corrupt, valid, _, _, _, _, _, _, _ := Decode(flipped); !corrupt && valid {
+				return fmt.Errorf("bit %d (byte %d) flipped, still a valid packet", bit, bit/8)
+			}
+		}
+		return nil
+	})
+}
+
+// flipBits is every bit of a small packet, for a big one every bit of the header and
+// checksum and a sample of the data - always the same ones for the same packet, so shrinking
+// sees the same failure
+func flipBits(raw []byte) []int {
+	if len(raw) <= 64 {
+		bits := make([]int, 8*len(raw))
+		for i := range bits {
+			bits[i] = i
+		}
+		return bits
+	}
+	var bits []int
+	for i := 0; i < 8*12; i++ {
+		bits = append(bits, i)
+	}
+	for i := 8 * (len(raw) - 2); i < 8*len(raw); i++ {
+		bits = append(bits, i)
+	}
+	r := rand.New(rand.NewSource(int64(len(raw))))
+	for i := 0; i < 64; i++ {
+		bits = append(bits, 8*12+r.Intn(8*(len(raw)-14)))
+	}
+	return bits
+}
+
+// the harness should find the smallest counterexample of a property that's wrong on purpose
+func TestShrink(t *testing.T) {
+	prop := func(h header) error {
+		if len(h.data) >= 10 && h.flag&DONE > 0 {
+			return fmt.Errorf("%d bytes", len(h.data))
+		}
+		return nil
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		h := generate(r)
+		if prop(h) == nil {
+			continue
+		}
+		small, _ := shrink(h, prop)
+		want := header{flag: DONE, data: make([]byte, 10)}
+		if small.String() != want.String() {
+			t.Fatalf("%v shrunk to %v, expected %v", h, small, want)
+		}
+		return
+	}
+	t.Fatal("no counterexample was generated")
+}
+
+// ------------------------
+
+// check runs prop on random headers, and reports the first failure after shrinking it
+func check(t *testing.T, prop func(h header) error) {
+	t.Helper()
+	seed := *propertySeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	cases := *propertyCases
+	if testing.Short() {
+		cases /= 10
+	}
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < cases; i++ {
+		h := generate(r)
+		if err := prop(h); err != nil {
+			small, err := shrink(h, prop)
+			t.Fatalf("case %d: %v\n\tgenerated: %v\n\tshrunk to: %v\n\t(-seed %d)", i, err, h, small, seed)
+		}
+	}
+}
+
+// generate makes a random header, with the values where things tend to break (0, the
+// largest, a single bit) more often than they'd come up by chance
+func generate(r *rand.Rand) header {
+	u16 := func() uint16 {
+		switch r.Intn(4) {
+		case 0:
+			return 0
+		case 1:
+			return 0xffff
+		case 2:
+			return 1 << r.Intn(16)
+		}
+		return uint16(r.Intn(0x10000))
+	}
+	h := header{
+		dest:  byte(r.Intn(256)),
+		src:   byte(r.Intn(256)),
+		seq:   u16(),
+		epoch: u16(),
+		// any of the six flags, the other two bits are OPTIONS and padding - MarshalBinary
+		// sets those itself
+		flag: byte(r.Intn(64)) << 2,
+		size: u16(),
+	}
+	// a third of them get options, the ones there are and ones nobody knows
+	if r.Intn(3) == 0 {
+		for i := r.Intn(4); i >= 0; i-- {
+			value := make([]byte, r.Intn(32))
+			kind := byte(4 + r.Intn(252))
+			switch r.Intn(4) {
+			case 0:
+				kind, value = OptVersion, make([]byte, 1)
+			case 1:
+				kind, value = OptTimestamps, make([]byte, 8)
+			case 2:
+				kind, value = OptMTU, make([]byte, 2)
+			}
+			r.Read(value)
+			h.opts = AppendOption(h.opts, kind, value...)
+		}
+	}
+	var n int
+	switch r.Intn(50) {
+	case 0:
+		n = 0xffff
+	case 1:
+		n = r.Intn(0x10000)
+	default:
+		n = r.Intn(64)
+	}
+	h.data = make([]byte, n)
+	r.Read(h.data)
+	return h
+}
+
+// shrink keeps going to a smaller header that still fails till there is none
+func shrink(h header, prop func(h header) error) (header, error) {
+	err := prop(h)
+again:
+	for _, c := range smaller(h) {
+		if e := prop(c); e != nil {
+			h, err = c, e
+			goto again
+		}
+	}
+	return h, err
+}
+
+// smaller is every header that is one step simpler than h
+func smaller(h header) (hs []header) {
+	u16 := func(v uint16, set func(*header, uint16)) {
+		for _, s := range []uint16{0, v / 2, v - 1} {
+			if v != 0 && s < v {
+				c := h
+				set(&c, s)
+				hs = append(hs, c)
+			}
+		}
+	}
+	u8 := func(v byte, set func(*header, byte)) {
+		for _, s := range []byte{0, v / 2, v - 1} {
+			if v != 0 && s < v {
+				c := h
+				set(&c, s)
+				hs = append(hs, c)
+			}
+		}
+	}
+	data := func(d []byte) {
+		c := h
+		c.data = d
+		hs = append(hs, c)
+	}
+
+	// without the options, or without one of them
+	if len(h.opts) > 0 {
+		c := h
+		c.opts = nil
+		hs = append(hs, c)
+		for o := 0; o < len(h.opts); o += 2 + int(h.opts[o+1]) {
+			c := h
+			c.opts = append(append([]byte{}, h.opts[:o]...), h.opts[o+2+int(h.opts[o+1]):]...)
+			hs = append(hs, c)
+		}
+	}
+	if n := len(h.data); n > 0 {
+		data(nil)
+		data(h.data[:n/2])
+		data(h.data[n/2:])
+		data(h.data[:n-1])
+		data(h.data[1:])
+		if n <= 64 {
+			for i, b := range h.data {
+				if b != 0 {
+					d := append([]byte{}, h.data...)
+					d[i] = 0
+					data(d)
+				}
+			}
+		}
+	}
+	for bit := byte(0b10000000); bit > 0b00000010; bit >>= 1 {
+		if h.flag&bit > 0 {
+			c := h
+			c.flag &^= bit
+			hs = append(hs, c)
+		}
+	}
+	u8(h.dest, func(c *header, v byte) { c.dest = v })
+	u8(h.src, func(c *header, v byte) { c.src = v })
+	u16(h.seq, func(c *header, v uint16) { c.seq = v })
+	u16(h.epoch, func(c *header, v uint16) { c.epoch = v })
+	u16(h.size, func(c *header, v uint16) { c.size = v })
+	return
+}
@@ -0,0 +1,103 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// a stream is a row of transfers, every one of them starts with the chunk's index (u32) so
+// the receiver can tell a chunk it already has from the next one - Send starts over when a
+// DONE is lost, which would otherwise write the same chunk twice. A chunk with nothing but
+// the index means the stream is over
+const chunkHeader = 4
+
+// segments per chunk, a chunk is what's kept in memory on either side
+const chunkSegments = 64
+
+// SendStream sends everything read from r till io.EOF, in chunks of up to 64 segments of window
+// bytes - only one chunk is kept in memory at once, so there's no limit on how much can be sent.
+// With a window of 0 Send picks the segment size, and chunks are 64 of what the path MTU to
+// dest allows when the stream starts. n is how many bytes of r the receiver has confirmed
+func SendStream(c net.Conn, src byte, dest byte, r io.Reader, window uint16, tolerance uint16) (n int64, e error) {
+	segment := window
+	if window == 0 {
+		mtu, _ := PathMTU(src, dest)
+		if segment = segmentSize(mtu); segment == 0 {
+			e = &TooBigError{Peer: dest, MTU: mtu}
+			return
+		}
+	}
+	chunk := make([]byte, int(segment)*chunkSegments)
+	var index uint32 = 0
+	for {
+		binary.LittleEndian.PutUint32(chunk, index)
+		k, err := io.ReadFull(r, chunk[chunkHeader:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			e = err
+			return
+		}
+		if k > 0 {
+			if e = Send(c, src, dest, chunk[:chunkHeader+k], window, tolerance); e != nil {
+				return
+			}
+			n += int64(k)
+			index++
+		}
+		if err != nil {
+			break
+		}
+	}
+	// the end of the stream, just the header
+	binary.LittleEndian.PutUint32(chunk, index)
+	e = Send(c, src, dest, chunk[:chunkHeader], window, tolerance)
+	return
+}
+
+// RecvStream is the complimentary wrapper to SendStream, it writes every chunk to w as soon
+// as it has it and returns when the stream is over. wait is used like in Recv, for every chunk
+func RecvStream(c net.Conn, src byte, w io.Writer, wait uint8) (n int64, srcR byte, e error) {
+	var index uint32 = 0
+	for {
+		data, from, err := Recv(c, src, wait)
+		if err != nil {
+			e = err
+			return
+		}
+		if index > 0 && from != srcR {
+			// it's already been told DONE, so it thinks it got through
+			logger.Warn("transfer from someone else in the middle of a stream, discarding",
+				"src", string(rune(src)), "stream", string(rune(srcR)), "from", string(rune(from)))
+			discarded.With("other").Inc()
+			continue
+		}
+		if len(data) < chunkHeader {
+			e = errors.New("Received a transfer that isn't part of a stream")
+			return
+		}
+		srcR = from
+		i := binary.LittleEndian.Uint32(data)
+		if i < index {
+			// Send started over after the DONE for it was lost
+			logger.Debug("RecvStream: chunk received twice, discarding", "index", i, "expected", index)
+			discarded.With("duplicate").Inc()
+			continue
+		}
+		if i > index {
+			e = fmt.Errorf("Stream is missing chunks, expected %d but got %d", index, i)
+			return
+		}
+		if len(data) == chunkHeader {
+			return
+		}
+		k, err := w.Write(data[chunkHeader:])
+		n += int64(k)
+		if err != nil {
+			e = err
+			return
+		}
+		index++
+	}
+}
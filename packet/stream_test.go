@@ -0,0 +1,131 @@
+package packet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"handin2/packet"
+	"net"
+	"testing"
+)
+
+func sendStream(c net.Conn, src byte, dest byte, data []byte, window uint16) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		n, err := packet.SendStream(c, src, dest, bytes.NewReader(data), window, 3)
+		if err == nil && n != int64(len(data)) {
+			err = fmt.Errorf("SendStream sent %d of %d bytes", n, len(data))
+		}
+		done <- err
+	}()
+	return done
+}
+
+// chunk is what the peer got in one transfer of a stream, checked against the index it should have
+func (p *peer) chunk(index uint32) []byte {
+	p.t.Helper()
+	start := p.readFlag(packet.START)
+	p.accept(start)
+	got := p.receive(start, nil)
+	if len(got) < 4 || binary.LittleEndian.Uint32(got) != index {
+		p.t.Fatalf("peer: expected chunk %d, got %x", index, got)
+	}
+	return got[4:]
+}
+
+// transfer plays the sender for data in one segment, up to the DONE
+func (p *peer) transfer(dest byte, src byte, data []byte) {
+	p.t.Helper()
+	epoch := newEpoch()
+	p.write(segment{dest, src, 1, epoch, packet.START, uint16(len(data)), nil})
+	p.readFlag(packet.ACCEPT)
+	p.write(segment{dest, src, 0, epoch, packet.EMPTY, 0, data})
+	p.readFlag(packet.DONE)
+}
+
+func chunkOf(index uint32, data string) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, index), data...)
+}
+
+// 64 segments of 4 bytes to a chunk, the index included - 600 bytes is two whole ones, a
+// bit and the end
+func TestSendStreamChunks(t *testing.T) {
+	_, c, p := setup(t)
+	data := make([]byte, 600)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	done := sendStream(c, 'c', 'd', data, 4)
+
+	var got []byte
+	for i, size := range []int{252, 252, 96} {
+		chunk := p.chunk(uint32(i))
+		if len(chunk) != size {
+			t.Fatalf("chunk %d has %d bytes, expected %d", i, len(chunk), size)
+		}
+		got = append(got, chunk...)
+	}
+	if end := p.chunk(3); len(end) != 0 {
+		t.Fatalf("expected the end of the stream, got %d more bytes", len(end))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("the peer didn't get what was sent")
+	}
+}
+
+// a stream with nothing in it is still ended, by chunk 0
+func TestSendStreamEmpty(t *testing.T) {
+	_, c, p := setup(t)
+	done := sendStream(c, 'e', 'f', nil, 8)
+	if end := p.chunk(0); len(end) != 0 {
+		t.Fatalf("expected the end of the stream, got %d bytes", len(end))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type streamed struct {
+	data []byte
+	n    int64
+	from byte
+	err  error
+}
+
+func recvStream(c net.Conn, src byte) <-chan streamed {
+	done := make(chan streamed, 1)
+	go func() {
+		var w bytes.Buffer
+		n, from, err := packet.RecvStream(c, src, &w, 0)
+		done <- streamed{w.Bytes(), n, from, err}
+	}()
+	return done
+}
+
+// the DONE for chunk 0 is lost, so the sender starts over and sends it again - it's only written once
+func TestRecvStreamDuplicate(t *testing.T) {
+	_, c, p := setup(t)
+	done := recvStream(c, 'g')
+
+	p.transfer('g', 'h', chunkOf(0, "hello "))
+	p.transfer('g', 'h', chunkOf(0, "hello "))
+	p.transfer('g', 'h', chunkOf(1, "there"))
+	p.transfer('g', 'h', chunkOf(2, ""))
+	r := <-done
+	if r.err != nil || string(r.data) != "hello there" || r.n != 11 || r.from != 'h' {
+		t.Fatalf("got %q (%d bytes) from %c, %v", r.data, r.n, r.from, r.err)
+	}
+}
+
+func TestRecvStreamEmpty(t *testing.T) {
+	_, c, p := setup(t)
+	done := recvStream(c, 'i')
+
+	p.transfer('i', 'j', chunkOf(0, ""))
+	if r := <-done; r.err != nil || len(r.data) != 0 || r.n != 0 || r.from != 'j' {
+		t.Fatalf("got %q (%d bytes) from %c, %v", r.data, r.n, r.from, r.err)
+	}
+}
@@ -0,0 +1,885 @@
+package packet_test
+
+import (
+	"bytes"
+	"errors"
+	"handin2/clock"
+	"handin2/forwarder"
+	"handin2/packet"
+	"handin2/sim"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send and Recv are tested against a peer that the test scripts packet by packet, over an
+// in-memory pipe, with a virtual clock that only moves when the test says so - a timeout
+// is clk.BlockUntil(1) (Send or Recv is waiting on its deadline) and then clk.Advance
+
+type segment struct {
+	dest, src byte
+	seq       uint16
+	epoch     uint16
+	flag      byte
+	size      uint16
+	data      []byte
+}
+
+func (s segment) encode() []byte {
+	return packet.Encode(s.dest, s.src, s.seq, s.epoch, s.flag, s.size, s.data)
+}
+
+// Recv remembers the last round it finished with every peer, so every test (and every run of
+// it, with -count) needs rounds of its own
+var epochs uint16
+
+func newEpoch() uint16 {
+	epochs += 1000
+	return epochs
+}
+
+type peer struct {
+	t *testing.T
+	c *packet.Conn
+}
+
+// read fails the test if what comes in doesn't decode
+func (p *peer) read() segment {
+	p.t.Helper()
+	buf := make([]byte, packet.MaxSize)
+	n, err := p.c.Read(buf)
+	if err != nil {
+		p.t.Fatalf("peer: %v", err)
+	}
+	corrupt, valid, dest, src, seq, epoch, flag, size, data := packet.Decode(buf[:n])
+	if corrupt || !valid {
+		p.t.Fatalf("peer: got a corrupt packet % x", buf[:n])
+	}
+	return segment{dest, src, seq, epoch, flag, size, data}
+}
+
+// readFlag skips over everything till a packet with exactly flag comes
+func (p *peer) readFlag(flag byte) segment {
+	p.t.Helper()
+	for {
+		if s := p.read(); s.flag == flag {
+			return s
+		}
+	}
+}
+
+func (p *peer) write(s segment) {
+	p.c.Write(s.encode())
+}
+
+func setup(t *testing.T) (*clock.Virtual, *packet.Conn, *peer) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	packet.SetClock(clk)
+	a, b := sim.Pipe(clk, "under test", "peer")
+	// everything here takes a moment of real time, if Send or Recv get stuck on a bug the
+	// pipe is closed so the test fails instead of hanging
+	watchdog := time.AfterFunc(10*time.Second, func() {
+		a.Close()
+		b.Close()
+	})
+	t.Cleanup(func() {
+		watchdog.Stop()
+		a.Close()
+		b.Close()
+		packet.SetClock(nil)
+	})
+	return clk, packet.NewConn(a), &peer{t: t, c: packet.NewConn(b)}
+}
+
+func send(c net.Conn, src byte, dest byte, data []byte, window uint16, tolerance uint16) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- packet.Send(c, src, dest, data, window, tolerance) }()
+	return done
+}
+
+type received struct {
+	data []byte
+	from byte
+	err  error
+}
+
+func recv(c net.Conn, src byte, wait uint8) <-chan received {
+	done := make(chan received, 1)
+	go func() {
+		data, from, err := packet.Recv(c, src, wait)
+		done <- received{data, from, err}
+	}()
+	return done
+}
+
+// receive plays the receiver for the round start began: ACCEPT, an ack for every data
+// segment, DONE once it has all of them - got is what it had before, it can be nil
+func (p *peer) receive(start segment, got map[uint16][]byte) []byte {
+	p.t.Helper()
+	if got == nil {
+		got = make(map[uint16][]byte)
+	}
+	var cum uint16
+	for got[cum] != nil {
+		cum++
+	}
+	for cum < start.seq {
+		s := p.read()
+		if s.flag != packet.EMPTY || s.epoch != start.epoch {
+			p.t.Fatalf("peer: expected data of epoch %d, got flag %08b epoch %d", start.epoch, s.flag, s.epoch)
+		}
+		got[s.seq] = s.data
+		for got[cum] != nil {
+			cum++
+		}
+		if cum < start.seq {
+			p.write(segment{start.src, start.dest, cum, start.epoch, packet.ACCEPT, 0, nil})
+		}
+	}
+	p.write(segment{start.src, start.dest, start.seq, start.epoch, packet.DONE, start.size, nil})
+	var data []byte
+	for i := uint16(0); i < start.seq; i++ {
+		data = append(data, got[i]...)
+	}
+	return data
+}
+
+func (p *peer) accept(start segment) {
+	p.write(segment{start.src, start.dest, start.seq, start.epoch, packet.ACCEPT, start.size, nil})
+}
+
+func TestSend(t *testing.T) {
+	_, c, p := setup(t)
+	data := []byte("hello there, this is more than one window")
+	done := send(c, 'a', 'b', data, 8, 3)
+
+	start := p.readFlag(packet.START)
+	if start.dest != 'b' || start.src != 'a' || start.seq != 6 || start.size != 8 {
+		t.Fatalf("START: %+v", start)
+	}
+	p.accept(start)
+	if got := p.receive(start, nil); !bytes.Equal(got, data) {
+		t.Errorf("peer got %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendIgnored(t *testing.T) {
+	_, c, p := setup(t)
+	done := send(c, 'a', 'b', []byte("hello"), 8, 3)
+
+	start := p.readFlag(packet.START)
+	p.write(segment{'a', 'b', start.seq, start.epoch, packet.IGNORE, 0, nil})
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "not accepting") {
+		t.Errorf("expected Send to give up, got %v", err)
+	}
+}
+
+func TestSendStartTimeout(t *testing.T) {
+	clk, c, p := setup(t)
+	data := []byte("hello")
+	done := send(c, 'a', 'b', data, 8, 3)
+
+	first := p.readFlag(packet.START)
+	// no answer, Send starts over with a new round once its deadline is up
+	clk.BlockUntil(1)
+	clk.Advance(2 * time.Second)
+	second := p.readFlag(packet.START)
+	if second.epoch == first.epoch {
+		t.Errorf("the START after the timeout has the same epoch (%d)", first.epoch)
+	}
+	// the ACCEPT for the first round shows up late, it's thrown away
+	p.accept(first)
+	p.accept(second)
+	if got := p.receive(second, nil); !bytes.Equal(got, data) {
+		t.Errorf("peer got %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendTolerance(t *testing.T) {
+	clk, c, p := setup(t)
+	const tolerance = 2
+	done := send(c, 'a', 'b', []byte("hello"), 8, tolerance)
+
+	for i := 0; i < tolerance+1; i++ {
+		p.readFlag(packet.START)
+		clk.BlockUntil(1)
+		clk.Advance(2 * time.Second)
+	}
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "tolerance") {
+		t.Errorf("expected Send to give up after %d STARTs, got %v", tolerance+1, err)
+	}
+}
+
+func TestSendCorruptAccept(t *testing.T) {
+	_, c, p := setup(t)
+	data := []byte("hello")
+	done := send(c, 'a', 'b', data, 8, 3)
+
+	first := p.readFlag(packet.START)
+	accept := segment{'a', 'b', first.seq, first.epoch, packet.ACCEPT, first.size, nil}.encode()
+	accept[2] ^= 0x40
+	p.c.Write(accept)
+	// no timeout, a corrupt answer to START makes Send start over right away
+	second := p.readFlag(packet.START)
+	if second.epoch == first.epoch {
+		t.Errorf("the START after the corrupt ACCEPT has the same epoch (%d)", first.epoch)
+	}
+	p.accept(second)
+	p.receive(second, nil)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendFailure(t *testing.T) {
+	_, c, p := setup(t)
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	done := send(c, 'a', 'b', data, 10, 3)
+
+	first := p.readFlag(packet.START)
+	p.accept(first)
+	p.readFlag(packet.EMPTY)
+	// FAILURE without data, the receiver wants the whole thing again
+	p.write(segment{'a', 'b', first.seq, first.epoch, packet.FAILURE, 0, nil})
+	second := p.readFlag(packet.START)
+	if second.epoch == first.epoch {
+		t.Errorf("the START after FAILURE has the same epoch (%d)", first.epoch)
+	}
+	p.accept(second)
+	if got := p.receive(second, nil); !bytes.Equal(got, data) {
+		t.Errorf("peer got %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendNak(t *testing.T) {
+	_, c, p := setup(t)
+	data := bytes.Repeat([]byte("0123456789"), 4)
+	done := send(c, 'a', 'b', data, 10, 3)
+
+	start := p.readFlag(packet.START)
+	p.accept(start)
+	// the first window is two segments, the receiver asks for the first one again
+	got := make(map[uint16][]byte)
+	for i := 0; i < 2; i++ {
+		s := p.readFlag(packet.EMPTY)
+		got[s.seq] = s.data
+	}
+	delete(got, 0)
+	p.write(segment{'a', 'b', 0, start.epoch, packet.FAILURE, 0, []byte{0, 0}})
+	if s := p.read(); s.flag != packet.EMPTY || s.seq != 0 {
+		t.Fatalf("expected segment 0 again, got flag %08b seq %d", s.flag, s.seq)
+	} else {
+		got[0] = s.data
+	}
+	p.write(segment{'a', 'b', 2, start.epoch, packet.ACCEPT, 0, nil})
+	if got := p.receive(start, got); !bytes.Equal(got, data) {
+		t.Errorf("peer got %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// the peer's START for sending back overtakes its DONE: Send holds on to it, and the Recv after
+// it answers it straight away - without the peer having to time out and send it again
+func TestSendReorderedStart(t *testing.T) {
+	_, c, p := setup(t)
+	done := send(c, 'E', 'F', []byte("0---"), 4, 1)
+	start := p.readFlag(packet.START)
+	p.accept(start)
+	p.readFlag(packet.EMPTY)
+	epoch := newEpoch()
+	p.write(segment{'E', 'F', 1, epoch, packet.START, 4, nil})
+	p.write(segment{start.src, start.dest, start.seq, start.epoch, packet.DONE, start.size, nil})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	got := recv(c, 'E', 0)
+	if s := p.readFlag(packet.ACCEPT); s.epoch != epoch {
+		t.Fatalf("expected the held START to be accepted, got %+v", s)
+	}
+	p.write(segment{'E', 'F', 0, epoch, packet.EMPTY, 0, []byte("1---")})
+	p.readFlag(packet.DONE)
+	if r := <-got; r.err != nil || string(r.data) != "1---" || r.from != 'F' {
+		t.Errorf("got %q from %c, %v", r.data, r.from, r.err)
+	}
+}
+
+func TestRecvDuplicates(t *testing.T) {
+	clk, c, p := setup(t)
+	done := recv(c, 'd', 0)
+
+	epoch := newEpoch()
+	start := segment{'d', 'c', 3, epoch, packet.START, 4, nil}
+	p.write(start)
+	if s := p.read(); s.flag != packet.ACCEPT || s.seq != 3 || s.size != 4 || s.epoch != epoch {
+		t.Fatalf("expected ACCEPT, got %+v", s)
+	}
+	data := segment{'d', 'c', 0, epoch, packet.EMPTY, 0, nil}
+	for _, seq := range []uint16{1, 0, 0, 1} {
+		data.seq, data.data = seq, []byte{byte('0' + seq), '-', '-', '-'}
+		p.write(data)
+	}
+	p.write(start)
+	data.seq, data.data = 2, []byte("2---")
+	p.write(data)
+	p.write(data)
+
+	if s := p.readFlag(packet.DONE); s.seq != 3 || s.size != 4 || s.epoch != epoch {
+		t.Errorf("DONE: %+v", s)
+	}
+	r := <-done
+	if r.err != nil || r.from != 'c' || string(r.data) != "0---1---2---" {
+		t.Fatalf("got %q from %c, %v", r.data, r.from, r.err)
+	}
+
+	// the START that was duplicated on the way comes in after DONE, it isn't delivered again
+	p.write(start)
+	done = recv(c, 'd', 1)
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	r = <-done
+	var netErr net.Error
+	if !errors.As(r.err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected Recv to time out, got %q, %v", r.data, r.err)
+	}
+}
+
+// the DONE is lost, so the sender sends the last segment again - it gets the DONE again,
+// rather than starting over with a new round that would be delivered a second time
+func TestRecvDoneLost(t *testing.T) {
+	clk, c, p := setup(t)
+	done := recv(c, 'B', 0)
+
+	epoch := newEpoch()
+	p.write(segment{'B', 'A', 1, epoch, packet.START, 4, nil})
+	p.readFlag(packet.ACCEPT)
+	data := segment{'B', 'A', 0, epoch, packet.EMPTY, 0, []byte("0---")}
+	p.write(data)
+	p.readFlag(packet.DONE)
+	if r := <-done; r.err != nil || string(r.data) != "0---" {
+		t.Fatalf("got %q, %v", r.data, r.err)
+	}
+
+	done = recv(c, 'B', 1)
+	p.write(data)
+	if s := p.read(); s.flag != packet.DONE || s.seq != 1 || s.size != 4 || s.epoch != epoch {
+		t.Fatalf("expected DONE again, got %+v", s)
+	}
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	r := <-done
+	var netErr net.Error
+	if !errors.As(r.err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected Recv to time out, got %q, %v", r.data, r.err)
+	}
+}
+
+// a peer that restarted picks a new starting epoch at random, one just below the epoch of
+// the round it finished before is a new round all the same
+func TestRecvRestartedPeer(t *testing.T) {
+	_, c, p := setup(t)
+	for _, epoch := range []uint16{newEpoch(), epochs - 3} {
+		done := recv(c, 'D', 0)
+		p.write(segment{'D', 'C', 1, epoch, packet.START, 4, nil})
+		p.readFlag(packet.ACCEPT)
+		p.write(segment{'D', 'C', 0, epoch, packet.EMPTY, 0, []byte("0---")})
+		p.readFlag(packet.DONE)
+		if r := <-done; r.err != nil || string(r.data) != "0---" {
+			t.Fatalf("epoch %d: got %q, %v", epoch, r.data, r.err)
+		}
+	}
+}
+
+func TestRecvCorruptSegment(t *testing.T) {
+	_, c, p := setup(t)
+	done := recv(c, 'f', 0)
+
+	epoch := newEpoch()
+	start := segment{'f', 'e', 2, epoch, packet.START, 4, nil}
+	p.write(start)
+	p.readFlag(packet.ACCEPT)
+	corrupt := segment{'f', 'e', 0, epoch, packet.EMPTY, 0, []byte("0---")}.encode()
+	corrupt[9] ^= 0x01
+	p.c.Write(corrupt)
+	// the header still looks right, so it's asked for straight away
+	nak := p.read()
+	if nak.flag != packet.FAILURE || !bytes.Equal(nak.data, []byte{0, 0}) {
+		t.Fatalf("expected a NAK for segment 0, got %+v", nak)
+	}
+	p.write(segment{'f', 'e', 0, epoch, packet.EMPTY, 0, []byte("0---")})
+	p.write(segment{'f', 'e', 1, epoch, packet.EMPTY, 0, []byte("1---")})
+	p.readFlag(packet.DONE)
+	if r := <-done; r.err != nil || string(r.data) != "0---1---" {
+		t.Errorf("got %q, %v", r.data, r.err)
+	}
+}
+
+func TestRecvSilentSender(t *testing.T) {
+	clk, c, p := setup(t)
+	recv(c, 'h', 0)
+
+	p.write(segment{'h', 'g', 2, newEpoch(), packet.START, 4, nil})
+	p.readFlag(packet.ACCEPT)
+	// every second without data Recv asks for everything, till the sender must have given
+	// up on the round - then it reports FAILURE
+	naks := 0
+	for {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second)
+		s := p.read()
+		if s.flag != packet.FAILURE {
+			t.Fatalf("expected FAILURE, got %+v", s)
+		}
+		if len(s.data) == 0 {
+			break
+		}
+		if !bytes.Equal(s.data, []byte{0, 0, 1, 0}) {
+			t.Errorf("NAK %d asked for % x", naks, s.data)
+		}
+		naks++
+	}
+	if naks != 5 {
+		t.Errorf("%d NAKs before FAILURE, expected 5", naks)
+	}
+}
+
+func TestRecvFlooded(t *testing.T) {
+	clk, c, p := setup(t)
+	recv(c, 'j', 30)
+
+	epoch := newEpoch()
+	p.write(segment{'j', 'i', 2, epoch, packet.START, 4, nil})
+	p.readFlag(packet.ACCEPT)
+	// something that isn't part of the transfer every half a second, so the read never
+	// times out - Recv still has to give up on a sender that doesn't send anything useful
+	for i := 0; i < 13; i++ {
+		p.write(segment{'j', 'i', 0, epoch + 1, packet.EMPTY, 0, []byte("junk")})
+		clk.BlockUntil(1)
+		clk.Advance(500 * time.Millisecond)
+	}
+	p.write(segment{'j', 'i', 0, epoch + 1, packet.EMPTY, 0, []byte("junk")})
+	if s := p.readFlag(packet.FAILURE); len(s.data) != 0 {
+		t.Errorf("expected FAILURE, got a NAK for % x", s.data)
+	}
+}
+
+// the whole thing through a forwarder that drops, duplicates, corrupts and reorders
+// readPacket is read, with the options
+func (p *peer) readPacket() packet.Packet {
+	p.t.Helper()
+	buf := make([]byte, packet.MaxSize)
+	n, err := p.c.Read(buf)
+	if err != nil {
+		p.t.Fatalf("peer: %v", err)
+	}
+	var pk packet.Packet
+	if err := pk.UnmarshalBinary(buf[:n]); err != nil {
+		p.t.Fatalf("peer: %v: % x", err, buf[:n])
+	}
+	return pk
+}
+
+func (p *peer) writePacket(pk packet.Packet) {
+	p.t.Helper()
+	raw, err := pk.MarshalBinary()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.c.Write(raw)
+}
+
+func segmentOf(pk packet.Packet) segment {
+	return segment{pk.Dest, pk.Src, pk.Seq, pk.Epoch, pk.Flag, pk.Size, pk.Data}
+}
+
+// a peer from before options drops a START that has them, so the next one doesn't - and once
+// it's answered one of those, the first START to it doesn't have them either
+func TestSendOlderPeer(t *testing.T) {
+	packet.ForgetVersions()
+	clk, c, p := setup(t)
+	data := []byte("hello")
+	done := send(c, 'o', 'p', data, 8, 3)
+
+	first := p.readPacket()
+	if v, ok := first.Option(packet.OptVersion); !first.IsStart() || !ok || v[0] != packet.Version {
+		t.Fatalf("the first START should offer version %d: %v", packet.Version, first)
+	}
+	clk.BlockUntil(1)
+	clk.Advance(2 * time.Second)
+	second := p.readPacket()
+	if !second.IsStart() || len(second.Options) > 0 {
+		t.Fatalf("expected a START without options after the timeout: %v", second)
+	}
+	p.accept(segmentOf(second))
+	p.receive(segmentOf(second), nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := packet.PeerVersion('o', 'p'); !ok || v != 0 {
+		t.Errorf("peer version %d (%v), expected 0", v, ok)
+	}
+
+	done = send(c, 'o', 'p', data, 8, 3)
+	start := p.readPacket()
+	if len(start.Options) > 0 {
+		t.Errorf("offered options to a peer that didn't understand them: %v", start)
+	}
+	p.accept(segmentOf(start))
+	p.receive(segmentOf(start), nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendNewerPeer(t *testing.T) {
+	packet.ForgetVersions()
+	_, c, p := setup(t)
+	data := []byte("hello")
+	for i := 0; i < 2; i++ {
+		done := send(c, 'q', 'r', data, 8, 3)
+		start := p.readPacket()
+		if len(start.Options) == 0 {
+			t.Fatalf("transfer %d: START without options: %v", i, start)
+		}
+		// a peer that speaks a newer version answers with the one both do, and options
+		// Send doesn't know about are fine
+		opts := packet.AppendOption(nil, 250, 1, 2)
+		opts = packet.AppendOption(opts, packet.OptVersion, packet.Version)
+		p.writePacket(packet.Packet{Header: packet.Header{Dest: 'q', Src: 'r', Seq: start.Seq, Epoch: start.Epoch, Flag: packet.ACCEPT, Size: start.Size}, Options: opts})
+		p.receive(segmentOf(start), nil)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := packet.PeerVersion('q', 'r'); !ok || v != packet.Version {
+			t.Errorf("transfer %d: peer version %d (%v), expected %d", i, v, ok, packet.Version)
+		}
+	}
+}
+
+func TestRecvOptions(t *testing.T) {
+	packet.ForgetVersions()
+	_, c, p := setup(t)
+
+	// a newer sender, with an option Recv doesn't know about
+	done := recv(c, 't', 0)
+	epoch := newEpoch()
+	opts := packet.AppendOption(nil, packet.OptVersion, packet.Version+5)
+	opts = packet.AppendOption(opts, 250, 1, 2, 3)
+	start := packet.Packet{Header: packet.Header{Dest: 't', Src: 's', Seq: 1, Epoch: epoch, Flag: packet.START, Size: 4}, Options: opts}
+	p.writePacket(start)
+	accept := p.readPacket()
+	if !accept.HasAck() || !bytes.Equal(accept.Options, packet.AppendOption(nil, packet.OptVersion, packet.Version)) {
+		t.Fatalf("expected an ACCEPT with only version %d: %v", packet.Version, accept)
+	}
+	p.write(segment{'t', 's', 0, epoch, packet.EMPTY, 0, []byte("data")})
+	p.readFlag(packet.DONE)
+	if r := <-done; r.err != nil || string(r.data) != "data" {
+		t.Fatalf("got %q, %v", r.data, r.err)
+	}
+	if v, ok := packet.PeerVersion('t', 's'); !ok || v != packet.Version {
+		t.Errorf("peer version %d (%v), expected %d", v, ok, packet.Version)
+	}
+
+	// an older one, it mustn't get options back
+	done = recv(c, 't', 0)
+	epoch = newEpoch()
+	p.write(segment{'t', 's', 1, epoch, packet.START, 4, nil})
+	if accept := p.readPacket(); !accept.HasAck() || len(accept.Options) > 0 {
+		t.Fatalf("expected an ACCEPT without options: %v", accept)
+	}
+	p.write(segment{'t', 's', 0, epoch, packet.EMPTY, 0, []byte("data")})
+	p.readFlag(packet.DONE)
+	if r := <-done; r.err != nil {
+		t.Fatal(r.err)
+	}
+	if v, ok := packet.PeerVersion('t', 's'); !ok || v != 0 {
+		t.Errorf("peer version %d (%v), expected 0", v, ok)
+	}
+}
+
+func stamped(h packet.Header, val uint32, ecr uint32) packet.Packet {
+	return packet.Packet{Header: h, Options: packet.AppendTimestamps(nil, val, ecr)}
+}
+
+// an ACCEPT that doesn't echo the START, and a DONE that echoes something from before it,
+// are from earlier rounds - whatever their epoch says
+func TestSendTimestamps(t *testing.T) {
+	packet.ForgetVersions()
+	clk, c, p := setup(t)
+	clk.Advance(10 * time.Second)
+	data := []byte("0123456789abcdef")
+	done := send(c, 'u', 'v', data, 4, 3)
+
+	start := p.readPacket()
+	startTs, ecr, ok := start.Timestamps()
+	if !ok || ecr != 0 || startTs != 10000 {
+		t.Fatalf("expected a START with timestamps 10000/0: %v", start)
+	}
+	accept := packet.Header{Dest: 'u', Src: 'v', Seq: start.Seq, Epoch: start.Epoch, Flag: packet.ACCEPT, Size: start.Size}
+	p.writePacket(stamped(accept, 111, startTs-1))
+	p.writePacket(stamped(accept, 222, startTs))
+	var last uint32
+	for i := uint16(0); i < 2; i++ {
+		seg := p.readPacket()
+		val, ecr, ok := seg.Timestamps()
+		if !ok || seg.Seq != i || ecr != 222 {
+			t.Fatalf("expected segment %d echoing the second ACCEPT: %v", i, seg)
+		}
+		last = val
+	}
+
+	ack := packet.Header{Dest: 'u', Src: 'v', Epoch: start.Epoch}
+	p.writePacket(stamped(packet.Header{Dest: 'u', Src: 'v', Seq: start.Seq, Epoch: start.Epoch, Flag: packet.DONE, Size: start.Size}, 999, startTs-1))
+	ack.Flag, ack.Seq = packet.ACCEPT, 2
+	p.writePacket(stamped(ack, 500, last))
+	for i := uint16(2); i < 4; i++ {
+		seg := p.readPacket()
+		if _, ecr, ok := seg.Timestamps(); !ok || seg.Seq != i || ecr != 500 {
+			t.Fatalf("expected segment %d echoing the ack: %v", i, seg)
+		}
+		last, _, _ = seg.Timestamps()
+	}
+	ack.Flag, ack.Seq, ack.Size = packet.DONE, start.Seq, start.Size
+	p.writePacket(stamped(ack, 501, last))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// data sent before the START is from an earlier round, even with the same epoch - and acks
+// echo the segment that moved them on
+func TestRecvTimestamps(t *testing.T) {
+	_, c, p := setup(t)
+	done := recv(c, 'w', 0)
+	epoch := newEpoch()
+	opts := packet.AppendOption(nil, packet.OptVersion, packet.Version)
+	p.writePacket(packet.Packet{Header: packet.Header{Dest: 'w', Src: 'x', Seq: 2, Epoch: epoch, Flag: packet.START, Size: 4},
+		Options: packet.AppendTimestamps(opts, 1000, 0)})
+	accept := p.readPacket()
+	if _, ecr, ok := accept.Timestamps(); !accept.HasAck() || !ok || ecr != 1000 {
+		t.Fatalf("expected an ACCEPT echoing 1000: %v", accept)
+	}
+
+	seg := packet.Header{Dest: 'w', Src: 'x', Epoch: epoch, Flag: packet.EMPTY}
+	old := stamped(seg, 999, 0)
+	old.Data = []byte("old!")
+	p.writePacket(old)
+	first := stamped(seg, 1001, 0)
+	first.Data = []byte("new!")
+	p.writePacket(first)
+	ack := p.readPacket()
+	if _, ecr, ok := ack.Timestamps(); ack.Flag != packet.ACCEPT || ack.Seq != 1 || !ok || ecr != 1001 {
+		t.Fatalf("expected an ack of 1 echoing 1001: %v", ack)
+	}
+	seg.Seq = 1
+	second := stamped(seg, 1002, 0)
+	second.Data = []byte("data")
+	p.writePacket(second)
+	fin := p.readPacket()
+	if _, ecr, ok := fin.Timestamps(); !fin.IsDone() || !ok || ecr != 1002 {
+		t.Fatalf("expected DONE echoing 1002: %v", fin)
+	}
+	if r := <-done; r.err != nil || string(r.data) != "new!data" {
+		t.Fatalf("got %q, %v", r.data, r.err)
+	}
+}
+
+// a FAILURE from the forwarder saying the segments are too big makes Send start over with
+// ones that fit, and the next transfer starts out with those
+func TestSendTooBig(t *testing.T) {
+	packet.ResetPathMTUs()
+	_, c, p := setup(t)
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	done := send(c, 'y', 'z', data, 0, 3)
+
+	start := p.readFlag(packet.START)
+	if start.seq != 1 || start.size != 0xffff {
+		t.Fatalf("expected a START for one segment as big as they get: %+v", start)
+	}
+	p.accept(start)
+	seg := p.readPacket()
+	p.writePacket(packet.TooBig(seg.Header, 60))
+	start = p.readFlag(packet.START)
+	if start.size != 60-21 || start.seq != 3 {
+		t.Fatalf("expected a START for 3 segments of 39 bytes: %+v", start)
+	}
+	p.accept(start)
+	if got := p.receive(start, nil); !bytes.Equal(got, data) {
+		t.Errorf("peer got %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if mtu, ok := packet.PathMTU('y', 'z'); !ok || mtu != 60 {
+		t.Errorf("path MTU %d (%v), expected 60", mtu, ok)
+	}
+
+	done = send(c, 'y', 'z', data, 0, 3)
+	if start = p.readFlag(packet.START); start.size != 39 {
+		t.Errorf("the next transfer didn't start out with 39 byte segments: %+v", start)
+	}
+	p.accept(start)
+	p.receive(start, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// with a window picked by the caller there's nothing Send can do about it
+	done = send(c, 'y', 'z', data, 50, 3)
+	start = p.readFlag(packet.START)
+	p.accept(start)
+	seg = p.readPacket()
+	p.writePacket(packet.TooBig(seg.Header, 60))
+	var tooBig *packet.TooBigError
+	if err := <-done; !errors.As(err, &tooBig) || tooBig.Peer != 'z' || tooBig.MTU != 60 {
+		t.Errorf("expected a TooBigError, got %v", err)
+	}
+}
+
+// a path that drops big packets without saying so gets half the size after a round where
+// nothing got through
+// a path that drops big packets without a word: Send probes it once a round gets nothing
+// acknowledged, and only tries smaller segments if an empty probe gets an answer and one as
+// big as its packets doesn't - with both answered it was loss, and the size stays
+func TestSendBlackHole(t *testing.T) {
+	full := uint16(0xffff)
+	// for Heard
+	packet.SetKeepalive('y', 'z', time.Hour, time.Hour)
+	t.Cleanup(func() { packet.SetKeepalive('y', 'z', 0, 0) })
+	for _, blackHole := range []bool{true, false} {
+		packet.ResetPathMTUs()
+		clk, c, p := setup(t)
+		done := send(c, 'y', 'z', []byte("hello"), 0, 3)
+
+		start := p.readFlag(packet.START)
+		if start.size != full {
+			t.Fatalf("first START has segments of %d bytes, expected %d", start.size, full)
+		}
+		p.accept(start)
+		for {
+			s := p.read()
+			if s.flag == packet.START {
+				start = s
+				break
+			}
+			if s.flag == packet.START|packet.DONE {
+				if blackHole && len(s.data) > 0 {
+					continue
+				}
+				p.write(segment{s.src, s.dest, s.seq, s.epoch, packet.ACCEPT | packet.DONE, 0, nil})
+				if !blackHole {
+					// the big one is answered first, and that's all Send waits for
+					continue
+				}
+				// the answer to the big one isn't coming, once Send has the one to the empty
+				// one it waits for the deadline
+				for !packet.Heard('y', 'z').Equal(clk.Now()) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			// one timer at a time, so every packet read is followed by the one timeout it
+			// was sent before - Send doesn't get ahead of what's been read
+			clk.BlockUntil(1)
+			clk.AdvanceToNext()
+		}
+		want := full
+		if blackHole {
+			want = uint16((0xffff+21)/2 - 21)
+		}
+		if start.size != want {
+			t.Errorf("black hole %v: START after nothing got through has segments of %d bytes, expected %d", blackHole, start.size, want)
+		}
+		p.accept(start)
+		p.receive(start, nil)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// through a forwarder with an MTU, that drops bigger packets - and one that fragments them,
+// Send doesn't find out about that
+func TestPathMTU(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	stop := clk.AutoAdvance(2 * time.Millisecond)
+	packet.SetClock(clk)
+	t.Cleanup(func() {
+		stop()
+		packet.SetClock(nil)
+	})
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	for _, fragment := range []bool{false, true} {
+		packet.ResetPathMTUs()
+		n := sim.New(forwarder.Config{Impairments: forwarder.Impairments{MTU: 1000, Fragment: fragment}, Latency: time.Millisecond, Clock: clk})
+		a, err := n.Dial('1')
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := n.Dial('2')
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if res := n.Transfer(a, b, data, 0, 3, 10); res.Err != nil {
+				t.Fatalf("fragment %v, transfer %d: %v", fragment, i, res.Err)
+			}
+		}
+		links := n.Forwarder.Links()
+		n.Close()
+		mtu, ok := packet.PathMTU('1', '2')
+		if fragment {
+			if ok {
+				t.Errorf("found a path MTU of %d through a forwarder that fragments", mtu)
+			}
+			continue
+		}
+		if !ok || mtu != 1000 {
+			t.Errorf("path MTU %d (%v), expected 1000", mtu, ok)
+		}
+		// only the first round of the first transfer had segments that were too big
+		for _, l := range links {
+			if l.Src == '1' && l.Dest == '2' && l.Oversize != 1 {
+				t.Errorf("%d packets were too big, expected 1", l.Oversize)
+			}
+		}
+	}
+}
+
+func TestTransferImpaired(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a few seconds")
+	}
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	stop := clk.AutoAdvance(2 * time.Millisecond)
+	packet.SetClock(clk)
+	t.Cleanup(func() {
+		stop()
+		packet.SetClock(nil)
+	})
+	cfg := forwarder.Config{
+		Impairments: forwarder.Impairments{Jitter: true, Drop: 10, Zero: 5, Duplicate: 10},
+		Latency:     time.Millisecond,
+		Clock:       clk,
+	}
+	sum, err := sim.Run(cfg, sim.Batch{Transfers: 40, Pairs: 4, Size: 4096, Window: 256, Tolerance: 10, Wait: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Failed > 0 {
+		t.Errorf("%d of %d transfers failed: %v", sum.Failed, sum.OK+sum.Failed, sum.Errors)
+	}
+}
@@ -2,31 +2,51 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"handin2/metrics"
 	"handin2/packet"
 	"net"
 	"os"
 	"strings"
-	"time"
 )
 
 var id = byte('c')
 
 func main() {
-	arguments := os.Args
+	level := flag.String("log-level", "warn", "debug, info, warn, error or off")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics on this loopback address, e.g. localhost:9101")
+	flag.Parse()
+
+	logger, err := packet.NewTextLogger(os.Stderr, *level)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	packet.SetLogger(logger)
+
+	if *metricsAddr != "" {
+		go func() {
+			logger.Error("metrics", "err", metrics.ListenAndServe(*metricsAddr, metrics.Default))
+		}()
+	}
+
 	CONNECT := ""
-	if len(arguments) == 1 {
+	if flag.NArg() == 0 {
 		fmt.Println("Using default localhost:4004")
 		CONNECT = "localhost:4004"
 	} else {
-		CONNECT = arguments[1]
+		CONNECT = flag.Arg(0)
 	}
 
-	c, err := net.Dial("tcp", CONNECT)
+	conn, err := net.Dial("tcp", CONNECT)
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("dial", "addr", CONNECT, "err", err)
 		return
 	}
+	// packets are framed so they don't run together on the way to and from the forwarder,
+	// that is, every read gets exactly one packet
+	c := packet.NewConn(conn)
 
 	// the first message to forwarder (which acts as 'the internet') will be the
 	// name/id of our pseudo_client/server, this is due to the fact that the forwarder
@@ -35,27 +55,27 @@ func main() {
 	c.Write([]byte{id})
 	// ^ in my implementation, this id can only be one character
 
-	// for some reason, at least on my machine, without a litle sleep, it would arbitrarily
-	// just not receive anything in forwarder
-	time.Sleep(50 * time.Millisecond)
-
 	// ------------------- EXAMPLE 1, TALKING TO ECHO SERVER -------------
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print("-> ")
-		text, _ := reader.ReadString('\n')
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			// stdin is closed (ctrl-d), time to say goodbye
+			break
+		}
 		text = strings.Replace(text, "\n", "", -1)
 		fmt.Printf("--------------------------\n| Sending data to 's'\n_______\n| %s\n--------------------------\n", text)
 		//err = packet.Send(c, id, 's', []byte(text), 2, 10)
 		err = packet.Send(c, id, 's', []byte(text), uint16(len(text)), 10)
 		if err != nil {
-			fmt.Println(err)
+			logger.Error("send", "err", err)
 			continue
 		}
 
 		data, _, err := packet.Recv(c, id, 5)
 		if err != nil {
-			fmt.Println(err)
+			logger.Error("recv", "err", err)
 			continue
 		}
 		fmt.Printf("| Received from 's'\n_______\n| %s\n--------------------------\n", string(data))
@@ -70,11 +90,16 @@ func main() {
 	// 	err = packet.Send(c, id, 's', []byte{}, 0, 0)
 	// 	start += time.Now().UnixMilli()
 	// 	if err != nil {
-	// 		fmt.Println(err)
+	// 		logger.Error("send", "err", err)
 	// 		return
 	// 	}
 	// 	fmt.Printf("Pinging 's' took %v ms\n", start)
 	// }
 
+	// tell the server we're done, and wait for it to say the same, so it isn't left
+	// waiting on its next Recv
+	if err := packet.Close(c, id, 's', 10); err != nil {
+		logger.Error("close", "err", err)
+	}
 	c.Close()
 }
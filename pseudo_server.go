@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"handin2/metrics"
 	"handin2/packet"
 	"net"
 	"os"
-	"time"
 )
 
 var id = byte('s')
@@ -14,20 +16,39 @@ var id = byte('s')
 // this can be remedied by use of equivalents to handleReceive/handleSend in packet.go
 // but this increases complexity by a lot
 func main() {
-	arguments := os.Args
+	level := flag.String("log-level", "warn", "debug, info, warn, error or off")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics on this loopback address, e.g. localhost:9101")
+	flag.Parse()
+
+	logger, err := packet.NewTextLogger(os.Stderr, *level)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	packet.SetLogger(logger)
+
+	if *metricsAddr != "" {
+		go func() {
+			logger.Error("metrics", "err", metrics.ListenAndServe(*metricsAddr, metrics.Default))
+		}()
+	}
+
 	CONNECT := ""
-	if len(arguments) == 1 {
+	if flag.NArg() == 0 {
 		fmt.Println("Using default localhost:4004")
 		CONNECT = "localhost:4004"
 	} else {
-		CONNECT = arguments[1]
+		CONNECT = flag.Arg(0)
 	}
 
-	c, err := net.Dial("tcp", CONNECT)
+	conn, err := net.Dial("tcp", CONNECT)
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("dial", "addr", CONNECT, "err", err)
 		return
 	}
+	// packets are framed so they don't run together on the way to and from the forwarder,
+	// that is, every read gets exactly one packet
+	c := packet.NewConn(conn)
 
 	// the first message to forwarder (which acts as 'the internet') will be the
 	// name/id of our pseudo_client/server, this is due to the fact that the forwarder
@@ -36,22 +57,29 @@ func main() {
 	c.Write([]byte{id})
 	// ^ in my implementation, this id can only be one character
 
-	// for some reason, at least on my machine, without a litle sleep, it would arbitrarily
-	// just not receive anything in forwarder
-	time.Sleep(50 * time.Millisecond)
-
 	// ------------ EXAMPLE 1, ECHO SERVER ---------------
 	for {
 		data, dest, err := packet.Recv(c, id, 0)
+		var closed *packet.ClosedError
+		if errors.As(err, &closed) {
+			// the client is done, close our side too (unless it's gone) and wait for the next
+			fmt.Println(closed)
+			if !closed.Reset {
+				if err := packet.Close(c, id, dest, 3); err != nil {
+					logger.Error("close", "err", err)
+				}
+			}
+			continue
+		}
 		if err != nil {
-			fmt.Println(err)
+			logger.Error("recv", "err", err)
 			return
 		}
 		fmt.Printf("Received from <%c>: %s\nSending it back...\n", dest, string(data))
 
 		err = packet.Send(c, id, dest, data, uint16(len(data)), 3)
 		if err != nil {
-			fmt.Println(err)
+			logger.Error("send", "err", err)
 		}
 	}
 
@@ -59,7 +87,7 @@ func main() {
 	// for {
 	// 	_, dest, err := packet.Recv(c, id, 0)
 	// 	if err != nil {
-	// 		fmt.Println(err)
+	// 		logger.Error("recv", "err", err)
 	// 		return
 	// 	}
 	// 	fmt.Printf("Received ping from <%c>\n", dest)
@@ -0,0 +1,192 @@
+package sim
+
+import (
+	"handin2/clock"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "sim" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// one direction of a pipe, bytes written to it wait in buf till they're read - like the
+// buffer of a socket, except it never fills up
+type stream struct {
+	m      sync.Mutex
+	buf    []byte
+	closed bool
+	// closed (and replaced) whenever something changes, so readers can wait for it
+	wake chan struct{}
+}
+
+func newStream() *stream {
+	return &stream{wake: make(chan struct{})}
+}
+
+// s.m must be held
+func (s *stream) broadcast() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+type conn struct {
+	r, w          *stream
+	local, remote pipeAddr
+	clk           clock.Clock
+
+	dm           sync.Mutex
+	readDeadline time.Time
+	deadlineWake chan struct{}
+	closed       bool
+}
+
+// Pipe is like net.Pipe, except writes never block - whatever is written waits for the other
+// end to read it. net.Pipe would have the forwarder stuck writing to an endpoint that is
+// busy writing to the forwarder. Read deadlines work like on a TCP connection, only they go
+// by clk (nil is the wall clock), write deadlines are ignored since writes never wait
+func Pipe(clk clock.Clock, a string, b string) (net.Conn, net.Conn) {
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	ab, ba := newStream(), newStream()
+	return &conn{r: ba, w: ab, local: pipeAddr(a), remote: pipeAddr(b), clk: clk, deadlineWake: make(chan struct{})},
+		&conn{r: ab, w: ba, local: pipeAddr(b), remote: pipeAddr(a), clk: clk, deadlineWake: make(chan struct{})}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	for {
+		c.dm.Lock()
+		if c.closed {
+			c.dm.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline, dwake := c.readDeadline, c.deadlineWake
+		c.dm.Unlock()
+
+		c.r.m.Lock()
+		if len(c.r.buf) > 0 {
+			n := copy(b, c.r.buf)
+			c.r.buf = c.r.buf[n:]
+			c.r.m.Unlock()
+			return n, nil
+		}
+		if c.r.closed {
+			c.r.m.Unlock()
+			return 0, io.EOF
+		}
+		wake := c.r.wake
+		c.r.m.Unlock()
+
+		var timeout <-chan time.Time
+		var t clock.Timer
+		if !deadline.IsZero() {
+			d := deadline.Sub(c.clk.Now())
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			t = c.clk.NewTimer(d)
+			timeout = t.C()
+		}
+		select {
+		case <-wake:
+		case <-dwake:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.dm.Lock()
+	closed := c.closed
+	c.dm.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	c.w.m.Lock()
+	defer c.w.m.Unlock()
+	if c.w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.w.buf = append(c.w.buf, b...)
+	c.w.broadcast()
+	return len(b), nil
+}
+
+// Close ends both directions, the other end reads what's left and then io.EOF
+func (c *conn) Close() error {
+	c.dm.Lock()
+	if c.closed {
+		c.dm.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	close(c.deadlineWake)
+	c.deadlineWake = make(chan struct{})
+	c.dm.Unlock()
+	for _, s := range []*stream{c.r, c.w} {
+		s.m.Lock()
+		s.closed = true
+		s.broadcast()
+		s.m.Unlock()
+	}
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.dm.Lock()
+	c.readDeadline = t
+	// a Read that is waiting has to look at the new deadline
+	close(c.deadlineWake)
+	c.deadlineWake = make(chan struct{})
+	c.dm.Unlock()
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// listener hands out the forwarder's end of the pipes made by Network.Dial
+type listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newListener() *listener {
+	return &listener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return pipeAddr("forwarder")
+}
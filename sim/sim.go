@@ -0,0 +1,327 @@
+// Package sim runs the real packet protocol and the forwarder in one process - endpoints are
+// connected to an in-process forwarder.Forwarder over in-memory pipes instead of TCP, so
+// a lot of transfers under different impairments can be run (and checked) without starting
+// three programs in three terminals.
+//
+//	n := sim.New(forwarder.Config{Impairments: forwarder.Impairments{Drop: 10}})
+//	defer n.Close()
+//	a, _ := n.Dial('a')
+//	b, _ := n.Dial('b')
+//	res := n.Transfer(a, b, data, 512, 10, 5)
+package sim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"handin2/clock"
+	"handin2/forwarder"
+	"handin2/metrics"
+	"handin2/packet"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Network is a forwarder with endpoints dialed into it
+type Network struct {
+	Forwarder *forwarder.Forwarder
+
+	clk   clock.Clock
+	l     *listener
+	m     sync.Mutex
+	conns []net.Conn
+	// {src, dest} -> what Transfer had src send dest so far, a delivery that isn't what was
+	// just sent has to be one of these
+	sent map[[2]byte][][]byte
+}
+
+// New starts a forwarder with cfg, if cfg has no Registry it gets its own, so several
+// networks can run side by side. The pipes go by cfg.Clock, like the forwarder - when it's a
+// clock.Virtual, packet has to be given it too (packet.SetClock)
+func New(cfg forwarder.Config) *Network {
+	if cfg.Registry == nil {
+		cfg.Registry = metrics.NewRegistry()
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real{}
+	}
+	n := &Network{Forwarder: forwarder.New(cfg), clk: cfg.Clock, l: newListener(), sent: make(map[[2]byte][][]byte)}
+	go n.Forwarder.Serve(n.l)
+	return n
+}
+
+// Endpoint is a pseudo client/server registered with the forwarder
+type Endpoint struct {
+	ID   byte
+	Conn *packet.Conn
+
+	// Transfer keeps calling Recv for as long as the endpoint is around, like a server would,
+	// so a sender that starts over after losing DONE still gets an answer
+	listen     sync.Once
+	deliveries chan delivery
+	// closed along with the network
+	done <-chan struct{}
+}
+
+type delivery struct {
+	data []byte
+	from byte
+	err  error
+}
+
+func (e *Endpoint) recvLoop() {
+	for {
+		data, from, err := packet.Recv(e.Conn, e.ID, 0)
+		var closed *packet.ClosedError
+		if err != nil && !errors.As(err, &closed) {
+			// the connection is gone
+			close(e.deliveries)
+			return
+		}
+		select {
+		case e.deliveries <- delivery{data, from, err}:
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// Dial connects a new endpoint and registers it as id, like pseudo_client does
+func (n *Network) Dial(id byte) (*Endpoint, error) {
+	a, b := Pipe(n.clk, fmt.Sprintf("endpoint %c", id), "forwarder")
+	select {
+	case n.l.conns <- b:
+	case <-n.l.done:
+		return nil, net.ErrClosed
+	}
+	c := packet.NewConn(a)
+	if _, err := c.Write([]byte{id}); err != nil {
+		return nil, err
+	}
+	n.m.Lock()
+	n.conns = append(n.conns, a)
+	n.m.Unlock()
+	return &Endpoint{ID: id, Conn: c, deliveries: make(chan delivery, 16), done: n.l.done}, nil
+}
+
+// Close disconnects every endpoint and stops the forwarder
+func (n *Network) Close() {
+	n.l.Close()
+	n.m.Lock()
+	for _, c := range n.conns {
+		c.Close()
+	}
+	n.conns = nil
+	n.m.Unlock()
+}
+
+// Result is how one transfer went
+type Result struct {
+	From, To byte
+	Size     int
+	// from Send or Recv, or because what arrived isn't what was sent
+	Err      error
+	Duration time.Duration
+	// earlier transfers between the two delivered again by Recv (or late, after their Send
+	// failed), because Send started over after its DONE was lost
+	Redelivered int
+}
+
+// sentBefore is whether src had Transfer send data to dest before
+func (n *Network) sentBefore(src byte, dest byte, data []byte) bool {
+	n.m.Lock()
+	defer n.m.Unlock()
+	for _, d := range n.sent[[2]byte{src, dest}] {
+		if bytes.Equal(d, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// Transfer sends data from src to dest with packet.Send, and checks that dest's Recv got it
+// intact within wait seconds after Send returned. Duration is how long Send took. An
+// endpoint shouldn't be the dest of two transfers at once. Something delivered before it that
+// src sent dest in an earlier Transfer is counted in Redelivered, anything else is an error
+func (n *Network) Transfer(src *Endpoint, dest *Endpoint, data []byte, window uint16, tolerance uint16, wait uint8) Result {
+	res := Result{From: src.ID, To: dest.ID, Size: len(data)}
+	dest.listen.Do(func() { go dest.recvLoop() })
+	defer func() {
+		n.m.Lock()
+		key := [2]byte{src.ID, dest.ID}
+		n.sent[key] = append(n.sent[key], data)
+		n.m.Unlock()
+	}()
+	start := n.clk.Now()
+	err := packet.Send(src.Conn, src.ID, dest.ID, data, window, tolerance)
+	res.Duration = clock.Since(n.clk, start)
+	if err != nil {
+		res.Err = fmt.Errorf("send: %w", err)
+		return res
+	}
+	timeout := n.clk.NewTimer(time.Duration(wait) * time.Second)
+	defer timeout.Stop()
+	for {
+		select {
+		case d, ok := <-dest.deliveries:
+			switch {
+			case !ok:
+				res.Err = errors.New("recv: connection closed")
+			case d.err != nil:
+				res.Err = fmt.Errorf("recv: %w", d.err)
+			case d.from != src.ID:
+				res.Err = fmt.Errorf("recv: got a transfer from %d, expected %d", d.from, src.ID)
+			case bytes.Equal(d.data, data):
+			case n.sentBefore(src.ID, dest.ID, d.data):
+				res.Redelivered++
+				continue
+			default:
+				res.Err = fmt.Errorf("recv: got %d bytes that aren't what was sent (%d bytes), or anything sent before", len(d.data), len(data))
+			}
+			return res
+		case <-timeout.C():
+			res.Err = errors.New("recv: Send got DONE, but nothing was delivered")
+			return res
+		}
+	}
+}
+
+// Batch is a number of transfers, spread over pairs of endpoints that run side by side
+type Batch struct {
+	Transfers int
+	Pairs     int
+	// bytes per transfer
+	Size      int
+	Window    uint16
+	Tolerance uint16
+	Wait      uint8
+}
+
+// Summary of a batch, restarts and retransmitted bytes come from the packet metrics, so
+// they're only right if nothing else uses the package at the same time
+type Summary struct {
+	OK, Failed int
+	// data that got through, in bytes
+	Bytes         int
+	Total, Max    time.Duration
+	Restarts      int
+	Retransmitted int
+	// transfers delivered more than once, which shouldn't happen
+	Redelivered int
+	Elapsed     time.Duration
+	// real time the batch took, the same as Elapsed unless the clock is virtual
+	Wall time.Duration
+	// error -> how many transfers failed with it
+	Errors map[string]int
+	// how long each transfer that went through took, shortest first
+	Durations []time.Duration
+}
+
+func (s Summary) Mean() time.Duration {
+	if s.OK+s.Failed == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.OK+s.Failed)
+}
+
+// Percentile is the duration p percent (0-100) of the transfers that went through took at
+// most, 0 if none did
+func (s Summary) Percentile(p float64) time.Duration {
+	if len(s.Durations) == 0 {
+		return 0
+	}
+	// nearest rank
+	i := int(math.Ceil(p/100*float64(len(s.Durations)))) - 1
+	return s.Durations[min(max(i, 0), len(s.Durations)-1)]
+}
+
+// Goodput is bytes of data that got through per second, of the time the batch took
+func (s Summary) Goodput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// ErrorList is Errors sorted by how often they happened
+func (s Summary) ErrorList() []string {
+	list := make([]string, 0, len(s.Errors))
+	for e := range s.Errors {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return s.Errors[list[i]] > s.Errors[list[j]] })
+	return list
+}
+
+// Run sets up a network with cfg and runs b on it, the data is different for every transfer.
+// The endpoints have the same ids in every batch, so what Send found out about paths in the
+// one before (on another network) is forgotten first
+func Run(cfg forwarder.Config, b Batch) (Summary, error) {
+	if b.Pairs < 1 || b.Pairs > 127 {
+		return Summary{}, errors.New("sim: there can be 1 to 127 pairs, every endpoint needs its own id")
+	}
+	packet.ResetPathMTUs()
+	n := New(cfg)
+	defer n.Close()
+	type pair struct{ src, dest *Endpoint }
+	pairs := make([]pair, b.Pairs)
+	for i := range pairs {
+		src, err := n.Dial(byte(2*i + 1))
+		if err != nil {
+			return Summary{}, err
+		}
+		dest, err := n.Dial(byte(2*i + 2))
+		if err != nil {
+			return Summary{}, err
+		}
+		pairs[i] = pair{src, dest}
+	}
+
+	before := packet.Metrics()
+	sum := Summary{Errors: make(map[string]int)}
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	start, wall := n.clk.Now(), time.Now()
+	for i, p := range pairs {
+		// transfer j goes to pair j % Pairs
+		count := b.Transfers / b.Pairs
+		if i < b.Transfers%b.Pairs {
+			count++
+		}
+		wg.Add(1)
+		go func(i int, p pair, count int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				data := make([]byte, b.Size)
+				for k := range data {
+					data[k] = byte(i + j + k)
+				}
+				res := n.Transfer(p.src, p.dest, data, b.Window, b.Tolerance, b.Wait)
+				m.Lock()
+				sum.Total += res.Duration
+				sum.Max = max(sum.Max, res.Duration)
+				sum.Redelivered += res.Redelivered
+				if res.Err != nil {
+					sum.Failed++
+					sum.Errors[res.Err.Error()]++
+				} else {
+					sum.OK++
+					sum.Bytes += res.Size
+					sum.Durations = append(sum.Durations, res.Duration)
+				}
+				m.Unlock()
+			}
+		}(i, p, count)
+	}
+	wg.Wait()
+	sum.Elapsed = clock.Since(n.clk, start)
+	sum.Wall = time.Since(wall)
+	sort.Slice(sum.Durations, func(i, j int) bool { return sum.Durations[i] < sum.Durations[j] })
+	after := packet.Metrics()
+	sum.Restarts = int(after["packet_restarts_total"] - before["packet_restarts_total"])
+	sum.Retransmitted = int(after["packet_bytes_retransmitted_total"] - before["packet_bytes_retransmitted_total"])
+	return sum, nil
+}
@@ -2,96 +2,195 @@ package main
 
 import (
 	"fmt"
+	"handin2/tcpstate"
 	"time"
 )
 
-type TCPHeader struct {
-	sourcePort            int16
-	destinationPort       int16
-	sequenceNumber        int
-	acknowledgementNumber int
-	data                  string
+// a TCP simulation without networking - client and server are goroutines handing segments to
+// each other over channels, and tcpstate keeps track of which state each of them is in and
+// what it has to send. Every transition is printed by a hook, so you can follow both ends
+// from CLOSED, through the handshake and the data, to CLOSED again
+
+const (
+	SYN = 1 << iota
+	ACK
+	FIN
+	RST
+)
+
+type segment struct {
+	flags int
+	seq   int
+	ack   int
+	data  string
 }
 
-func listen(serverch chan string, clientch chan string, tcpheader TCPHeader) {
-	input := <-serverch
-	if input == "passive open" {
-		fmt.Printf("SERVER %d -- State: Listen \n", tcpheader.destinationPort)
-		time.Sleep(time.Second)
+func fmtSegment(s segment) string {
+	flags := ""
+	for _, f := range []struct {
+		bit  int
+		name string
+	}{{SYN, "SYN"}, {ACK, "ACK"}, {FIN, "FIN"}, {RST, "RST"}} {
+		if s.flags&f.bit > 0 {
+			if flags != "" {
+				flags += ","
+			}
+			flags += f.name
+		}
 	}
+	return fmt.Sprintf("%s seq=%d ack=%d len=%d", flags, s.seq, s.ack, len(s.data))
+}
+
+// time between steps, so it can be followed while it runs
+const step = 250 * time.Millisecond
+
+// 2 * maximum segment lifetime, how long TIME-WAIT lasts
+const msl2 = time.Second
+
+type endpoint struct {
+	name string
+	port int16
+	m    *tcpstate.Machine
+	in   <-chan segment
+	out  chan<- segment
+	// next sequence number we send, and the next one we expect from the other end
+	seq, ack int
+}
+
+func newEndpoint(name string, port int16, isn int, in <-chan segment, out chan<- segment) *endpoint {
+	e := &endpoint{name: name, port: port, m: tcpstate.New(), in: in, out: out, seq: isn}
+	e.m.OnTransition(func(t tcpstate.Transition) {
+		fmt.Printf("%s %d -- %s\n", e.name, e.port, t)
+	})
+	return e
+}
+
+func (e *endpoint) send(s segment) {
+	fmt.Printf("%s %d       sending: %s\n", e.name, e.port, fmtSegment(s))
+	e.out <- s
 }
-func synsent(serverch chan string, clientch chan string, tcpheader TCPHeader) {
-	input := <-clientch
-	if input == "active open" {
-		fmt.Printf("CLIENT %d-- State: SYN SENT \n       -- sending syn (%d) \n", tcpheader.sourcePort, tcpheader.sequenceNumber)
-		serverch <- "syn"
-		time.Sleep(time.Second)
-		synrcvd(serverch, clientch, tcpheader)
-	} else if input == "syn, ack" {
-		fmt.Printf("CLIENT %d -- State: SYN SENT \n       -- received: syn (%d), ack sending: ack (%d) \n", tcpheader.sourcePort, tcpheader.sequenceNumber, tcpheader.acknowledgementNumber)
-		serverch <- "ack"
-		time.Sleep(time.Second)
-		established(serverch, clientch, tcpheader)
-
-	} else if input == "close" {
-		fmt.Printf("CLIENT %d-- State: SYN SENT \n       -- received : close \n", tcpheader.sourcePort)
-		clientch <- "close"
-		time.Sleep(time.Second)
-		closed(serverch, clientch, tcpheader)
+
+// handle moves the state machine along and sends whatever the transition says to
+func (e *endpoint) handle(ev tcpstate.Event) {
+	t, err := e.m.Handle(ev)
+	if err != nil {
+		fmt.Printf("%s %d -- %v\n", e.name, e.port, err)
+		return
+	}
+	time.Sleep(step)
+	switch t.Action {
+	case tcpstate.SendSyn:
+		e.send(segment{flags: SYN, seq: e.seq})
+		e.seq++
+	case tcpstate.SendSynAck:
+		e.send(segment{flags: SYN | ACK, seq: e.seq, ack: e.ack})
+		e.seq++
+	case tcpstate.SendAck:
+		e.send(segment{flags: ACK, seq: e.seq, ack: e.ack})
+	case tcpstate.SendFin:
+		e.send(segment{flags: FIN, seq: e.seq, ack: e.ack})
+		e.seq++
 	}
 }
 
-func synrcvd(serverch chan string, clientch chan string, tcpheader TCPHeader) {
-	select {
-	case input := <-serverch:
-		if input == "syn" {
-			fmt.Printf("SERVER %d-- State: SYN RCVD \n       -- received : syn (%d) sending: syn, ack (%d,%d) \n", tcpheader.destinationPort, tcpheader.sequenceNumber, tcpheader.sequenceNumber, tcpheader.acknowledgementNumber)
-			clientch <- "syn, ack"
-			time.Sleep(time.Second)
-			synsent(serverch, clientch, tcpheader)
-		} else if input == "ack" {
-			time.Sleep(time.Second)
-			established(serverch, clientch, tcpheader)
+// recv takes the next segment, if it's one that changes the state it's handed to the state
+// machine - otherwise it's data (which is acknowledged) or the ack for our data
+func (e *endpoint) recv() {
+	s := <-e.in
+	fmt.Printf("%s %d       received: %s\n", e.name, e.port, fmtSegment(s))
+	switch {
+	case s.flags&RST > 0:
+		e.handle(tcpstate.RecvRst)
+	case s.flags&SYN > 0:
+		e.ack = s.seq + 1
+		if s.flags&ACK > 0 {
+			e.handle(tcpstate.RecvSynAck)
+		} else {
+			e.handle(tcpstate.RecvSyn)
+		}
+	case s.flags&FIN > 0:
+		e.ack = s.seq + len(s.data) + 1
+		if s.flags&ACK > 0 && s.ack == e.seq && e.m.State() == tcpstate.FinWait1 {
+			e.handle(tcpstate.RecvFinAck)
+		} else {
+			e.handle(tcpstate.RecvFin)
 		}
-	case input := <-clientch:
-		if input == "syn" {
-			fmt.Printf("CLIENT %d -- (ESTABLISHED CONNECTION) \n              -- received syn: %d and sends length of data+syn as ack: %d \n \n", tcpheader.destinationPort, tcpheader.sequenceNumber+1, len(tcpheader.data)+tcpheader.sequenceNumber+1)
+	case len(s.data) > 0:
+		if !e.m.State().CanRecv() {
+			fmt.Printf("%s %d -- data in %s, ignoring it\n", e.name, e.port, e.m.State())
+			return
+		}
+		fmt.Printf("%s %d       data: %q\n", e.name, e.port, s.data)
+		e.ack = s.seq + len(s.data)
+		time.Sleep(step)
+		e.send(segment{flags: ACK, seq: e.seq, ack: e.ack})
+	case s.flags&ACK > 0:
+		// only an ack of everything we've sent, SYN or FIN included, can move the state
+		switch e.m.State() {
+		case tcpstate.SynReceived, tcpstate.FinWait1, tcpstate.Closing, tcpstate.LastAck:
+			if s.ack == e.seq {
+				e.handle(tcpstate.RecvAck)
+			}
 		}
 	}
 }
-func established(serverch chan string, clientch chan string, tcpheader TCPHeader) {
-	input := <-serverch
-	if input == "ack" {
-		fmt.Printf("SERVER %d/CLIENT %d -- ESTABLISHED CONNECTION \n              -- Exchanging data :"+tcpheader.data+" ... \n", tcpheader.destinationPort, tcpheader.sourcePort)
-		time.Sleep(2 * time.Second)
-		clientch <- "syn"
-		synrcvd(serverch, clientch, tcpheader)
+
+// until keeps receiving till the state is one of states
+func (e *endpoint) until(states ...tcpstate.State) {
+	for {
+		for _, s := range states {
+			if e.m.State() == s {
+				return
+			}
+		}
+		e.recv()
 	}
 }
 
-func initialize(serverch chan string, clientch chan string, tcpheader TCPHeader) {
-	serverch <- "passive open"
-	clientch <- "active open"
-	listen(serverch, clientch, tcpheader)
-	synsent(serverch, clientch, tcpheader)
-}
-func closed(serverch chan string, clientch chan string, tcpheader TCPHeader) {
-	select {
-	case <-clientch:
-		fmt.Printf("CLIENT %d -- State: Closed. \n", tcpheader.sourcePort)
-	case <-serverch:
-		fmt.Printf("CLIENT %d -- State: Closed. \n", tcpheader.sourcePort)
+func client(e *endpoint, data string, done chan<- struct{}) {
+	e.handle(tcpstate.ActiveOpen)
+	e.until(tcpstate.Established)
+	for i := 0; i < len(data); i += 50 {
+		chunk := data[i:min(i+50, len(data))]
+		e.send(segment{flags: ACK, seq: e.seq, ack: e.ack, data: chunk})
+		e.seq += len(chunk)
+		// wait for the ack before sending the next one
+		for acked := false; !acked; {
+			s := <-e.in
+			fmt.Printf("%s %d       received: %s\n", e.name, e.port, fmtSegment(s))
+			acked = s.flags&ACK > 0 && s.ack == e.seq
+		}
 	}
+	e.handle(tcpstate.Close)
+	e.until(tcpstate.TimeWait)
+	time.Sleep(msl2)
+	e.handle(tcpstate.Timeout)
+	close(done)
+}
+
+func server(e *endpoint, done chan<- struct{}) {
+	e.handle(tcpstate.PassiveOpen)
+	e.until(tcpstate.CloseWait)
+	// nothing more to send back, close our side too
+	e.handle(tcpstate.Close)
+	e.until(tcpstate.Closed)
+	close(done)
 }
 
 // Tried to incorporate the State Machine model for the TC protocol...
 func main() {
 	exData := "Lorem Ipsum is simply dummy text of the printing and typesetting industry. Lorem Ipsum has been the industry's standard dummy text ever since the 1500s, when an unknown printer took a galley of type and scrambled it to make a type specimen book. It has survived not only five centuries, but also the leap into electronic typesetting, remaining essentially unchanged. It was popularised in the 1960s with the release of Letraset sheets containing Lorem Ipsum passages, and more recently with desktop publishing software like Aldus PageMaker including versions of Lorem Ipsum."
-	for i := 0; i < len(exData); i = i + 50 {
-		serverchannel := make(chan string, 1)
-		clientchannel := make(chan string, 1)
-		packet := TCPHeader{sourcePort: 123, destinationPort: 456, sequenceNumber: i, acknowledgementNumber: i + 1, data: exData[i : i+50]}
-		initialize(serverchannel, clientchannel, packet)
-	}
+	toServer := make(chan segment, 1)
+	toClient := make(chan segment, 1)
+	c := newEndpoint("CLIENT", 123, 100, toClient, toServer)
+	s := newEndpoint("SERVER", 456, 300, toServer, toClient)
 
+	serverDone, clientDone := make(chan struct{}), make(chan struct{})
+	go server(s, serverDone)
+	// the server has to be listening before the client connects
+	time.Sleep(step)
+	go client(c, exData, clientDone)
+	<-serverDone
+	<-clientDone
+	fmt.Printf("CLIENT %d: %s, SERVER %d: %s\n", c.port, c.m.State(), s.port, s.m.State())
 }
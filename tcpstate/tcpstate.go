@@ -0,0 +1,268 @@
+// Package tcpstate is the TCP connection state machine from RFC 793 (figure 6), as a table
+// of transitions - every state, what can happen in it and what has to be sent because of it.
+// It doesn't send anything itself, whoever uses it does what Transition.Action says, e.g.
+// tcpsimulation.go
+package tcpstate
+
+import (
+	"fmt"
+	"sync"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	Listen
+	SynSent
+	SynReceived
+	Established
+	FinWait1
+	FinWait2
+	CloseWait
+	Closing
+	LastAck
+	TimeWait
+)
+
+var stateNames = [...]string{"CLOSED", "LISTEN", "SYN-SENT", "SYN-RECEIVED", "ESTABLISHED",
+	"FIN-WAIT-1", "FIN-WAIT-2", "CLOSE-WAIT", "CLOSING", "LAST-ACK", "TIME-WAIT"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// Synchronized is true for the states where both ends have agreed on sequence numbers,
+// from ESTABLISHED on - anything but CLOSED, LISTEN, SYN-SENT and SYN-RECEIVED
+func (s State) Synchronized() bool {
+	return s >= Established
+}
+
+// CanSend is true if data can still be sent in s
+func (s State) CanSend() bool {
+	return s == Established || s == CloseWait
+}
+
+// CanRecv is true if the other end can still send data in s
+func (s State) CanRecv() bool {
+	return s == Established || s == FinWait1 || s == FinWait2
+}
+
+// Event is either something the user of the connection does (open, send, close), a segment
+// that was received, or the TIME-WAIT timer running out
+type Event int
+
+const (
+	PassiveOpen Event = iota
+	ActiveOpen
+	// SEND while listening, which turns the passive open into an active one
+	Send
+	Close
+	RecvSyn
+	RecvSynAck
+	// the ACK of our SYN or FIN
+	RecvAck
+	RecvFin
+	// FIN with the ACK of our FIN in the same segment
+	RecvFinAck
+	RecvRst
+	// 2MSL is up
+	Timeout
+)
+
+var eventNames = [...]string{"passive open", "active open", "send", "close", "rcv SYN",
+	"rcv SYN,ACK", "rcv ACK", "rcv FIN", "rcv FIN,ACK", "rcv RST", "timeout"}
+
+func (e Event) String() string {
+	if e < 0 || int(e) >= len(eventNames) {
+		return fmt.Sprintf("Event(%d)", int(e))
+	}
+	return eventNames[e]
+}
+
+// Action is the segment that has to be sent on a transition, if any
+type Action int
+
+const (
+	None Action = iota
+	SendSyn
+	SendSynAck
+	SendAck
+	SendFin
+)
+
+var actionNames = [...]string{"", "snd SYN", "snd SYN,ACK", "snd ACK", "snd FIN"}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+	return actionNames[a]
+}
+
+type Transition struct {
+	From   State
+	Event  Event
+	To     State
+	Action Action
+}
+
+func (t Transition) String() string {
+	s := fmt.Sprintf("%s -> %s (%s", t.From, t.To, t.Event)
+	if t.Action != None {
+		s += " / " + t.Action.String()
+	}
+	return s + ")"
+}
+
+type key struct {
+	s State
+	e Event
+}
+
+type edge struct {
+	to State
+	a  Action
+}
+
+// the arrows of figure 6, plus the resets from section 3.4 and a FIN repeated in TIME-WAIT
+var table = map[key]edge{
+	{Closed, PassiveOpen}: {Listen, None},
+	{Closed, ActiveOpen}:  {SynSent, SendSyn},
+
+	{Listen, RecvSyn}: {SynReceived, SendSynAck},
+	{Listen, Send}:    {SynSent, SendSyn},
+	{Listen, Close}:   {Closed, None},
+
+	// both opened at once
+	{SynSent, RecvSyn}:    {SynReceived, SendAck},
+	{SynSent, RecvSynAck}: {Established, SendAck},
+	{SynSent, Close}:      {Closed, None},
+	{SynSent, RecvRst}:    {Closed, None},
+
+	{SynReceived, RecvAck}: {Established, None},
+	{SynReceived, Close}:   {FinWait1, SendFin},
+	// after a simultaneous open, one that came from LISTEN goes back there (see passiveTable)
+	{SynReceived, RecvRst}: {Closed, None},
+
+	{Established, Close}:   {FinWait1, SendFin},
+	{Established, RecvFin}: {CloseWait, SendAck},
+	{Established, RecvRst}: {Closed, None},
+
+	{FinWait1, RecvAck}: {FinWait2, None},
+	// both closing at once
+	{FinWait1, RecvFin}:    {Closing, SendAck},
+	{FinWait1, RecvFinAck}: {TimeWait, SendAck},
+	{FinWait1, RecvRst}:    {Closed, None},
+
+	{FinWait2, RecvFin}: {TimeWait, SendAck},
+	{FinWait2, RecvRst}: {Closed, None},
+
+	{CloseWait, Close}:   {LastAck, SendFin},
+	{CloseWait, RecvRst}: {Closed, None},
+
+	{Closing, RecvAck}: {TimeWait, None},
+	{Closing, RecvRst}: {Closed, None},
+
+	{LastAck, RecvAck}: {Closed, None},
+	{LastAck, RecvRst}: {Closed, None},
+
+	// the ACK for the other side's FIN got lost, so it sent it again
+	{TimeWait, RecvFin}: {TimeWait, SendAck},
+	{TimeWait, Timeout}: {Closed, None},
+	{TimeWait, RecvRst}: {Closed, None},
+}
+
+// where a connection that came from a passive open differs: a reset in SYN-RECEIVED only
+// gives up on the half open connection, it keeps listening (RFC 793, section 3.4)
+var passiveTable = map[key]edge{
+	{SynReceived, RecvRst}: {Listen, None},
+}
+
+// Next looks up what e does in s, false if it can't happen there. A SYN-RECEIVED that came
+// from LISTEN is different, see NextPassive
+func Next(s State, e Event) (t Transition, ok bool) {
+	return NextPassive(s, e, false)
+}
+
+// NextPassive is Next for a connection that did (passive) or didn't come from LISTEN
+func NextPassive(s State, e Event, passive bool) (t Transition, ok bool) {
+	ed, ok := table[key{s, e}]
+	if passive {
+		if p, isPassive := passiveTable[key{s, e}]; isPassive {
+			ed, ok = p, true
+		}
+	}
+	if !ok {
+		return Transition{}, false
+	}
+	return Transition{From: s, Event: e, To: ed.to, Action: ed.a}, true
+}
+
+// InvalidEventError is returned by Machine.Handle for an event that can't happen in the
+// state the machine is in, the state is left alone
+type InvalidEventError struct {
+	State State
+	Event Event
+}
+
+func (e *InvalidEventError) Error() string {
+	return fmt.Sprintf("tcpstate: %s can't happen in %s", e.Event, e.State)
+}
+
+// Hook is called after every transition a Machine makes
+type Hook func(t Transition)
+
+// Machine is one end of a connection, it starts out CLOSED. It's safe to use from several
+// goroutines, hooks are called outside of the lock so they can look at the machine
+type Machine struct {
+	m     sync.Mutex
+	state State
+	// it got where it is through LISTEN, and a SEND didn't turn that into an active open
+	passive bool
+	hooks   []Hook
+}
+
+func New() *Machine {
+	return &Machine{}
+}
+
+func (m *Machine) State() State {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.state
+}
+
+// OnTransition adds h to the hooks, they're called in the order they were added
+func (m *Machine) OnTransition(h Hook) {
+	m.m.Lock()
+	m.hooks = append(m.hooks, h)
+	m.m.Unlock()
+}
+
+// Handle moves the machine along with e, the returned Transition says what to send
+func (m *Machine) Handle(e Event) (t Transition, err error) {
+	m.m.Lock()
+	t, ok := NextPassive(m.state, e, m.passive)
+	if !ok {
+		err = &InvalidEventError{State: m.state, Event: e}
+		m.m.Unlock()
+		return
+	}
+	m.state = t.To
+	switch t.To {
+	case Listen:
+		m.passive = true
+	case Closed, SynSent:
+		m.passive = false
+	}
+	hooks := m.hooks
+	m.m.Unlock()
+	for _, h := range hooks {
+		h(t)
+	}
+	return
+}
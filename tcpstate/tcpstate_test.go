@@ -0,0 +1,235 @@
+package tcpstate
+
+import (
+	"errors"
+	"testing"
+)
+
+// run feeds events to a new machine, failing on the first one that isn't allowed
+func run(t *testing.T, events ...Event) (*Machine, []Transition) {
+	t.Helper()
+	m := New()
+	var ts []Transition
+	for _, e := range events {
+		tr, err := m.Handle(e)
+		if err != nil {
+			t.Fatalf("after %v: %v", ts, err)
+		}
+		ts = append(ts, tr)
+	}
+	return m, ts
+}
+
+func TestPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  []Event
+		states  []State
+		actions []Action
+	}{
+		{
+			"client open and close",
+			[]Event{ActiveOpen, RecvSynAck, Close, RecvAck, RecvFin, Timeout},
+			[]State{SynSent, Established, FinWait1, FinWait2, TimeWait, Closed},
+			[]Action{SendSyn, SendAck, SendFin, None, SendAck, None},
+		},
+		{
+			"server open and close",
+			[]Event{PassiveOpen, RecvSyn, RecvAck, RecvFin, Close, RecvAck},
+			[]State{Listen, SynReceived, Established, CloseWait, LastAck, Closed},
+			[]Action{None, SendSynAck, None, SendAck, SendFin, None},
+		},
+		{
+			"simultaneous open",
+			[]Event{ActiveOpen, RecvSyn, RecvAck},
+			[]State{SynSent, SynReceived, Established},
+			[]Action{SendSyn, SendAck, None},
+		},
+		{
+			"simultaneous close",
+			[]Event{ActiveOpen, RecvSynAck, Close, RecvFin, RecvAck, Timeout},
+			[]State{SynSent, Established, FinWait1, Closing, TimeWait, Closed},
+			[]Action{SendSyn, SendAck, SendFin, SendAck, None, None},
+		},
+		{
+			"FIN and ACK together",
+			[]Event{ActiveOpen, RecvSynAck, Close, RecvFinAck, Timeout},
+			[]State{SynSent, Established, FinWait1, TimeWait, Closed},
+			[]Action{SendSyn, SendAck, SendFin, SendAck, None},
+		},
+		{
+			"FIN repeated in TIME-WAIT",
+			[]Event{ActiveOpen, RecvSynAck, Close, RecvAck, RecvFin, RecvFin, Timeout},
+			[]State{SynSent, Established, FinWait1, FinWait2, TimeWait, TimeWait, Closed},
+			[]Action{SendSyn, SendAck, SendFin, None, SendAck, SendAck, None},
+		},
+		{
+			"listen then send",
+			[]Event{PassiveOpen, Send, RecvSynAck},
+			[]State{Listen, SynSent, Established},
+			[]Action{None, SendSyn, SendAck},
+		},
+		{
+			"reset while half open goes back to listening",
+			[]Event{PassiveOpen, RecvSyn, RecvRst},
+			[]State{Listen, SynReceived, Listen},
+			[]Action{None, SendSynAck, None},
+		},
+		{
+			"reset after a simultaneous open closes",
+			[]Event{ActiveOpen, RecvSyn, RecvRst},
+			[]State{SynSent, SynReceived, Closed},
+			[]Action{SendSyn, SendAck, None},
+		},
+		{
+			"reset after listen then send closes",
+			[]Event{PassiveOpen, Send, RecvSyn, RecvRst},
+			[]State{Listen, SynSent, SynReceived, Closed},
+			[]Action{None, SendSyn, SendAck, None},
+		},
+		{
+			"listening again after a reset, then a reset after an active open",
+			[]Event{PassiveOpen, RecvSyn, RecvRst, Close, ActiveOpen, RecvSyn, RecvRst},
+			[]State{Listen, SynReceived, Listen, Closed, SynSent, SynReceived, Closed},
+			[]Action{None, SendSynAck, None, None, SendSyn, SendAck, None},
+		},
+		{
+			"reset while established",
+			[]Event{PassiveOpen, RecvSyn, RecvAck, RecvRst},
+			[]State{Listen, SynReceived, Established, Closed},
+			[]Action{None, SendSynAck, None, None},
+		},
+		{
+			"close before established",
+			[]Event{PassiveOpen, RecvSyn, Close, RecvAck, RecvFin, Timeout},
+			[]State{Listen, SynReceived, FinWait1, FinWait2, TimeWait, Closed},
+			[]Action{None, SendSynAck, SendFin, None, SendAck, None},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, ts := run(t, tt.events...)
+			for i, tr := range ts {
+				if tr.To != tt.states[i] || tr.Action != tt.actions[i] {
+					t.Errorf("event %d (%s): got %s %q, want %s %q", i, tt.events[i], tr.To, tr.Action, tt.states[i], tt.actions[i])
+				}
+				if i > 0 && tr.From != ts[i-1].To {
+					t.Errorf("event %d (%s): from %s, but the last transition went to %s", i, tt.events[i], tr.From, ts[i-1].To)
+				}
+			}
+			if got, want := m.State(), tt.states[len(tt.states)-1]; got != want {
+				t.Errorf("ended in %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestInvalidEvent(t *testing.T) {
+	m, _ := run(t, ActiveOpen)
+	_, err := m.Handle(RecvFin)
+	var invalid *InvalidEventError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got %v, want an *InvalidEventError", err)
+	}
+	if invalid.State != SynSent || invalid.Event != RecvFin {
+		t.Errorf("got %s/%s, want SYN-SENT/rcv FIN", invalid.State, invalid.Event)
+	}
+	if m.State() != SynSent {
+		t.Errorf("state changed to %s", m.State())
+	}
+}
+
+// every state can be reached from CLOSED, and every state but CLOSED and LISTEN can get back to it
+func TestReachable(t *testing.T) {
+	reach := func(from State, back bool) map[State]bool {
+		seen := map[State]bool{from: true}
+		queue := []State{from}
+		for len(queue) > 0 {
+			s := queue[0]
+			queue = queue[1:]
+			for k, ed := range table {
+				a, b := k.s, ed.to
+				if back {
+					a, b = b, a
+				}
+				if a == s && !seen[b] {
+					seen[b] = true
+					queue = append(queue, b)
+				}
+			}
+		}
+		return seen
+	}
+	fwd, bwd := reach(Closed, false), reach(Closed, true)
+	for s := Closed; s <= TimeWait; s++ {
+		if !fwd[s] {
+			t.Errorf("%s can't be reached from CLOSED", s)
+		}
+		if !bwd[s] {
+			t.Errorf("%s can't get back to CLOSED", s)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	m := New()
+	var got []Transition
+	m.OnTransition(func(tr Transition) {
+		// hooks are called outside the lock
+		if m.State() != tr.To {
+			t.Errorf("hook sees %s, want %s", m.State(), tr.To)
+		}
+		got = append(got, tr)
+	})
+	m.Handle(ActiveOpen)
+	m.Handle(Timeout) // not allowed, no hook
+	m.Handle(RecvSynAck)
+	want := []Transition{
+		{From: Closed, Event: ActiveOpen, To: SynSent, Action: SendSyn},
+		{From: SynSent, Event: RecvSynAck, To: Established, Action: SendAck},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("hook %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	tr := Transition{From: Established, Event: Close, To: FinWait1, Action: SendFin}
+	if got, want := tr.String(), "ESTABLISHED -> FIN-WAIT-1 (close / snd FIN)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := State(42).String(), "State(42)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for s := Closed; s <= TimeWait; s++ {
+		if s.String() == "" {
+			t.Errorf("state %d has no name", int(s))
+		}
+	}
+}
+
+// Next on its own can't know where SYN-RECEIVED came from, it's the one from an active open
+func TestNextPassive(t *testing.T) {
+	if tr, _ := Next(SynReceived, RecvRst); tr.To != Closed {
+		t.Errorf("Next: got %s, want CLOSED", tr.To)
+	}
+	if tr, _ := NextPassive(SynReceived, RecvRst, true); tr.To != Listen {
+		t.Errorf("NextPassive: got %s, want LISTEN", tr.To)
+	}
+	// everything else is the same either way
+	for k := range table {
+		if _, ok := passiveTable[k]; ok {
+			continue
+		}
+		a, _ := Next(k.s, k.e)
+		p, _ := NextPassive(k.s, k.e, true)
+		if a != p {
+			t.Errorf("%s/%s: %v, passive %v", k.s, k.e, a, p)
+		}
+	}
+}